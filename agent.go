@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Agent sends prompts to a coding assistant CLI. Adapters are selected by
+// agent.type; the default exec adapter runs any command and returns its
+// cleaned output.
+type Agent interface {
+	// Run sends prompt and waits for the answer. onLine, if not nil,
+	// receives human-readable progress lines while the agent works. The
+	// result is never nil; on failure it holds whatever output was produced.
+	Run(runCtx context.Context, prompt string, onLine func(string)) (*AgentResult, error)
+}
+
+// AgentResult is what an agent produced for one prompt
+type AgentResult struct {
+	Output    string // the final answer
+	SessionID string // conversation id, for agents that report one
+	Usage     Usage
+}
+
+// Usage is the token and cost accounting reported by an agent
+type Usage struct {
+	InputTokens      int     `json:"input_tokens,omitempty"`
+	OutputTokens     int     `json:"output_tokens,omitempty"`
+	CacheReadTokens  int     `json:"cache_read_tokens,omitempty"`
+	CacheWriteTokens int     `json:"cache_write_tokens,omitempty"`
+	CostUSD          float64 `json:"cost_usd,omitempty"`
+	Estimated        bool    `json:"estimated,omitempty"` // tokens guessed from prompt and output size
+}
+
+// Add accumulates u2 into u
+func (u *Usage) Add(u2 Usage) {
+	u.InputTokens += u2.InputTokens
+	u.OutputTokens += u2.OutputTokens
+	u.CacheReadTokens += u2.CacheReadTokens
+	u.CacheWriteTokens += u2.CacheWriteTokens
+	u.CostUSD += u2.CostUSD
+	u.Estimated = u.Estimated || u2.Estimated
+}
+
+// agentTypes maps agent.type to the adapter constructor
+var agentTypes = map[string]func(AgentConfig) Agent{
+	"exec":     func(cfg AgentConfig) Agent { return &execAgent{cfg: cfg} },
+	"claude":   func(cfg AgentConfig) Agent { return &claudeAgent{cfg: cfg} },
+	"kiro-cli": func(cfg AgentConfig) Agent { return &kiroAgent{cfg: cfg} },
+	"opencode": func(cfg AgentConfig) Agent { return &opencodeAgent{cfg: cfg} },
+}
+
+// agentDefaultCmd is the binary used by an adapter when cmd is not set
+var agentDefaultCmd = map[string]string{
+	"claude":   "claude",
+	"kiro-cli": "kiro-cli",
+	"opencode": "opencode",
+}
+
+// newAgent returns the adapter for cfg
+func newAgent(cfg AgentConfig) (Agent, error) {
+	typ := cfg.Type
+	if typ == "" {
+		typ = "exec"
+	}
+	newAdapter, ok := agentTypes[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown agent type %q (use %s)", cfg.Type, strings.Join(agentTypeNames(), ", "))
+	}
+	if cfg.Cmd == "" {
+		cfg.Cmd = agentDefaultCmd[typ]
+	}
+	if cfg.Model != "" && typ != "exec" && !hasFlag(cfg.Args, "--model") {
+		cfg.Args = append(append([]string{}, cfg.Args...), "--model", cfg.Model)
+	}
+	return newAdapter(cfg), nil
+}
+
+func agentTypeNames() []string {
+	names := make([]string, 0, len(agentTypes))
+	for name := range agentTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// execAgent runs any command and treats its cleaned output as the answer
+type execAgent struct {
+	cfg AgentConfig
+}
+
+func (a *execAgent) Run(runCtx context.Context, prompt string, onLine func(string)) (*AgentResult, error) {
+	cmd, cleanup, err := newAgentCommand(runCtx, a.cfg, prompt)
+	if err != nil {
+		return &AgentResult{}, err
+	}
+	defer cleanup()
+
+	var output string
+	if onLine != nil {
+		output, err = runCommandWithStreaming(cmd, onLine)
+	} else {
+		output, err = runCommand(cmd)
+	}
+	return &AgentResult{Output: output}, err
+}
+
+// withArgs returns cfg with sub as leading subcommand and flags appended to
+// args, skipping those the user already passed
+func withArgs(cfg AgentConfig, sub string, flags ...string) AgentConfig {
+	var args []string
+	if sub != "" && (len(cfg.Args) == 0 || cfg.Args[0] != sub) {
+		args = append(args, sub)
+	}
+	args = append(args, cfg.Args...)
+
+	for k := 0; k < len(flags); k++ {
+		flag := flags[k]
+		hasValue := k+1 < len(flags) && !strings.HasPrefix(flags[k+1], "-")
+		if !hasFlag(cfg.Args, flag) {
+			args = append(args, flag)
+			if hasValue {
+				args = append(args, flags[k+1])
+			}
+		}
+		if hasValue {
+			k++
+		}
+	}
+
+	cfg.Args = args
+	return cfg
+}
+
+func hasFlag(args []string, flag string) bool {
+	for _, arg := range args {
+		if arg == flag || strings.HasPrefix(arg, flag+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// runLines runs cmd, passing every stdout line to onLine as it arrives.
+// Stderr is kept apart, so structured output stays parseable, and is added
+// to the error when the command fails.
+func runLines(cmd *exec.Cmd, onLine func(string)) error {
+	var output strings.Builder
+	var mu sync.Mutex
+	stdout := &lineWriter{mu: &mu, output: &output, onLine: onLine}
+	var stderr bytes.Buffer
+	cmd.Stdout = stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	stdout.flush()
+
+	if err != nil {
+		if msg := strings.TrimSpace(stripANSI(stderr.String())); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// claudeAgent drives the Claude Code CLI in print mode with stream-json
+// output, so the final answer, session id and cost come from the result
+// event instead of scraped terminal text
+type claudeAgent struct {
+	cfg AgentConfig
+}
+
+// claudeEvent is the subset of a stream-json line the adapter reads
+type claudeEvent struct {
+	Type      string  `json:"type"`
+	Subtype   string  `json:"subtype"`
+	SessionID string  `json:"session_id"`
+	Result    *string `json:"result"`
+	IsError   bool    `json:"is_error"`
+	CostUSD   float64 `json:"total_cost_usd"`
+	Usage     *struct {
+		InputTokens              int `json:"input_tokens"`
+		OutputTokens             int `json:"output_tokens"`
+		CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+		CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	} `json:"usage"`
+	Message *struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+			Name string `json:"name"`
+		} `json:"content"`
+	} `json:"message"`
+}
+
+func (a *claudeAgent) Run(runCtx context.Context, prompt string, onLine func(string)) (*AgentResult, error) {
+	flags := []string{"-p", "--output-format", "stream-json", "--verbose"}
+	if a.cfg.session != "" {
+		flags = append(flags, "--resume", a.cfg.session)
+	}
+	cfg := withArgs(a.cfg, "", flags...)
+	cmd, cleanup, err := newAgentCommand(runCtx, cfg, prompt)
+	if err != nil {
+		return &AgentResult{}, err
+	}
+	defer cleanup()
+
+	p := &claudeParser{onLine: onLine}
+	err = runLines(cmd, p.line)
+	res, perr := p.result()
+	if err == nil {
+		err = perr
+	}
+	return res, err
+}
+
+// claudeParser accumulates stream-json events into an AgentResult
+type claudeParser struct {
+	onLine    func(string)
+	texts     []string // assistant text blocks, the fallback answer
+	final     *claudeEvent
+	sessionID string
+}
+
+func (p *claudeParser) line(line string) {
+	var ev claudeEvent
+	if err := json.Unmarshal([]byte(line), &ev); err != nil || ev.Type == "" {
+		p.show(line)
+		return
+	}
+	if ev.SessionID != "" {
+		p.sessionID = ev.SessionID
+	}
+
+	switch ev.Type {
+	case "assistant":
+		if ev.Message == nil {
+			return
+		}
+		for _, block := range ev.Message.Content {
+			switch block.Type {
+			case "text":
+				p.texts = append(p.texts, block.Text)
+				for _, l := range strings.Split(block.Text, "\n") {
+					p.show(l)
+				}
+			case "tool_use":
+				p.show("⚙ " + block.Name)
+			}
+		}
+	case "result":
+		p.final = &ev
+	}
+}
+
+func (p *claudeParser) show(line string) {
+	if p.onLine != nil {
+		p.onLine(line)
+	}
+}
+
+// result returns the answer, and an error when claude reported one
+func (p *claudeParser) result() (*AgentResult, error) {
+	res := &AgentResult{
+		Output:    strings.Join(p.texts, "\n"),
+		SessionID: p.sessionID,
+	}
+	if p.final == nil {
+		return res, nil
+	}
+
+	if p.final.Result != nil {
+		res.Output = *p.final.Result
+	}
+	res.Usage.CostUSD = p.final.CostUSD
+	if u := p.final.Usage; u != nil {
+		res.Usage.InputTokens = u.InputTokens
+		res.Usage.OutputTokens = u.OutputTokens
+		res.Usage.CacheReadTokens = u.CacheReadInputTokens
+		res.Usage.CacheWriteTokens = u.CacheCreationInputTokens
+	}
+
+	if p.final.IsError {
+		return res, fmt.Errorf("claude: %s: %s", p.final.Subtype, strings.TrimSpace(res.Output))
+	}
+	return res, nil
+}
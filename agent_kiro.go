@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// kiroAgent drives `kiro-cli chat` in non-interactive mode. kiro-cli has no
+// structured output, so the answer is its cleaned terminal text with the
+// "> " response marker removed.
+type kiroAgent struct {
+	cfg AgentConfig
+}
+
+func (a *kiroAgent) Run(runCtx context.Context, prompt string, onLine func(string)) (*AgentResult, error) {
+	base := &execAgent{cfg: withArgs(a.cfg, "chat", "--no-interactive")}
+	res, err := base.Run(runCtx, prompt, onLine)
+	res.Output = cleanKiroOutput(res.Output)
+	return res, err
+}
+
+// cleanKiroOutput drops blank leading lines and the "> " marker kiro-cli
+// prints before its answer
+func cleanKiroOutput(output string) string {
+	lines := strings.Split(output, "\n")
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for k, line := range lines {
+		if rest, ok := strings.CutPrefix(line, "> "); ok {
+			lines[k] = rest
+			break
+		}
+	}
+	return strings.Join(lines, "\n")
+}
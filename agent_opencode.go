@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// opencodeAgent drives `opencode run` with JSON event output
+type opencodeAgent struct {
+	cfg AgentConfig
+}
+
+// opencodeEvent is the subset of a JSON event line the adapter reads
+type opencodeEvent struct {
+	Type      string `json:"type"`
+	SessionID string `json:"sessionID"`
+	Error     *struct {
+		Name string `json:"name"`
+		Data struct {
+			Message string `json:"message"`
+		} `json:"data"`
+	} `json:"error"`
+	Part *struct {
+		Text   string  `json:"text"`
+		Tool   string  `json:"tool"`
+		Cost   float64 `json:"cost"`
+		Tokens *struct {
+			Input  int `json:"input"`
+			Output int `json:"output"`
+			Cache  struct {
+				Read  int `json:"read"`
+				Write int `json:"write"`
+			} `json:"cache"`
+		} `json:"tokens"`
+	} `json:"part"`
+}
+
+func (a *opencodeAgent) Run(runCtx context.Context, prompt string, onLine func(string)) (*AgentResult, error) {
+	flags := []string{"--format", "json"}
+	if a.cfg.session != "" {
+		flags = append(flags, "--session", a.cfg.session)
+	}
+	cfg := withArgs(a.cfg, "run", flags...)
+	cmd, cleanup, err := newAgentCommand(runCtx, cfg, prompt)
+	if err != nil {
+		return &AgentResult{}, err
+	}
+	defer cleanup()
+
+	p := &opencodeParser{onLine: onLine}
+	err = runLines(cmd, p.line)
+	res := &AgentResult{
+		Output:    strings.Join(p.texts, "\n"),
+		SessionID: p.sessionID,
+		Usage:     p.usage,
+	}
+	if err == nil && p.err != "" {
+		err = fmt.Errorf("opencode: %s", p.err)
+	}
+	return res, err
+}
+
+// opencodeParser accumulates JSON events into the answer and usage
+type opencodeParser struct {
+	onLine    func(string)
+	texts     []string
+	sessionID string
+	usage     Usage
+	err       string
+}
+
+func (p *opencodeParser) line(line string) {
+	var ev opencodeEvent
+	if err := json.Unmarshal([]byte(line), &ev); err != nil || ev.Type == "" {
+		p.show(line)
+		return
+	}
+	if ev.SessionID != "" {
+		p.sessionID = ev.SessionID
+	}
+
+	switch ev.Type {
+	case "text":
+		if ev.Part != nil && ev.Part.Text != "" {
+			p.texts = append(p.texts, ev.Part.Text)
+			for _, l := range strings.Split(ev.Part.Text, "\n") {
+				p.show(l)
+			}
+		}
+	case "tool_use":
+		if ev.Part != nil {
+			p.show("⚙ " + ev.Part.Tool)
+		}
+	case "step_finish":
+		if ev.Part == nil {
+			return
+		}
+		p.usage.CostUSD += ev.Part.Cost
+		if t := ev.Part.Tokens; t != nil {
+			p.usage.InputTokens += t.Input
+			p.usage.OutputTokens += t.Output
+			p.usage.CacheReadTokens += t.Cache.Read
+			p.usage.CacheWriteTokens += t.Cache.Write
+		}
+	case "error":
+		p.err = "unknown error"
+		if ev.Error != nil {
+			p.err = ev.Error.Name
+			if ev.Error.Data.Message != "" {
+				p.err += ": " + ev.Error.Data.Message
+			}
+		}
+	}
+}
+
+func (p *opencodeParser) show(line string) {
+	if p.onLine != nil {
+		p.onLine(line)
+	}
+}
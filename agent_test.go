@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeAgent returns a config running testdata/fake-agent with the given
+// adapter type, printing the recorded output in file
+func fakeAgent(t *testing.T, typ, file string) AgentConfig {
+	t.Helper()
+	bin, err := filepath.Abs(filepath.Join("testdata", "fake-agent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FAKE_AGENT_OUTPUT", filepath.Join("testdata", file))
+	return AgentConfig{Type: typ, Cmd: bin}
+}
+
+func TestClaudeAgent(t *testing.T) {
+	cfg := fakeAgent(t, "claude", "claude-stream.jsonl")
+	argsFile := filepath.Join(t.TempDir(), "args")
+	t.Setenv("FAKE_AGENT_ARGS", argsFile)
+	cfg.Args = []string{"--model", "sonnet"}
+
+	var lines []string
+	agent, err := newAgent(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := agent.Run(context.Background(), "check the tests", func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if want := "All tests pass.\nVERDICT: approve"; res.Output != want {
+		t.Errorf("Output = %q, want %q", res.Output, want)
+	}
+	if want := "4f1c2a9e-0b7d-4c55-9a51-2f1f0c6d8e21"; res.SessionID != want {
+		t.Errorf("SessionID = %q, want %q", res.SessionID, want)
+	}
+	wantUsage := Usage{InputTokens: 1200, OutputTokens: 450, CacheReadTokens: 15000, CacheWriteTokens: 3000, CostUSD: 0.0421}
+	if res.Usage != wantUsage {
+		t.Errorf("Usage = %+v, want %+v", res.Usage, wantUsage)
+	}
+	wantLines := []string{"Let me look at the tests first.", "⚙ Bash", "All tests pass.", "VERDICT: approve"}
+	if !reflect.DeepEqual(lines, wantLines) {
+		t.Errorf("streamed lines = %q, want %q", lines, wantLines)
+	}
+
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantArgs := "--model\nsonnet\n-p\n--output-format\nstream-json\n--verbose\ncheck the tests\n"
+	if string(args) != wantArgs {
+		t.Errorf("args = %q, want %q", args, wantArgs)
+	}
+}
+
+func TestClaudeAgentError(t *testing.T) {
+	agent, _ := newAgent(fakeAgent(t, "claude", "claude-error.jsonl"))
+	res, err := agent.Run(context.Background(), "x", nil)
+	if err == nil || !strings.Contains(err.Error(), "error_max_turns: Reached maximum number of turns") {
+		t.Errorf("Run() error = %v, want the reported error", err)
+	}
+	if res.Usage.CostUSD != 0.11 {
+		t.Errorf("cost of a failed run = %v, want 0.11", res.Usage.CostUSD)
+	}
+}
+
+func TestOpencodeAgent(t *testing.T) {
+	cfg := fakeAgent(t, "opencode", "opencode-events.jsonl")
+	argsFile := filepath.Join(t.TempDir(), "args")
+	t.Setenv("FAKE_AGENT_ARGS", argsFile)
+
+	agent, _ := newAgent(cfg)
+	res, err := agent.Run(context.Background(), "vet it", nil)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if want := "Vet is clean.\nNo changes needed."; res.Output != want {
+		t.Errorf("Output = %q, want %q", res.Output, want)
+	}
+	if res.SessionID != "ses_7a1b2c3d4e" {
+		t.Errorf("SessionID = %q", res.SessionID)
+	}
+	wantUsage := Usage{InputTokens: 800, OutputTokens: 120, CacheReadTokens: 4000, CostUSD: 0.0125}
+	if res.Usage != wantUsage {
+		t.Errorf("Usage = %+v, want %+v", res.Usage, wantUsage)
+	}
+
+	args, _ := os.ReadFile(argsFile)
+	if want := "run\n--format\njson\nvet it\n"; string(args) != want {
+		t.Errorf("args = %q, want %q", args, want)
+	}
+}
+
+func TestKiroAgent(t *testing.T) {
+	cfg := fakeAgent(t, "kiro-cli", "kiro-output.txt")
+	argsFile := filepath.Join(t.TempDir(), "args")
+	t.Setenv("FAKE_AGENT_ARGS", argsFile)
+	cfg.Args = []string{"chat", "--model", "haiku"}
+
+	agent, _ := newAgent(cfg)
+	res, err := agent.Run(context.Background(), "what does it do?", nil)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if want := "The function is parseConfig.\nIt reads YAML.\n"; res.Output != want {
+		t.Errorf("Output = %q, want %q", res.Output, want)
+	}
+
+	args, _ := os.ReadFile(argsFile)
+	if want := "chat\n--model\nhaiku\n--no-interactive\nwhat does it do?\n"; string(args) != want {
+		t.Errorf("args = %q, want %q", args, want)
+	}
+}
+
+func TestExecAgentFailure(t *testing.T) {
+	cfg := fakeAgent(t, "", "kiro-output.txt")
+	t.Setenv("FAKE_AGENT_EXIT", "3")
+	t.Setenv("FAKE_AGENT_STDERR", "rate limit exceeded")
+
+	agent, _ := newAgent(cfg)
+	res, err := agent.Run(context.Background(), "x", nil)
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") || !strings.Contains(err.Error(), "rate limit exceeded") {
+		t.Errorf("Run() error = %v", err)
+	}
+	if !strings.Contains(res.Output, "parseConfig") {
+		t.Errorf("Output of a failed run = %q, want what the agent printed", res.Output)
+	}
+}
+
+func TestNewAgentUnknownType(t *testing.T) {
+	if _, err := newAgent(AgentConfig{Type: "gpt", Cmd: "x"}); err == nil || !strings.Contains(err.Error(), "claude, exec, kiro-cli, opencode") {
+		t.Errorf("newAgent() error = %v", err)
+	}
+}
+
+func TestWithArgs(t *testing.T) {
+	cfg := AgentConfig{Args: []string{"--output-format=text", "-p"}}
+	got := withArgs(cfg, "", "-p", "--output-format", "stream-json", "--verbose").Args
+	want := []string{"--output-format=text", "-p", "--verbose"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("withArgs() = %q, want %q", got, want)
+	}
+}
+
+func TestNewAgentModel(t *testing.T) {
+	tests := []struct {
+		cfg  AgentConfig
+		want []string
+	}{
+		{AgentConfig{Type: "claude", Model: "haiku"}, []string{"--model", "haiku"}},
+		{AgentConfig{Type: "claude", Model: "haiku", Args: []string{"--model", "opus"}}, []string{"--model", "opus"}},
+		{AgentConfig{Cmd: "my-agent", Model: "haiku", Args: []string{"-q"}}, []string{"-q"}},
+	}
+
+	for _, tt := range tests {
+		agent, err := newAgent(tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		switch a := agent.(type) {
+		case *claudeAgent:
+			got = a.cfg.Args
+		case *execAgent:
+			got = a.cfg.Args
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("newAgent(%+v) args = %q, want %q", tt.cfg, got, tt.want)
+		}
+	}
+}
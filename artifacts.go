@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Default size limits of the project files a step loads
+const (
+	defaultMaxFileSize  = 64 * 1024
+	defaultMaxTotalSize = 512 * 1024
+)
+
+func getArtifactsDir() string {
+	return filepath.Join(".octos", "artifacts")
+}
+
+// StringList is a YAML string or list of strings
+type StringList []string
+
+func (l *StringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var s string
+		if err := node.Decode(&s); err != nil {
+			return err
+		}
+		*l = StringList{s}
+		return nil
+	}
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// SaveSpec says where and how a step saves its output as an artifact. In
+// YAML it is a file name, or a map.
+type SaveSpec struct {
+	File    string `yaml:"file"`
+	Extract string `yaml:"extract"` // code: first fenced code block, json: the JSON output, pretty-printed
+	Lang    string `yaml:"lang"`    // with extract: code, the language the block must be tagged with
+	Append  bool   `yaml:"append"`  // add to the artifact instead of replacing it
+}
+
+func (s *SaveSpec) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*s = SaveSpec{File: node.Value}
+		return nil
+	}
+	type plain SaveSpec
+	return node.Decode((*plain)(s))
+}
+
+func (s SaveSpec) validate() error {
+	if s.File == "" {
+		if s.Extract != "" || s.Lang != "" || s.Append {
+			return errors.New("file is required")
+		}
+		return nil
+	}
+	if !filepath.IsLocal(s.File) {
+		return fmt.Errorf("%s: must be a relative path inside the artifacts directory", s.File)
+	}
+	switch s.Extract {
+	case "", "code", "json":
+	default:
+		return fmt.Errorf("extract must be code or json, got %q", s.Extract)
+	}
+	if s.Lang != "" && s.Extract != "code" {
+		return errors.New("lang requires extract: code")
+	}
+	return nil
+}
+
+var taggedBlockRegex = regexp.MustCompile("(?s)```([a-zA-Z0-9_+-]*)[ \\t]*\\n(.*?)```")
+
+// render returns the artifact content for output
+func (s SaveSpec) render(output string) (string, error) {
+	switch s.Extract {
+	case "code":
+		for _, m := range taggedBlockRegex.FindAllStringSubmatch(output, -1) {
+			if s.Lang == "" || strings.EqualFold(m[1], s.Lang) {
+				return m[2], nil
+			}
+		}
+		if s.Lang != "" {
+			return "", fmt.Errorf("no %s code block in the output", s.Lang)
+		}
+		return "", errors.New("no code block in the output")
+	case "json":
+		doc, err := parseJSONOutput(output)
+		if err != nil {
+			return "", err
+		}
+		data, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		return string(data) + "\n", nil
+	}
+	return output, nil
+}
+
+// FileInputs are the project files a step loads into {{files.*}}. In YAML
+// it is a glob pattern, a list of them, or a map with limits.
+type FileInputs struct {
+	Include      []string `yaml:"include"`        // glob patterns relative to the working directory; ** matches any directories
+	MaxFileSize  int      `yaml:"max_file_size"`  // bytes kept per file; longer files are truncated
+	MaxTotalSize int      `yaml:"max_total_size"` // bytes loaded in total; files past it are left out
+}
+
+func (f *FileInputs) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		var patterns StringList
+		if err := node.Decode(&patterns); err != nil {
+			return err
+		}
+		*f = FileInputs{Include: patterns}
+		return nil
+	}
+	type plain FileInputs
+	return node.Decode((*plain)(f))
+}
+
+func (f FileInputs) validate() error {
+	for _, pattern := range f.Include {
+		if err := validateGlob(pattern); err != nil {
+			return err
+		}
+	}
+	if f.MaxFileSize < 0 || f.MaxTotalSize < 0 {
+		return errors.New("size limits must be positive")
+	}
+	return nil
+}
+
+func (f FileInputs) maxFileSize() int {
+	if f.MaxFileSize > 0 {
+		return f.MaxFileSize
+	}
+	return defaultMaxFileSize
+}
+
+func (f FileInputs) maxTotalSize() int {
+	if f.MaxTotalSize > 0 {
+		return f.MaxTotalSize
+	}
+	return defaultMaxTotalSize
+}
+
+// validateGlob checks that pattern is a valid glob that stays inside the
+// directory it is matched against
+func validateGlob(pattern string) error {
+	if !filepath.IsLocal(pattern) {
+		return fmt.Errorf("%s: must be a relative path inside the project", pattern)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("%s: %w", pattern, err)
+	}
+	return nil
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// matchGlob reports whether the slash-separated name matches pattern, where
+// a ** segment matches any number of directories
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for k := 0; k <= len(name); k++ {
+			if matchSegments(pattern[1:], name[k:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], name[0])
+	return ok && matchSegments(pattern[1:], name[1:])
+}
+
+// walkFiles returns the files under root, as slash-separated paths relative
+// to it, leaving out hidden files and directories and node_modules
+func walkFiles(root string) []string {
+	var files []string
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := d.Name()
+		if p != root && (strings.HasPrefix(name, ".") || name == "node_modules") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if rel, err := filepath.Rel(root, p); err == nil {
+				files = append(files, filepath.ToSlash(rel))
+			}
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+// artifactName is how an artifact file is referenced: {{artifact.<name>}}
+func artifactName(file string) string {
+	return strings.TrimSuffix(file, path.Ext(file))
+}
+
+// findArtifact returns the path of the artifact file for name, which may
+// omit the extension, looking in dirs in order. It returns "" if there is
+// none.
+func findArtifact(dirs []string, name string) string {
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && !info.IsDir() {
+			return filepath.Join(dir, name)
+		}
+		matches, _ := filepath.Glob(filepath.Join(dir, name+".*"))
+		sort.Strings(matches)
+		if len(matches) > 0 {
+			return matches[0]
+		}
+	}
+	return ""
+}
+
+// globArtifacts returns the artifact files in dirs matching pattern, by
+// name relative to their directory. Earlier dirs win.
+func globArtifacts(dirs []string, pattern string) map[string]string {
+	found := make(map[string]string)
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		for _, file := range walkFiles(dir) {
+			if _, ok := found[file]; !ok && matchGlob(pattern, file) {
+				found[file] = filepath.Join(dir, filepath.FromSlash(file))
+			}
+		}
+	}
+	return found
+}
+
+// loadsArtifact reports whether step loads the artifact called name
+func (s Step) loadsArtifact(name string) bool {
+	for _, entry := range s.LoadFrom {
+		if entry == name || artifactName(entry) == name {
+			return true
+		}
+		if isGlob(entry) && (matchGlob(entry, name) || matchGlob(artifactName(entry), name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateArtifacts checks the load_from, save_to and files of step
+func (s Step) validateArtifacts() error {
+	for _, entry := range s.LoadFrom {
+		if err := validateGlob(entry); err != nil {
+			return fmt.Errorf("load_from: %w", err)
+		}
+	}
+	if err := s.SaveTo.validate(); err != nil {
+		return fmt.Errorf("save_to: %w", err)
+	}
+	if err := s.Files.validate(); err != nil {
+		return fmt.Errorf("files: %w", err)
+	}
+	return nil
+}
+
+// artifactDirs are the directories artifacts are read from: the ones this
+// run saved, then the latest ones of any run
+func (r *pipelineRun) artifactDirs() []string {
+	if r.log == nil {
+		return []string{getArtifactsDir()}
+	}
+	return []string{filepath.Join(r.log.dir, "artifacts"), getArtifactsDir()}
+}
+
+// loadArtifacts loads the load_from artifacts of step i into the context
+func (r *pipelineRun) loadArtifacts(i int) {
+	step := r.p.Steps[i]
+	dirs := r.artifactDirs()
+
+	loaded := make(map[string]string) // name -> path
+	for _, entry := range step.LoadFrom {
+		if isGlob(entry) {
+			matches := globArtifacts(dirs, entry)
+			if len(matches) == 0 && !r.silent {
+				fmt.Printf("⚠ Warning: no artifacts match %s\n", entry)
+			}
+			for file, p := range matches {
+				loaded[artifactName(file)] = p
+			}
+			continue
+		}
+		p := findArtifact(dirs, entry)
+		if p == "" {
+			if !r.silent {
+				fmt.Printf("⚠ Warning: could not load artifact %s: not found\n", entry)
+			}
+			continue
+		}
+		loaded[artifactName(entry)] = p
+	}
+
+	for _, name := range sortedKeys(loaded) {
+		data, err := os.ReadFile(loaded[name])
+		if err != nil {
+			if !r.silent {
+				fmt.Printf("⚠ Warning: could not load artifact %s: %v\n", name, err)
+			}
+			continue
+		}
+		r.mu.Lock()
+		r.artifacts[name] = string(data)
+		r.ctx.Outputs["artifact."+name] = string(data)
+		r.mu.Unlock()
+	}
+}
+
+// saveArtifact writes the save_to artifact of step i from output, to the
+// run's own copy and then to the artifacts directory, and returns its file
+// name. append adds to the run's copy, so concurrent and resumed runs do not
+// append to each other's; the first append of a run starts from the latest.
+func (r *pipelineRun) saveArtifact(i int, output string) (string, error) {
+	spec := r.p.Steps[i].SaveTo
+	content, err := spec.render(output)
+	if err != nil {
+		return "", err
+	}
+	if spec.Append {
+		old, err := loadArtifact(spec.File)
+		if own, ownErr := os.ReadFile(r.log.artifactFile(spec.File)); ownErr == nil {
+			old, err = string(own), nil
+		}
+		if err == nil && old != "" {
+			if !strings.HasSuffix(old, "\n") {
+				old += "\n"
+			}
+			content = old + content
+		}
+	}
+	if err := r.log.artifact(spec.File, content); err != nil {
+		return "", err
+	}
+	if err := saveArtifact(spec.File, content); err != nil {
+		return "", err
+	}
+	return spec.File, nil
+}
+
+// loadFiles reads the project files of step i, within its size limits
+func (r *pipelineRun) loadFiles(i int) map[string]string {
+	spec := r.p.Steps[i].Files
+	if len(spec.Include) == 0 {
+		return nil
+	}
+	warn := func(format string, args ...any) {
+		if !r.silent {
+			fmt.Printf("⚠ Warning: "+format+"\n", args...)
+		}
+	}
+
+	files := make(map[string]string)
+	total := 0
+	for _, name := range walkProject(r.workdir(), true) {
+		if strings.HasPrefix(name, ".") || strings.Contains(name, "/.") {
+			continue // hidden
+		}
+		if !slices.ContainsFunc(spec.Include, func(pattern string) bool { return matchGlob(pattern, name) }) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(r.workdir(), filepath.FromSlash(name)))
+		if err != nil {
+			warn("could not load %s: %v", name, err)
+			continue
+		}
+		if bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+			continue // binary
+		}
+		if len(data) > spec.maxFileSize() {
+			warn("%s is %d bytes, only the first %d are loaded", name, len(data), spec.maxFileSize())
+			data = append(data[:spec.maxFileSize():spec.maxFileSize()], []byte("\n[... truncated]")...)
+		}
+		if total+len(data) > spec.maxTotalSize() {
+			warn("files of step %s exceed %d bytes, %s and the files after it are left out", r.p.Steps[i].Name, spec.maxTotalSize(), name)
+			break
+		}
+		total += len(data)
+		files[name] = string(data)
+	}
+	if len(files) == 0 {
+		warn("no files match %s", strings.Join(spec.Include, ", "))
+	}
+	return files
+}
+
+// renderFiles formats loaded files for {{files}}
+func renderFiles(files map[string]string) string {
+	var buf strings.Builder
+	for _, name := range sortedKeys(files) {
+		fmt.Fprintf(&buf, "=== %s ===\n%s", name, files[name])
+		if !strings.HasSuffix(files[name], "\n") {
+			buf.WriteString("\n")
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "src/main.go", false},
+		{"src/*.go", "src/main.go", true},
+		{"src/**/*.go", "src/main.go", true},
+		{"src/**/*.go", "src/a/b/c.go", true},
+		{"src/**/*.go", "lib/a.go", false},
+		{"**", "a/b", true},
+		{"**/test_*.py", "pkg/test_x.py", true},
+		{"reviews/*", "reviews/a.md", true},
+	}
+
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestArtifactYAML(t *testing.T) {
+	var step Step
+	err := yaml.Unmarshal([]byte(`
+load_from: plan.md
+save_to: {file: out.json, extract: json, append: true}
+files: {include: ["src/**/*.go", go.mod], max_file_size: 100}
+`), &step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(step.LoadFrom, StringList{"plan.md"}) {
+		t.Errorf("load_from = %q", step.LoadFrom)
+	}
+	if want := (SaveSpec{File: "out.json", Extract: "json", Append: true}); step.SaveTo != want {
+		t.Errorf("save_to = %+v", step.SaveTo)
+	}
+	if want := (FileInputs{Include: []string{"src/**/*.go", "go.mod"}, MaxFileSize: 100}); !reflect.DeepEqual(step.Files, want) {
+		t.Errorf("files = %+v", step.Files)
+	}
+
+	step = Step{}
+	if err := yaml.Unmarshal([]byte("load_from: [a.md, 'b/*']\nsave_to: plan.md\nfiles: '*.go'"), &step); err != nil {
+		t.Fatal(err)
+	}
+	if len(step.LoadFrom) != 2 || step.SaveTo.File != "plan.md" || step.Files.Include[0] != "*.go" {
+		t.Errorf("short forms = %+v", step)
+	}
+}
+
+func TestValidateArtifacts(t *testing.T) {
+	tests := []struct {
+		name    string
+		step    Step
+		wantErr string
+	}{
+		{"valid", Step{LoadFrom: StringList{"a.md", "reviews/*.md"}, SaveTo: SaveSpec{File: "x/y.go", Extract: "code", Lang: "go"}, Files: FileInputs{Include: []string{"src/**"}}}, ""},
+		{"load outside", Step{LoadFrom: StringList{"../secret"}}, "load_from: ../secret: must be a relative path"},
+		{"bad glob", Step{LoadFrom: StringList{"[a"}}, "load_from: [a: syntax error"},
+		{"save outside", Step{SaveTo: SaveSpec{File: "/tmp/x"}}, "save_to: /tmp/x: must be a relative path"},
+		{"no file", Step{SaveTo: SaveSpec{Append: true}}, "save_to: file is required"},
+		{"bad extract", Step{SaveTo: SaveSpec{File: "a", Extract: "xml"}}, "extract must be code or json"},
+		{"lang without code", Step{SaveTo: SaveSpec{File: "a", Lang: "go"}}, "lang requires extract: code"},
+		{"files outside", Step{Files: FileInputs{Include: []string{"../*.go"}}}, "files: ../*.go: must be a relative path"},
+		{"negative limit", Step{Files: FileInputs{Include: []string{"*"}, MaxTotalSize: -1}}, "size limits must be positive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.step.validateArtifacts()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSaveSpecRender(t *testing.T) {
+	output := "Plan:\n```json\n{\"steps\": [1]}\n```\n```go\nfunc main() {}\n```\n"
+
+	tests := []struct {
+		name    string
+		spec    SaveSpec
+		want    string
+		wantErr string
+	}{
+		{"raw", SaveSpec{File: "a"}, output, ""},
+		{"first code block", SaveSpec{File: "a", Extract: "code"}, "{\"steps\": [1]}\n", ""},
+		{"code block by language", SaveSpec{File: "a", Extract: "code", Lang: "go"}, "func main() {}\n", ""},
+		{"missing language", SaveSpec{File: "a", Extract: "code", Lang: "rust"}, "", "no rust code block"},
+		{"json", SaveSpec{File: "a", Extract: "json"}, "{\n  \"steps\": [\n    1\n  ]\n}\n", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.spec.render(output)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadFiles(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for name, content := range map[string]string{
+		"src/main.go":         "package main\n",
+		"src/pkg/long.go":     strings.Repeat("x", 30),
+		"src/pkg/z.go":        "package z\n",
+		"src/bin.go":          "a\x00b",
+		"src/readme.md":       "no",
+		".git/config.go":      "hidden",
+		".cache/c.go":         "hidden",
+		"node_modules/m/a.go": "vendored",
+		".gitignore":          "gen/\n",
+		".octosignore":        "fixture.go\n",
+		"src/gen/out.go":      "generated",
+		"src/fixture.go":      "fixture",
+	} {
+		os.MkdirAll(filepath.Dir(name), 0755)
+		os.WriteFile(name, []byte(content), 0644)
+	}
+
+	tests := []struct {
+		name  string
+		files FileInputs
+		want  []string
+	}{
+		{"recursive", FileInputs{Include: []string{"src/**/*.go"}}, []string{"src/main.go", "src/pkg/long.go", "src/pkg/z.go"}},
+		{"one directory", FileInputs{Include: []string{"src/*.go"}}, []string{"src/main.go"}},
+		{"total limit", FileInputs{Include: []string{"**/*.go"}, MaxTotalSize: 40}, []string{"src/main.go"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &pipelineRun{p: &Pipeline{Steps: []Step{{Name: "a", Files: tt.files}}}, silent: true}
+			files := r.loadFiles(0)
+			if got := sortedKeys(files); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("files = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	r := &pipelineRun{p: &Pipeline{Steps: []Step{{Name: "a", Files: FileInputs{Include: []string{"src/pkg/long.go"}, MaxFileSize: 10}}}}, silent: true}
+	if got := r.loadFiles(0)["src/pkg/long.go"]; got != "xxxxxxxxxx\n[... truncated]" {
+		t.Errorf("truncated file = %q", got)
+	}
+}
+
+func TestArtifactsPerRun(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll(getArtifactsDir(), 0755)
+	p := &Pipeline{
+		File:  "p.yaml",
+		Agent: AgentConfig{Cmd: "echo"},
+		Steps: []Step{
+			{Name: "plan", Run: "echo mine", SaveTo: SaveSpec{File: "plan.txt", Append: true}},
+			// Another run overwrites the shared copy in the meantime
+			{Name: "other", Run: "echo theirs > .octos/artifacts/plan.txt"},
+			{Name: "more", Run: "echo more", SaveTo: SaveSpec{File: "plan.txt", Append: true}},
+			{Name: "use", Run: `printf 'got %s' "{{artifact.plan}}"`},
+			{Name: "load", Run: "true", LoadFrom: StringList{"*.txt"}, When: `{{artifact.plan}} contains "mine"`},
+		},
+	}
+
+	var outputs []string
+	cb := Callbacks{OnOutput: func(_ int, output string) { outputs = append(outputs, output) }}
+	if err := RunPipelineWithCallbacks(context.Background(), p, cb, RunOptions{Iteration: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if outputs[3] != "got mine\nmore\n" {
+		t.Errorf("{{artifact.plan}} = %q, want this run's artifact", outputs[3])
+	}
+	if len(outputs) != 5 {
+		t.Errorf("the load step did not see this run's artifact: outputs %q", outputs)
+	}
+	if content, _ := loadArtifact("plan.txt"); content != "mine\nmore\n" {
+		t.Errorf("shared artifact = %q, want the latest run's", content)
+	}
+
+	// A new run appends to the latest copy, a resumed one to its own
+	p.Steps = []Step{
+		{Name: "plan", Run: "echo again", SaveTo: SaveSpec{File: "plan.txt", Append: true}},
+		{Name: "gate", Run: "test -f ok"},
+		{Name: "more", Run: "echo resumed", SaveTo: SaveSpec{File: "plan.txt", Append: true}},
+	}
+	if err := RunPipelineWithCallbacks(context.Background(), p, Callbacks{}, RunOptions{Iteration: 1}); err == nil {
+		t.Fatal("expected the gate step to fail")
+	}
+	if content, _ := loadArtifact("plan.txt"); content != "mine\nmore\nagain\n" {
+		t.Errorf("appended artifact = %q", content)
+	}
+	saveArtifact("plan.txt", "theirs\n")
+	os.WriteFile("ok", nil, 0644)
+	if err := RunPipelineWithCallbacks(context.Background(), p, Callbacks{}, RunOptions{Resume: true, Iteration: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := loadArtifact("plan.txt"); content != "mine\nmore\nagain\nresumed\n" {
+		t.Errorf("artifact appended on resume = %q", content)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// charsPerToken is the rough ratio used to turn a token budget into characters
+const charsPerToken = 4
+
+// defaultSummaryChars is the summary length asked for when max_chars is unset
+const defaultSummaryChars = 1000
+
+// defaultSummaryPrompt asks the summarize agent to compress a step output
+const defaultSummaryPrompt = "Resume el siguiente output del paso anterior en un máximo de %d caracteres. " +
+	"Conserva decisiones, nombres de ficheros, comandos y datos concretos. Responde solo con el resumen."
+
+// ContextBudget caps the size of a step prompt, in characters. In YAML it
+// is a number of characters ("20000", "20000 chars") or of estimated
+// tokens ("5000 tokens").
+type ContextBudget int
+
+func (b *ContextBudget) UnmarshalYAML(node *yaml.Node) error {
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return err
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("context_budget: expected a number with an optional unit, got %q", s)
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil || n < 0 {
+		return fmt.Errorf("context_budget: invalid number %q", fields[0])
+	}
+
+	unit := "chars"
+	if len(fields) == 2 {
+		unit = fields[1]
+	}
+	switch unit {
+	case "chars", "characters":
+		*b = ContextBudget(n)
+	case "tokens":
+		*b = ContextBudget(n * charsPerToken)
+	default:
+		return fmt.Errorf("context_budget: unknown unit %q (use chars or tokens)", unit)
+	}
+	return nil
+}
+
+// SummarizeConfig enables compressing older outputs once the budget is exceeded
+type SummarizeConfig struct {
+	Agent    *AgentConfig `yaml:"agent"`     // defaults to the pipeline agent
+	Prompt   string       `yaml:"prompt"`    // instructions placed before the output
+	MaxChars int          `yaml:"max_chars"` // summary length to ask for
+}
+
+// OutputPolicy selects which previous outputs a step sees in its prompt.
+// In YAML it is "all" (default), "none", "last N" or a list of step names.
+type OutputPolicy struct {
+	None  bool
+	Last  int      // keep the last N outputs, if > 0
+	Steps []string // keep only these steps, if set
+}
+
+func (o *OutputPolicy) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		var steps []string
+		if err := node.Decode(&steps); err != nil {
+			return err
+		}
+		*o = OutputPolicy{Steps: steps, None: len(steps) == 0}
+		return nil
+	}
+
+	var s string
+	if err := node.Decode(&s); err != nil {
+		return err
+	}
+	fields := strings.Fields(s)
+	switch {
+	case s == "all":
+		*o = OutputPolicy{}
+	case s == "none":
+		*o = OutputPolicy{None: true}
+	case len(fields) == 2 && fields[0] == "last":
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("include_outputs: invalid count in %q", s)
+		}
+		*o = OutputPolicy{Last: n}
+	default:
+		return fmt.Errorf("include_outputs: expected all, none, last N or a list of steps, got %q", s)
+	}
+	return nil
+}
+
+// apply returns the step outputs (given in pipeline order) that the policy keeps
+func (o OutputPolicy) apply(names []string) []string {
+	switch {
+	case o.None:
+		return nil
+	case o.Steps != nil:
+		keep := make(map[string]bool, len(o.Steps))
+		for _, name := range o.Steps {
+			keep[name] = true
+		}
+		var kept []string
+		for _, name := range names {
+			if keep[name] {
+				kept = append(kept, name)
+			}
+		}
+		return kept
+	case o.Last > 0 && len(names) > o.Last:
+		return names[len(names)-o.Last:]
+	default:
+		return names
+	}
+}
+
+// OutputSummary is a cached summary of a step output
+type OutputSummary struct {
+	Hash string `json:"hash"` // hash of the summarized output
+	Text string `json:"text"`
+}
+
+// contentHash identifies a step output or prompt by a short hash of its text
+func contentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:8])
+}
+
+// selectOutputs narrows visible to the outputs step i includes in its
+// prompt. Loaded artifacts are always kept.
+func (r *pipelineRun) selectOutputs(i int, visible *Context) *Context {
+	var steps, extra []string
+	for _, name := range visible.order {
+		if r.p.StepIndex(name) >= 0 {
+			steps = append(steps, name)
+		} else {
+			extra = append(extra, name)
+		}
+	}
+
+	selected := *visible
+	selected.Outputs = make(map[string]string)
+	selected.order = nil
+	for _, name := range append(r.p.Steps[i].IncludeOutputs.apply(steps), extra...) {
+		selected.Outputs[name] = visible.Outputs[name]
+		selected.order = append(selected.order, name)
+	}
+	return &selected
+}
+
+// fitBudget shrinks the previous outputs of ctx, oldest first, until the
+// prompt for task fits the context budget. Outputs are summarized when
+// summarize is configured and truncated otherwise.
+func (r *pipelineRun) fitBudget(i int, ctx *Context, task string) string {
+	budget := int(r.p.ContextBudget)
+	fullPrompt := buildPrompt(ctx, task)
+	if budget == 0 || len(fullPrompt) <= budget {
+		return fullPrompt
+	}
+
+	for _, name := range ctx.order {
+		output := ctx.Outputs[name]
+		if r.p.Summarize != nil {
+			summary, err := r.summarize(i, name, output)
+			if err == nil && len(summary) < len(output) {
+				output = summary
+			} else if err != nil && !r.silent {
+				fmt.Printf("⚠ Warning: could not summarize %s: %v\n", name, err)
+			}
+		}
+
+		excess := len(buildPrompt(ctx, task)) - len(ctx.Outputs[name]) + len(output) - budget
+		if excess > 0 {
+			output = truncateOutput(output, len(output)-excess)
+		}
+		ctx.Outputs[name] = output
+
+		fullPrompt = buildPrompt(ctx, task)
+		if len(fullPrompt) <= budget {
+			return fullPrompt
+		}
+	}
+
+	if !r.silent {
+		fmt.Printf("⚠ Warning: prompt for step %s is %d characters, over the context budget of %d\n", r.p.Steps[i].Name, len(fullPrompt), budget)
+	}
+	return fullPrompt
+}
+
+// truncateOutput cuts output to at most max bytes, noting how much was left out
+func truncateOutput(output string, max int) string {
+	const note = "\n[... %d caracteres omitidos]"
+	cut := max - len(fmt.Sprintf(note, len(output)))
+	if cut <= 0 {
+		return strings.TrimSpace(fmt.Sprintf(note, len(output)))
+	}
+	for cut > 0 && !utf8.RuneStart(output[cut]) {
+		cut--
+	}
+	return output[:cut] + fmt.Sprintf(note, len(output)-cut)
+}
+
+// summarize asks the summarize agent to compress output for the prompt of
+// step i, reusing a summary cached in the state when the output has not
+// changed
+func (r *pipelineRun) summarize(i int, name, output string) (string, error) {
+	hash := contentHash(output)
+
+	r.mu.Lock()
+	cached := r.state.Summaries[name]
+	r.mu.Unlock()
+	if cached != nil && cached.Hash == hash {
+		return cached.Text, nil
+	}
+
+	cfg := r.p.Summarize
+	agent := r.p.Agent
+	if cfg.Agent != nil {
+		agent = *cfg.Agent
+	}
+	maxChars := cfg.MaxChars
+	if maxChars == 0 {
+		maxChars = defaultSummaryChars
+	}
+	instructions := cfg.Prompt
+	if instructions == "" {
+		instructions = fmt.Sprintf(defaultSummaryPrompt, maxChars)
+	}
+
+	if !r.silent {
+		fmt.Printf("✂ Summarizing output of %s\n", name)
+	}
+	key := r.p.Steps[i].Name
+	if r.mock != nil {
+		key = mockSummaryKey
+	}
+	adapter, err := r.agentFor(key, agent)
+	if err != nil {
+		return "", err
+	}
+	prompt := instructions + "\n\n" + output
+	result, err := adapter.Run(r.runCtx, prompt, nil)
+	r.addUsage(i, r.p.meterUsage(agent, prompt, result))
+	if err != nil {
+		return "", err
+	}
+	summary := strings.TrimSpace(result.Output)
+
+	r.mu.Lock()
+	if r.state.Summaries == nil {
+		r.state.Summaries = make(map[string]*OutputSummary)
+	}
+	r.state.Summaries[name] = &OutputSummary{Hash: hash, Text: summary}
+	SaveState(r.state)
+	r.mu.Unlock()
+
+	return summary, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestContextBudgetYAML(t *testing.T) {
+	tests := []struct {
+		yaml    string
+		want    ContextBudget
+		wantErr bool
+	}{
+		{"20000", 20000, false},
+		{"20000 chars", 20000, false},
+		{"5000 tokens", 5000 * charsPerToken, false},
+		{"lots", 0, true},
+		{"5000 words", 0, true},
+		{"-1", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.yaml, func(t *testing.T) {
+			var got ContextBudget
+			err := yaml.Unmarshal([]byte(tt.yaml), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal(%q) error = %v, wantErr %v", tt.yaml, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Unmarshal(%q) = %d, want %d", tt.yaml, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputPolicy(t *testing.T) {
+	names := []string{"a", "b", "c", "d"}
+
+	tests := []struct {
+		yaml    string
+		want    []string
+		wantErr bool
+	}{
+		{"all", names, false},
+		{"none", nil, false},
+		{"last 2", []string{"c", "d"}, false},
+		{"last 9", names, false},
+		{"[d, b]", []string{"b", "d"}, false},
+		{"[]", nil, false},
+		{"last zero", nil, true},
+		{"some", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.yaml, func(t *testing.T) {
+			var policy OutputPolicy
+			err := yaml.Unmarshal([]byte(tt.yaml), &policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal(%q) error = %v, wantErr %v", tt.yaml, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := policy.apply(names); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("apply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateOutput(t *testing.T) {
+	output := strings.Repeat("x", 500)
+	got := truncateOutput(output, 100)
+	if len(got) > 100 {
+		t.Errorf("len = %d, want at most 100", len(got))
+	}
+	if !strings.HasSuffix(got, "caracteres omitidos]") {
+		t.Errorf("truncateOutput() = %q, want an omission note", got)
+	}
+
+	// Multi-byte runes are never split
+	got = truncateOutput(strings.Repeat("ñ", 100), 60)
+	if !strings.HasPrefix(got, "ññ") || strings.ContainsRune(got, '�') {
+		t.Errorf("truncateOutput() split a rune: %q", got)
+	}
+}
+
+func TestFitBudget(t *testing.T) {
+	p := &Pipeline{
+		ContextBudget: 400,
+		Steps:         []Step{{Name: "old"}, {Name: "new"}, {Name: "task"}},
+	}
+	r := &pipelineRun{runCtx: context.Background(), p: p, silent: true}
+
+	ctx := &Context{
+		Global:  map[string]any{"project": "demo"},
+		Outputs: map[string]string{"old": strings.Repeat("o", 300), "new": strings.Repeat("n", 100)},
+		order:   []string{"old", "new"},
+	}
+	prompt := r.fitBudget(2, ctx, "do it")
+
+	if len(prompt) > 400 {
+		t.Errorf("prompt is %d bytes, budget is 400", len(prompt))
+	}
+	if !strings.Contains(prompt, strings.Repeat("n", 100)) {
+		t.Error("newest output was shrunk before the oldest one")
+	}
+	if !strings.Contains(prompt, "do it") {
+		t.Error("task is missing from the prompt")
+	}
+}
+
+func TestSummarizeCache(t *testing.T) {
+	p := &Pipeline{
+		ContextBudget: 200,
+		Summarize:     &SummarizeConfig{Agent: &AgentConfig{Cmd: "sh", Args: []string{"-c", "echo short"}}},
+		Steps:         []Step{{Name: "old"}, {Name: "task"}},
+	}
+	r := &pipelineRun{runCtx: context.Background(), p: p, silent: true, state: &PipelineState{}}
+	t.Chdir(t.TempDir())
+
+	output := strings.Repeat("o", 500)
+	ctx := &Context{Outputs: map[string]string{"old": output}, order: []string{"old"}}
+	prompt := r.fitBudget(1, ctx, "do it")
+
+	if strings.Contains(prompt, "ooo") {
+		t.Errorf("output was not summarized: %q", prompt)
+	}
+	cached := r.state.Summaries["old"]
+	if cached == nil || cached.Hash != contentHash(output) || !strings.HasPrefix(cached.Text, "short") {
+		t.Fatalf("summary not cached: %+v", cached)
+	}
+
+	// A cached summary is reused without running the agent again
+	p.Summarize.Agent = &AgentConfig{Cmd: "false"}
+	if got, err := r.summarize(0, "old", output); err != nil || got != cached.Text {
+		t.Errorf("summarize() = %q, %v, want cached %q", got, err, cached.Text)
+	}
+}
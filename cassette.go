@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cassetteVersion is the format written by --record
+const cassetteVersion = 1
+
+// ErrReplayMismatch is returned when a replayed pipeline asks an agent
+// something the cassette did not record. It is never retried.
+var ErrReplayMismatch = errors.New("replay mismatch")
+
+// Cassette holds agent invocations captured with --record, so --replay can
+// run the pipeline again without calling any agent. Run steps are not
+// recorded; they always run for real.
+type Cassette struct {
+	Version  int             `json:"version"`
+	Pipeline string          `json:"pipeline"`
+	Entries  []CassetteEntry `json:"entries"`
+
+	path   string
+	replay bool
+	next   map[string]int // replay: index into Entries of the next entry per step
+	last   map[string]int // index of the latest entry per step
+	seen   map[int]bool   // record: entries whose file changes are recorded
+	mu     sync.Mutex
+}
+
+// CassetteEntry is one recorded agent invocation
+type CassetteEntry struct {
+	Step        string        `json:"step"`
+	Agent       CassetteAgent `json:"agent"`
+	PromptHash  string        `json:"prompt_hash"`
+	Prompt      string        `json:"prompt"`
+	Output      string        `json:"output"`
+	ExitCode    int           `json:"exit_code"`
+	Error       string        `json:"error,omitempty"`
+	Duration    float64       `json:"duration_seconds"`
+	SessionID   string        `json:"session_id,omitempty"`
+	Usage       *Usage        `json:"usage,omitempty"`
+	FileChanges []string      `json:"file_changes,omitempty"`
+}
+
+// CassetteAgent is the agent configuration an entry was recorded with
+type CassetteAgent struct {
+	Type       string   `json:"type,omitempty"`
+	Cmd        string   `json:"cmd"`
+	Args       []string `json:"args,omitempty"`
+	PromptMode string   `json:"prompt_mode,omitempty"`
+	Model      string   `json:"model,omitempty"`
+}
+
+// NewCassette starts an empty cassette that --record writes to path
+func NewCassette(path, pipelineFile string) *Cassette {
+	return &Cassette{
+		Version:  cassetteVersion,
+		Pipeline: pipelineFile,
+		path:     path,
+		last:     make(map[string]int),
+		seen:     make(map[int]bool),
+	}
+}
+
+// LoadCassette reads a cassette for --replay
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cassette{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if c.Version != cassetteVersion {
+		return nil, fmt.Errorf("%s: unsupported cassette version %d", path, c.Version)
+	}
+	c.path = path
+	c.replay = true
+	c.next = make(map[string]int)
+	c.last = make(map[string]int)
+	return c, nil
+}
+
+// Save writes the cassette to its path
+func (c *Cassette) Save() error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, data, 0644)
+}
+
+// wrap returns the agent that step should call: the real adapter,
+// wrapped to be recorded, or a stand-in answering from the cassette when
+// replaying
+func (c *Cassette) wrap(step string, cfg AgentConfig, adapter Agent) Agent {
+	if c == nil {
+		return adapter
+	}
+	if c.replay {
+		return &replayAgent{c: c, step: step}
+	}
+	return &recordingAgent{c: c, step: step, cfg: cfg, inner: adapter}
+}
+
+// recordingAgent runs the real agent and appends every call to the cassette
+type recordingAgent struct {
+	c     *Cassette
+	step  string
+	cfg   AgentConfig
+	inner Agent
+}
+
+func (a *recordingAgent) Run(runCtx context.Context, prompt string, onLine func(string)) (*AgentResult, error) {
+	start := time.Now()
+	res, err := a.inner.Run(runCtx, prompt, onLine)
+
+	entry := CassetteEntry{
+		Step: a.step,
+		Agent: CassetteAgent{
+			Type:       a.cfg.Type,
+			Cmd:        a.cfg.Cmd,
+			Args:       a.cfg.Args,
+			PromptMode: a.cfg.PromptMode,
+			Model:      a.cfg.Model,
+		},
+		PromptHash: contentHash(prompt),
+		Prompt:     prompt,
+		Output:     res.Output,
+		Duration:   time.Since(start).Seconds(),
+		SessionID:  res.SessionID,
+	}
+	if !res.Usage.IsZero() {
+		usage := res.Usage
+		entry.Usage = &usage
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		entry.ExitCode = exitCode(err)
+	}
+	a.c.add(entry)
+	return res, err
+}
+
+// replayAgent answers with the next entry recorded for its step
+type replayAgent struct {
+	c    *Cassette
+	step string
+}
+
+func (a *replayAgent) Run(runCtx context.Context, prompt string, onLine func(string)) (*AgentResult, error) {
+	entry, err := a.c.take(a.step, prompt)
+	if err != nil {
+		return &AgentResult{}, err
+	}
+
+	if onLine != nil {
+		for _, line := range strings.Split(entry.Output, "\n") {
+			onLine(line)
+		}
+	}
+	res := &AgentResult{Output: entry.Output, SessionID: entry.SessionID}
+	if entry.Usage != nil {
+		res.Usage = *entry.Usage
+	}
+	if entry.Error != "" {
+		return res, &scriptedError{code: entry.ExitCode, msg: entry.Error}
+	}
+	return res, nil
+}
+
+// scriptedError is a recorded or mocked failure, exit code included
+type scriptedError struct {
+	code int
+	msg  string
+}
+
+func (e *scriptedError) Error() string { return e.msg }
+func (e *scriptedError) ExitCode() int { return e.code }
+
+func (c *Cassette) add(entry CassetteEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Entries = append(c.Entries, entry)
+	c.last[entry.Step] = len(c.Entries) - 1
+	c.Save()
+}
+
+// take returns the next entry recorded for step, failing when there is
+// none left or it was recorded for a different prompt
+func (c *Cassette) take(step, prompt string) (CassetteEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k := c.next[step]; k < len(c.Entries); k++ {
+		entry := c.Entries[k]
+		if entry.Step != step {
+			continue
+		}
+		c.next[step] = k + 1
+		c.last[step] = k
+		if hash := contentHash(prompt); hash != entry.PromptHash {
+			return CassetteEntry{}, fmt.Errorf("%w: prompt of step %s has changed since it was recorded (hash %s, recorded %s)",
+				ErrReplayMismatch, step, hash, entry.PromptHash)
+		}
+		return entry, nil
+	}
+	return CassetteEntry{}, fmt.Errorf("%w: no recorded response left for step %s", ErrReplayMismatch, step)
+}
+
+// replaying reports whether agent calls are answered from the cassette
+func (c *Cassette) replaying() bool {
+	return c != nil && c.replay
+}
+
+// fileChanges records the changes of step's latest invocation when
+// recording, and returns the recorded ones instead when replaying. Only
+// the first call per invocation is recorded: it sees the changes before
+// guardrails revert any of them.
+func (c *Cassette) fileChanges(step string, changes []string) []string {
+	if c == nil {
+		return changes
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k, ok := c.last[step]
+	if !ok {
+		return changes
+	}
+	if c.replay {
+		return c.Entries[k].FileChanges
+	}
+
+	// The cassette itself is rewritten after every call
+	var recorded []string
+	for _, change := range changes {
+		if filepath.Clean(change[2:]) != filepath.Clean(c.path) {
+			recorded = append(recorded, change)
+		}
+	}
+	if !c.seen[k] {
+		c.seen[k] = true
+		c.Entries[k].FileChanges = recorded
+		c.Save()
+	}
+	return recorded
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCassetteRecordReplay(t *testing.T) {
+	t.Chdir(t.TempDir())
+	p := &Pipeline{
+		File:  "cassette.yaml",
+		Agent: AgentConfig{Cmd: "sh", Args: []string{"-c", "echo made >> made.txt; echo answer"}},
+		Steps: []Step{
+			{Name: "one", Prompt: "first"},
+			{Name: "two", Prompt: "second: {{one.output}}"},
+		},
+	}
+
+	var changes []string
+	cb := Callbacks{OnFileChanges: func(_ int, c []string, _ map[string]string) { changes = append(changes, c...) }}
+	rec := NewCassette("cassette.json", p.File)
+	if err := RunPipelineWithCallbacks(context.Background(), p, cb, RunOptions{Iteration: 1, Cassette: rec}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"+ made.txt", "M made.txt"}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("recorded file changes = %q, want %q", changes, want)
+	}
+
+	// Replay with an agent that would fail if it were called
+	os.Remove("made.txt")
+	p.Agent = AgentConfig{Cmd: "false"}
+	play, err := LoadCassette("cassette.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(play.Entries) != 2 || !strings.Contains(play.Entries[1].Prompt, "second: answer") {
+		t.Fatalf("cassette entries = %+v", play.Entries)
+	}
+
+	var outputs []string
+	changes = nil
+	cb.OnOutput = func(_ int, output string) { outputs = append(outputs, output) }
+	if err := RunPipelineWithCallbacks(context.Background(), p, cb, RunOptions{Iteration: 1, Cassette: play}); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if want := []string{"answer\n", "answer\n"}; !reflect.DeepEqual(outputs, want) {
+		t.Errorf("replayed outputs = %q, want %q", outputs, want)
+	}
+	if want := []string{"+ made.txt", "M made.txt"}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("replayed file changes = %q, want %q", changes, want)
+	}
+	if _, err := os.Stat("made.txt"); err == nil {
+		t.Error("the agent ran during replay")
+	}
+}
+
+func TestCassetteTake(t *testing.T) {
+	entries := []CassetteEntry{
+		{Step: "a", PromptHash: contentHash("x"), Output: "a1"},
+		{Step: "b", PromptHash: contentHash("y"), Output: "b1"},
+		{Step: "a", PromptHash: contentHash("x"), Output: "a2", Error: "exit status 3", ExitCode: 3},
+	}
+
+	tests := []struct {
+		name    string
+		calls   [][2]string // step, prompt
+		want    []string    // outputs
+		wantErr string
+	}{
+		{"in order per step", [][2]string{{"b", "y"}, {"a", "x"}, {"a", "x"}}, []string{"b1", "a1", "a2"}, ""},
+		{"prompt changed", [][2]string{{"a", "z"}}, nil, "prompt of step a has changed"},
+		{"unknown step", [][2]string{{"c", "x"}}, nil, "no recorded response left for step c"},
+		{"used up", [][2]string{{"b", "y"}, {"b", "y"}}, []string{"b1"}, "no recorded response left for step b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Cassette{Entries: entries, replay: true, next: map[string]int{}, last: map[string]int{}}
+			var got []string
+			var err error
+			for _, call := range tt.calls {
+				var entry CassetteEntry
+				if entry, err = c.take(call[0], call[1]); err != nil {
+					break
+				}
+				got = append(got, entry.Output)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("outputs = %q, want %q", got, tt.want)
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrReplayMismatch) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want a replay mismatch containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReplayFailure(t *testing.T) {
+	c := &Cassette{
+		Entries: []CassetteEntry{{Step: "a", PromptHash: contentHash("x"), Output: "boom", Error: "exit status 3", ExitCode: 3}},
+		replay:  true,
+		next:    map[string]int{},
+		last:    map[string]int{},
+	}
+
+	res, err := c.wrap("a", AgentConfig{}, nil).Run(context.Background(), "x", nil)
+	if err == nil || exitCode(err) != 3 || res.Output != "boom" {
+		t.Errorf("Run() = %+v, %v (exit code %d), want the recorded failure", res, err, exitCode(err))
+	}
+}
+
+func TestLoadCassetteVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "c.json")
+	os.WriteFile(path, []byte(`{"version": 99, "entries": []}`), 0644)
+	if _, err := LoadCassette(path); err == nil || !strings.Contains(err.Error(), "unsupported cassette version 99") {
+		t.Errorf("LoadCassette() error = %v", err)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// GitConfig sets how a pipeline uses the git repository it runs in
+type GitConfig struct {
+	Checkpoint bool `yaml:"checkpoint"` // commit the worktree around every step under refs/octos/
+}
+
+// checkpointRefPrefix holds the commits of git checkpoints, one namespace
+// per run, so they are kept from garbage collection without touching
+// branches
+const checkpointRefPrefix = "refs/octos/"
+
+var unsafeRefChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// checkpointEnv gives checkpoint commits an author, whatever git config
+// the repository has
+var checkpointEnv = []string{
+	"GIT_AUTHOR_NAME=octos", "GIT_AUTHOR_EMAIL=octos@localhost",
+	"GIT_COMMITTER_NAME=octos", "GIT_COMMITTER_EMAIL=octos@localhost",
+}
+
+// checkpointRef is the ref of the checkpoint of step i of run id
+func checkpointRef(id string, i int, name string) string {
+	return fmt.Sprintf("%s%s/%02d-%s", checkpointRefPrefix, id, i+1, unsafeRefChars.ReplaceAllString(name, "_"))
+}
+
+// checkpoint commits the worktree as it was when s was taken, on top of
+// HEAD, then the worktree once the step finished on top of that, and points
+// ref at the second commit. Its parent is the state before the step.
+func (s *worktreeSnapshot) checkpoint(ref, message string) (string, error) {
+	if s.tree == "" {
+		return "", errors.New("not a git repository")
+	}
+	if err := s.finish(); err != nil {
+		return "", err
+	}
+
+	args := []string{"commit-tree", s.tree}
+	if head, err := gitOutput(s.dir, nil, "rev-parse", "--verify", "-q", "HEAD"); err == nil {
+		args = append(args, "-p", strings.TrimSpace(head))
+	}
+	before, err := gitOutput(s.dir, checkpointEnv, append(args, "-m", "before "+message)...)
+	if err != nil {
+		return "", err
+	}
+	after, err := gitOutput(s.dir, checkpointEnv, "commit-tree", s.after, "-p", strings.TrimSpace(before), "-m", message)
+	if err != nil {
+		return "", err
+	}
+	commit := strings.TrimSpace(after)
+	if _, err := gitOutput(s.dir, nil, "update-ref", ref, commit); err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+// checkpoint commits the worktree around step i when git checkpoints are
+// on, and records the commit in the run store
+func (r *pipelineRun) checkpoint(i int, snapshot *worktreeSnapshot) {
+	if !r.p.Git.Checkpoint || snapshot.tree == "" {
+		return
+	}
+	step := r.p.Steps[i]
+	commit, err := snapshot.checkpoint(checkpointRef(r.state.RunID, i, step.Name),
+		fmt.Sprintf("octos: step %s of run %s", step.Name, r.state.RunID))
+	if err != nil {
+		if !r.silent {
+			fmt.Printf("⚠ Warning: could not checkpoint step %s: %v\n", step.Name, err)
+		}
+		return
+	}
+	r.log.update(i, step.Name, func(s *RunStep) { s.Checkpoint = commit })
+}
+
+// Rollback is the outcome of rolling the worktree back to a checkpoint
+type Rollback struct {
+	Changes []string // "+ path" recreated, "M path" restored, "- path" deleted
+	Backup  string   // ref holding the worktree as it was before the rollback
+}
+
+// RollbackStep restores the worktree below the current directory, or the
+// workspace of an isolated run, to its state before step ran in run. The
+// current state is committed first, so the rollback can be undone.
+func RollbackStep(run *RunRecord, step string) (*Rollback, error) {
+	var s *RunStep
+	for _, rs := range run.Steps {
+		if rs.Name == step {
+			s = rs
+		}
+	}
+	if s == nil {
+		return nil, fmt.Errorf("run %s has no step %s", run.ID, step)
+	}
+	if s.Checkpoint == "" {
+		return nil, fmt.Errorf("step %s of run %s has no git checkpoint (set git: {checkpoint: true} in the pipeline)", step, run.ID)
+	}
+
+	dir := "."
+	if run.Workspace != nil {
+		dir = run.Workspace.Dir
+		if _, err := os.Stat(dir); err != nil {
+			return nil, fmt.Errorf("workspace of run %s: %w", run.ID, err)
+		}
+	}
+
+	target, err := gitOutput(dir, nil, "rev-parse", "--verify", "-q", s.Checkpoint+"^^{tree}")
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint %s of step %s not found: %w", s.Checkpoint, step, err)
+	}
+	target = strings.TrimSpace(target)
+	current, err := gitWorktreeTree(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	backup, err := gitOutput(dir, checkpointEnv, "commit-tree", current, "-m", fmt.Sprintf("octos: worktree before rolling back to step %s of run %s", step, run.ID))
+	if err != nil {
+		return nil, err
+	}
+	backup = strings.TrimSpace(backup)
+	rb := &Rollback{Backup: fmt.Sprintf("%srollback/%s-%s", checkpointRefPrefix, time.Now().Format("20060102-150405"), backup[:7])}
+	if _, err := gitOutput(dir, nil, "update-ref", rb.Backup, backup); err != nil {
+		return nil, err
+	}
+
+	out, err := gitOutput(dir, nil, "diff", "--name-status", "-z", "--no-renames", "--relative", current, target)
+	if err != nil {
+		return nil, err
+	}
+	rb.Changes = parseNameStatus(out)
+
+	var remove, restore []string
+	for _, change := range rb.Changes {
+		if strings.HasPrefix(change, "- ") {
+			remove = append(remove, changePath(change))
+		} else {
+			restore = append(restore, changePath(change))
+		}
+	}
+	return rb, restorePaths(dir, target, remove, restore)
+}
+
+// restorePaths deletes the files remove and puts restore back as they are
+// in tree, below dir
+func restorePaths(dir, tree string, remove, restore []string) error {
+	for _, path := range remove {
+		if err := os.Remove(filepath.Join(dir, path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removeEmptyDirs(dir, filepath.Dir(path))
+	}
+	if len(restore) == 0 {
+		return nil
+	}
+	args := append([]string{"restore", "--source=" + tree, "--worktree", "--"}, restore...)
+	_, err := gitOutput(dir, []string{"GIT_LITERAL_PATHSPECS=1"}, args...)
+	return err
+}
+
+// removeEmptyDirs removes dir and its parents below root while they are
+// empty
+func removeEmptyDirs(root, dir string) {
+	for dir != "." && dir != "/" && os.Remove(filepath.Join(root, dir)) == nil {
+		dir = filepath.Dir(dir)
+	}
+}
+
+// deleteCheckpointRefs removes the git checkpoints of run id, if any
+func deleteCheckpointRefs(id string) {
+	out, err := gitOutput(".", nil, "for-each-ref", "--format=%(refname)", checkpointRefPrefix+id+"/")
+	if err != nil {
+		return
+	}
+	for _, ref := range strings.Fields(out) {
+		gitOutput(".", nil, "update-ref", "-d", ref)
+	}
+}
+
+// runRollbackCommand implements `octos rollback <run> --to <step>`
+func runRollbackCommand(args []string) int {
+	usage := "Usage: octos rollback <id|latest> --to <step>"
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	to := fs.String("to", "", "Restore the worktree as it was before this step")
+	fs.Parse(args)
+	// Flags may also follow the run id
+	id := fs.Arg(0)
+	if fs.NArg() > 0 {
+		fs.Parse(fs.Args()[1:])
+	}
+	if id == "" || *to == "" || fs.NArg() > 0 {
+		log.Fatal(usage)
+	}
+
+	run, err := FindRun(id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	lock, err := LockState(context.Background(), run.Pipeline, false)
+	if err != nil {
+		log.Fatalf("%s: %v", run.Pipeline, err)
+	}
+	defer lock.release()
+
+	rb, err := RollbackStep(run, *to)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("↺ Rolled back to before step %s of run %s\n", *to, run.ID)
+	for _, change := range rb.Changes {
+		fmt.Printf("  %s\n", change)
+	}
+	if len(rb.Changes) == 0 {
+		fmt.Println("  (no changes)")
+	}
+	fmt.Printf("The previous worktree is saved as %s\n", rb.Backup)
+	fmt.Printf("Re-run the step with: octos --from %s %s\n", *to, run.Pipeline)
+	return 0
+}
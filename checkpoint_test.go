@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointRef(t *testing.T) {
+	tests := []struct {
+		i    int
+		name string
+		want string
+	}{
+		{0, "plan", "refs/octos/run1/01-plan"},
+		{11, "fix tests", "refs/octos/run1/12-fix_tests"},
+		{2, "v1..v2.lock", "refs/octos/run1/03-v1_v2_lock"},
+	}
+
+	for _, tt := range tests {
+		if got := checkpointRef("run1", tt.i, tt.name); got != tt.want {
+			t.Errorf("checkpointRef(%d, %q) = %q, want %q", tt.i, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRollbackStep(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Chdir(t.TempDir())
+	git := func(args ...string) string {
+		t.Helper()
+		out, err := gitOutput(".", checkpointEnv, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	read := func(name string) string {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return "<missing>"
+		}
+		return string(data)
+	}
+
+	git("init", "-q")
+	os.WriteFile("main.go", []byte("v1\n"), 0644)
+	os.WriteFile("keep.go", []byte("keep\n"), 0644)
+	git("add", ".")
+	git("commit", "-qm", "init")
+	os.WriteFile("keep.go", []byte("keep staged\n"), 0644)
+	git("add", "keep.go")
+
+	p := &Pipeline{
+		File: "p.yaml",
+		Git:  GitConfig{Checkpoint: true},
+		Steps: []Step{
+			{Name: "write", Run: "echo v2 > main.go; mkdir -p src; echo new > src/new.go"},
+			{Name: "wreck", Run: "rm main.go; echo junk > src/new.go; echo junk > junk.go"},
+		},
+	}
+	if err := RunPipelineWithCallbacks(context.Background(), p, Callbacks{}, RunOptions{Iteration: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	run, err := latestRun(p.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := strings.Fields(git("for-each-ref", "--format=%(refname)", checkpointRefPrefix+run.ID+"/"))
+	if want := []string{checkpointRef(run.ID, 0, "write"), checkpointRef(run.ID, 1, "wreck")}; !reflect.DeepEqual(refs, want) {
+		t.Fatalf("refs = %q, want %q", refs, want)
+	}
+
+	tests := []struct {
+		step    string
+		changes []string
+		files   map[string]string
+	}{
+		{
+			step:    "wreck",
+			changes: []string{"- junk.go", "+ main.go", "M src/new.go"},
+			files:   map[string]string{"main.go": "v2\n", "src/new.go": "new\n", "junk.go": "<missing>"},
+		},
+		{
+			step:    "write",
+			changes: []string{"M main.go", "- src/new.go"},
+			files:   map[string]string{"main.go": "v1\n", "src/new.go": "<missing>", "keep.go": "keep staged\n"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.step, func(t *testing.T) {
+			rb, err := RollbackStep(run, tt.step)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rb.Changes, tt.changes) {
+				t.Errorf("changes = %q, want %q", rb.Changes, tt.changes)
+			}
+			for name, want := range tt.files {
+				if got := read(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if _, err := gitOutput(".", nil, "rev-parse", "--verify", rb.Backup); err != nil {
+				t.Errorf("backup %s was not saved: %v", rb.Backup, err)
+			}
+		})
+	}
+
+	if _, err := os.Stat("src"); !os.IsNotExist(err) {
+		t.Error("the emptied src directory was kept")
+	}
+	if staged := git("diff", "--cached", "--name-only"); staged != "keep.go\n" {
+		t.Errorf("staged files = %q", staged)
+	}
+	if _, err := RollbackStep(run, "deploy"); err == nil || !strings.Contains(err.Error(), "has no step deploy") {
+		t.Errorf("unknown step error = %v", err)
+	}
+
+	PruneRuns(0)
+	if refs := git("for-each-ref", checkpointRefPrefix+run.ID+"/"); refs != "" {
+		t.Errorf("pruned run kept its checkpoints: %s", refs)
+	}
+}
+
+func TestRollbackWithoutCheckpoint(t *testing.T) {
+	run := &RunRecord{ID: "r1", Steps: []*RunStep{{Name: "a"}}}
+	_, err := RollbackStep(run, "a")
+	if err == nil || !strings.Contains(err.Error(), "step a of run r1 has no git checkpoint") {
+		t.Errorf("error = %v", err)
+	}
+}
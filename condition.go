@@ -0,0 +1,701 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Condition language used by `when:`
+//
+//	expr       := or
+//	or         := and ( ("or" | "||") and )*
+//	and        := unary ( ("and" | "&&") unary )*
+//	unary      := ("not" | "!") unary | comparison
+//	comparison := operand [ ["not"] op operand | "not_empty" | "empty" ]
+//	op         := == != < <= > >= contains equals matches startsWith endsWith
+//	operand    := {{ref}} | "string" | number | true | false | len(operand) | ( expr ) | word+
+//
+// Bare words are string literals, so `{{check.output}} contains no` keeps working.
+// After contains, equals, startsWith and endsWith an unquoted value runs to
+// the next and/or (or an unmatched parenthesis), other keywords included.
+
+// condRefFields lists the fields a condition can read from a step reference
+var condRefFields = map[string]bool{
+	"output":    true,
+	"status":    true,
+	"exit_code": true,
+	"duration":  true,
+}
+
+// condLookup resolves a {{reference}} path to its current value
+type condLookup func(path []string) (any, error)
+
+type condition struct {
+	root condNode
+	refs [][]string
+}
+
+type condNode interface {
+	eval(lookup condLookup) (any, error)
+}
+
+// evaluateCondition checks if a when condition is met
+func evaluateCondition(cond string, lookup condLookup) (bool, error) {
+	if strings.TrimSpace(cond) == "" {
+		return true, nil
+	}
+
+	c, err := parseCondition(cond)
+	if err != nil {
+		return false, err
+	}
+
+	v, err := c.root.eval(lookup)
+	if err != nil {
+		return false, err
+	}
+	return truthy(v), nil
+}
+
+// parseCondition compiles a when expression
+func parseCondition(src string) (*condition, error) {
+	tokens, err := lexCondition(src)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := &condParser{src: src, tokens: tokens}
+	root, err := ps.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := ps.peek(); tok.kind != tokEOF {
+		return nil, ps.errorf(tok, "unexpected %s", tok)
+	}
+
+	return &condition{root: root, refs: ps.refs}, nil
+}
+
+// checkConditionRef validates a reference used by the when of step i
+func checkConditionRef(p *Pipeline, g *stepGraph, i int, path []string) error {
+	if len(path) < 2 {
+		return fmt.Errorf("invalid reference {{%s}}", strings.Join(path, "."))
+	}
+	if path[0] == "artifact" {
+		return nil
+	}
+
+	j := p.StepIndex(path[0])
+	if j < 0 {
+		return fmt.Errorf("reference to unknown step %q", path[0])
+	}
+	if j == i || !g.ancestors(i)[j] {
+		return fmt.Errorf("step %q does not run before this step (add it to depends_on)", path[0])
+	}
+	if len(path) == 3 && path[1] == "outputs" {
+		if _, ok := p.Steps[j].Outputs[path[2]]; !ok {
+			return fmt.Errorf("step %q does not declare output %q", path[0], path[2])
+		}
+		return nil
+	}
+	if len(path) != 2 || !condRefFields[path[1]] {
+		return fmt.Errorf("unknown field {{%s}} (use output, outputs.<name>, status, exit_code or duration)", strings.Join(path, "."))
+	}
+	return nil
+}
+
+// Lexer
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokLParen
+	tokRParen
+	tokString
+	tokNumber
+	tokRef
+	tokWord
+	tokOp
+)
+
+type condToken struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+func (t condToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of condition"
+	case tokString:
+		return fmt.Sprintf("string %q", t.text)
+	case tokRef:
+		return fmt.Sprintf("{{%s}}", t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+func lexCondition(src string) ([]condToken, error) {
+	var tokens []condToken
+	runes := []rune(src)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '(' || r == ')':
+			kind := tokLParen
+			if r == ')' {
+				kind = tokRParen
+			}
+			tokens = append(tokens, condToken{kind: kind, text: string(r), pos: i})
+			i++
+
+		case r == '{' && i+1 < len(runes) && runes[i+1] == '{':
+			end := -1
+			for j := i + 2; j+1 < len(runes); j++ {
+				if runes[j] == '}' && runes[j+1] == '}' {
+					end = j
+					break
+				}
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("condition %q: unterminated {{ at position %d", src, i+1)
+			}
+			inner := strings.TrimSpace(string(runes[i+2 : end]))
+			tokens = append(tokens, condToken{kind: tokRef, text: inner, pos: i})
+			i = end + 2
+
+		case r == '"' || r == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				// Only the quote and backslash are escapable, so regexes keep \b, \d...
+				if runes[j] == '\\' && j+1 < len(runes) && (runes[j+1] == r || runes[j+1] == '\\') {
+					j++
+				}
+				sb.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("condition %q: unterminated string at position %d", src, i+1)
+			}
+			tokens = append(tokens, condToken{kind: tokString, text: sb.String(), pos: i})
+			i = j + 1
+
+		case strings.ContainsRune("=!<>&|", r):
+			op := string(r)
+			if i+1 < len(runes) {
+				two := string(runes[i : i+2])
+				switch two {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = two
+				}
+			}
+			if op == "=" || op == "&" || op == "|" {
+				return nil, fmt.Errorf("condition %q: unexpected %q at position %d", src, op, i+1)
+			}
+			tokens = append(tokens, condToken{kind: tokOp, text: op, pos: i})
+			i += len(op)
+
+		default:
+			j := i
+			for j < len(runes) && !unicode.IsSpace(runes[j]) && !strings.ContainsRune("()\"'=!<>&|{", runes[j]) {
+				j++
+			}
+			word := string(runes[i:j])
+			kind := tokWord
+			if _, err := strconv.ParseFloat(word, 64); err == nil {
+				kind = tokNumber
+			}
+			tokens = append(tokens, condToken{kind: kind, text: word, pos: i})
+			i = j
+
+			if isTextOperator(word) {
+				tail, end, ok, err := unquotedTail(src, runes, i)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					tokens = append(tokens, condToken{kind: tokString, text: tail, pos: i})
+					i = end
+				}
+			}
+		}
+	}
+
+	return append(tokens, condToken{kind: tokEOF, pos: len(runes)}), nil
+}
+
+// textOperators take the following text as their value when it is not
+// quoted, so `contains not ready` looks for that whole text
+var textOperators = []string{"contains", "equals", "startsWith", "endsWith"}
+
+func isTextOperator(word string) bool {
+	for _, op := range textOperators {
+		if strings.EqualFold(word, op) {
+			return true
+		}
+	}
+	return false
+}
+
+// unquotedTail returns the raw text from start up to the end of the
+// condition, an unmatched closing parenthesis or the next and, or, && or
+// ||. It returns false when the value is quoted, parenthesised or a
+// {{reference}}, and an error when the text holds a {{reference}}.
+func unquotedTail(src string, runes []rune, start int) (string, int, bool, error) {
+	i := start
+	for i < len(runes) && unicode.IsSpace(runes[i]) {
+		i++
+	}
+	if i >= len(runes) {
+		return "", start, false, nil
+	}
+	switch {
+	case runes[i] == '"' || runes[i] == '\'' || runes[i] == '(':
+		return "", start, false, nil
+	case runes[i] == '{' && i+1 < len(runes) && runes[i+1] == '{':
+		return "", start, false, nil
+	}
+
+	depth := 0
+	end := i
+scan:
+	for ; end < len(runes); end++ {
+		switch {
+		case runes[end] == '(':
+			depth++
+		case runes[end] == ')':
+			if depth == 0 {
+				break scan
+			}
+			depth--
+		case depth == 0 && booleanAt(runes, end):
+			break scan
+		}
+	}
+
+	tail := strings.TrimSpace(string(runes[i:end]))
+	if strings.Contains(tail, "{{") {
+		return "", start, false, fmt.Errorf("condition %q: quote the value %q at position %d", src, tail, i+1)
+	}
+	return tail, end, true, nil
+}
+
+// booleanAt reports whether and, or, && or || starts at runes[i]
+func booleanAt(runes []rune, i int) bool {
+	rest := string(runes[i:])
+	if strings.HasPrefix(rest, "&&") || strings.HasPrefix(rest, "||") {
+		return true
+	}
+	if i > 0 && !unicode.IsSpace(runes[i-1]) {
+		return false
+	}
+	for _, word := range []string{"and", "or"} {
+		if len(rest) >= len(word) && strings.EqualFold(rest[:len(word)], word) {
+			after := rest[len(word):]
+			if after == "" || unicode.IsSpace(rune(after[0])) || after[0] == '(' {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Parser
+
+type condParser struct {
+	src    string
+	tokens []condToken
+	pos    int
+	refs   [][]string
+}
+
+func (ps *condParser) peek() condToken {
+	return ps.tokens[ps.pos]
+}
+
+func (ps *condParser) next() condToken {
+	tok := ps.tokens[ps.pos]
+	if tok.kind != tokEOF {
+		ps.pos++
+	}
+	return tok
+}
+
+func (ps *condParser) errorf(tok condToken, format string, args ...any) error {
+	return fmt.Errorf("condition %q: %s at position %d", ps.src, fmt.Sprintf(format, args...), tok.pos+1)
+}
+
+// keyword reports whether tok is the given keyword or operator
+func (ps *condParser) keyword(tok condToken, names ...string) bool {
+	if tok.kind != tokWord && tok.kind != tokOp {
+		return false
+	}
+	for _, name := range names {
+		if strings.EqualFold(tok.text, name) {
+			return true
+		}
+	}
+	return false
+}
+
+var condKeywords = []string{
+	"and", "or", "not", "contains", "equals", "matches", "startsWith", "endsWith",
+	"not_empty", "empty",
+}
+
+func (ps *condParser) parseOr() (condNode, error) {
+	left, err := ps.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for ps.keyword(ps.peek(), "or", "||") {
+		ps.next()
+		right, err := ps.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicNode{and: false, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (ps *condParser) parseAnd() (condNode, error) {
+	left, err := ps.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for ps.keyword(ps.peek(), "and", "&&") {
+		ps.next()
+		right, err := ps.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicNode{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (ps *condParser) parseUnary() (condNode, error) {
+	if ps.keyword(ps.peek(), "not", "!") {
+		ps.next()
+		x, err := ps.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{x: x}, nil
+	}
+	return ps.parseComparison()
+}
+
+func (ps *condParser) parseComparison() (condNode, error) {
+	left, err := ps.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := ps.peek()
+	switch {
+	case ps.keyword(tok, "not_empty", "empty"):
+		ps.next()
+		return &emptyNode{x: left, negate: strings.EqualFold(tok.text, "not_empty")}, nil
+
+	case ps.keyword(tok, "not"):
+		ps.next()
+		op := ps.next()
+		if !ps.keyword(op, "contains", "matches", "startsWith", "endsWith") {
+			return nil, ps.errorf(op, "expected contains, matches, startsWith or endsWith after not, got %s", op)
+		}
+		return ps.finishBinary(strings.ToLower(op.text), true, left)
+
+	case ps.keyword(tok, "==", "!=", "<", "<=", ">", ">=", "contains", "equals", "matches", "startsWith", "endsWith"):
+		ps.next()
+		return ps.finishBinary(strings.ToLower(tok.text), false, left)
+	}
+
+	return left, nil
+}
+
+func (ps *condParser) finishBinary(op string, negate bool, left condNode) (condNode, error) {
+	opTok := ps.tokens[ps.pos-1]
+	right, err := ps.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	node := &binaryNode{op: op, negate: negate, left: left, right: right}
+	if op == "matches" {
+		if lit, ok := right.(*literalNode); ok {
+			re, err := regexp.Compile(toString(lit.value))
+			if err != nil {
+				return nil, ps.errorf(opTok, "invalid regex: %v", err)
+			}
+			node.re = re
+		}
+	}
+	return node, nil
+}
+
+func (ps *condParser) parseOperand() (condNode, error) {
+	tok := ps.next()
+	switch tok.kind {
+	case tokString:
+		return &literalNode{value: tok.text}, nil
+
+	case tokNumber:
+		n, _ := strconv.ParseFloat(tok.text, 64)
+		return &literalNode{value: n}, nil
+
+	case tokRef:
+		path := strings.Split(tok.text, ".")
+		for _, part := range path {
+			if part == "" {
+				return nil, ps.errorf(tok, "invalid reference {{%s}}", tok.text)
+			}
+		}
+		ps.refs = append(ps.refs, path)
+		return &refNode{path: path}, nil
+
+	case tokLParen:
+		x, err := ps.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := ps.next(); closing.kind != tokRParen {
+			return nil, ps.errorf(closing, "expected ), got %s", closing)
+		}
+		return x, nil
+
+	case tokWord:
+		switch {
+		case strings.EqualFold(tok.text, "true"):
+			return &literalNode{value: true}, nil
+		case strings.EqualFold(tok.text, "false"):
+			return &literalNode{value: false}, nil
+		case strings.EqualFold(tok.text, "len") && ps.peek().kind == tokLParen:
+			ps.next()
+			x, err := ps.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if closing := ps.next(); closing.kind != tokRParen {
+				return nil, ps.errorf(closing, "expected ) after len argument, got %s", closing)
+			}
+			return &lenNode{x: x}, nil
+		case ps.keyword(tok, condKeywords...):
+			return nil, ps.errorf(tok, "expected a value, got %s", tok)
+		}
+
+		// Consecutive bare words form a single string literal
+		words := []string{tok.text}
+		for {
+			next := ps.peek()
+			if (next.kind != tokWord && next.kind != tokNumber) || ps.keyword(next, condKeywords...) {
+				break
+			}
+			words = append(words, ps.next().text)
+		}
+		return &literalNode{value: strings.Join(words, " ")}, nil
+	}
+
+	return nil, ps.errorf(tok, "expected a value, got %s", tok)
+}
+
+// Nodes
+
+type literalNode struct {
+	value any
+}
+
+func (n *literalNode) eval(condLookup) (any, error) {
+	return n.value, nil
+}
+
+type refNode struct {
+	path []string
+}
+
+func (n *refNode) eval(lookup condLookup) (any, error) {
+	return lookup(n.path)
+}
+
+type lenNode struct {
+	x condNode
+}
+
+func (n *lenNode) eval(lookup condLookup) (any, error) {
+	v, err := n.x.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+	return float64(len([]rune(strings.TrimSpace(toString(v))))), nil
+}
+
+type notNode struct {
+	x condNode
+}
+
+func (n *notNode) eval(lookup condLookup) (any, error) {
+	v, err := n.x.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(v), nil
+}
+
+type logicNode struct {
+	and         bool
+	left, right condNode
+}
+
+func (n *logicNode) eval(lookup condLookup) (any, error) {
+	l, err := n.left.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+	// Short-circuit
+	if truthy(l) != n.and {
+		return truthy(l), nil
+	}
+	r, err := n.right.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+	return truthy(r), nil
+}
+
+type emptyNode struct {
+	x      condNode
+	negate bool
+}
+
+func (n *emptyNode) eval(lookup condLookup) (any, error) {
+	v, err := n.x.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+	empty := strings.TrimSpace(toString(v)) == ""
+	return empty != n.negate, nil
+}
+
+type binaryNode struct {
+	op          string
+	negate      bool
+	left, right condNode
+	re          *regexp.Regexp
+}
+
+func (n *binaryNode) eval(lookup condLookup) (any, error) {
+	l, err := n.left.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.right.eval(lookup)
+	if err != nil {
+		return nil, err
+	}
+
+	ls := strings.TrimSpace(toString(l))
+	rs := strings.TrimSpace(toString(r))
+
+	var result bool
+	switch n.op {
+	case "contains":
+		result = strings.Contains(strings.ToLower(ls), strings.ToLower(rs))
+	case "equals":
+		result = ls == rs
+	case "startswith":
+		result = strings.HasPrefix(ls, rs)
+	case "endswith":
+		result = strings.HasSuffix(ls, rs)
+	case "matches":
+		re := n.re
+		if re == nil {
+			if re, err = regexp.Compile(toString(r)); err != nil {
+				return nil, fmt.Errorf("invalid regex %q: %w", toString(r), err)
+			}
+		}
+		result = re.MatchString(toString(l))
+	case "==", "!=":
+		ln, lok := toNumber(l)
+		rn, rok := toNumber(r)
+		if lok && rok {
+			result = ln == rn
+		} else {
+			result = ls == rs
+		}
+		if n.op == "!=" {
+			result = !result
+		}
+	default:
+		ln, lok := toNumber(l)
+		rn, rok := toNumber(r)
+		if !lok || !rok {
+			return nil, fmt.Errorf("%s needs numbers, got %q and %q", n.op, ls, rs)
+		}
+		switch n.op {
+		case "<":
+			result = ln < rn
+		case "<=":
+			result = ln <= rn
+		case ">":
+			result = ln > rn
+		case ">=":
+			result = ln >= rn
+		}
+	}
+
+	return result != n.negate, nil
+}
+
+// Values
+
+func truthy(v any) bool {
+	switch x := v.(type) {
+	case bool:
+		return x
+	case float64:
+		return x != 0
+	case nil:
+		return false
+	default:
+		s := strings.TrimSpace(toString(v))
+		return s != "" && !strings.EqualFold(s, "false")
+	}
+}
+
+func toString(v any) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(x)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+func toNumber(v any) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		return n, err == nil
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// fakeLookup resolves references from a flat map keyed by dotted path
+func fakeLookup(values map[string]any) condLookup {
+	return func(path []string) (any, error) {
+		return values[strings.Join(path, ".")], nil
+	}
+}
+
+func TestEvaluateCondition(t *testing.T) {
+	values := map[string]any{
+		"check.output":   "No tests found\n",
+		"check.status":   "completed",
+		"test.exit_code": 1.0,
+		"test.duration":  12.5,
+		"lint.status":    "skipped",
+		"empty.output":   "  \n",
+		"artifact.plan":  "1. refactor auth",
+	}
+
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{"", true},
+		{"{{check.output}} contains no", true},
+		{"{{check.output}} contains NO TESTS", true},
+		{"{{check.output}} contains yes", false},
+		{"{{check.output}} not contains yes", true},
+		{"{{check.output}} contains not ready", false},
+		{"{{check.output}} contains Empty", false},
+		{"{{check.output}} contains tests and waiting", true},
+		{"{{check.output}} contains yes and {{test.exit_code}} == 1", false},
+		{"{{check.output}} contains tests found and {{test.exit_code}} == 1", true},
+		{"{{check.output}} contains yes or {{test.exit_code}} == 1", true},
+		{"{{check.output}} contains tests || {{lint.status}} == completed", true},
+		{"{{check.output}} contains tests && {{lint.status}} == completed", false},
+		{"({{check.output}} contains no tests) and {{lint.status}} == skipped", true},
+		{"{{check.output}} contains \"tests\" and {{lint.status}} == skipped", true},
+		{"({{check.output}} contains found) and {{lint.status}} == skipped", true},
+		{"{{check.status}} equals completed", true},
+		{"{{check.status}} == completed", true},
+		{"{{check.status}} != completed", false},
+		{"{{test.exit_code}} != 0", true},
+		{"{{test.exit_code}} == 1", true},
+		{"{{test.exit_code}} == 1.0", true},
+		{"{{test.duration}} > 10", true},
+		{"{{test.duration}} <= 10", false},
+		{"{{test.duration}} >= 12.5 && {{test.exit_code}} < 2", true},
+		{"{{check.output}} matches '(?i)^no\\b'", true},
+		{"{{check.output}} not matches '^yes'", true},
+		{"{{check.output}} startsWith No", true},
+		{"{{check.output}} endsWith found", true},
+		{"{{artifact.plan}} startsWith \"1.\"", true},
+		{"len({{check.output}}) == 14", true},
+		{"len({{check.output}}) > 100", false},
+		{"{{check.output}} not_empty", true},
+		{"{{empty.output}} not_empty", false},
+		{"{{empty.output}} empty", true},
+		{"not {{lint.status}} == skipped", false},
+		{"!({{lint.status}} == skipped)", false},
+		// and binds tighter than or
+		{"{{lint.status}} == completed and {{check.status}} == completed or {{test.exit_code}} == 1", true},
+		{"{{lint.status}} == completed and ({{check.status}} == completed or {{test.exit_code}} == 1)", false},
+		{"{{lint.status}} == skipped or {{check.status}} == completed and {{test.exit_code}} == 0", true},
+		{"true", true},
+		{"false or {{check.output}}", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cond, func(t *testing.T) {
+			got, err := evaluateCondition(tt.cond, fakeLookup(values))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateConditionErrors(t *testing.T) {
+	values := map[string]any{
+		"check.output": "yes",
+	}
+
+	tests := []struct {
+		cond    string
+		wantErr string
+	}{
+		{"{{check.output}} contains", "expected a value"},
+		{"{{check.output}} matches \"(\"", "invalid regex"},
+		{"{{check.output}} > 3", "needs numbers"},
+		{"{{check.output}} = yes", "unexpected \"=\""},
+		{"({{check.output}} == yes", "expected )"},
+		{"{{check.output}} == 'yes", "unterminated string"},
+		{"{{check.output == yes", "unterminated {{"},
+		{"{{check.output}} == yes yes2 )", "unexpected"},
+		{"{{check.output}} not == yes", "expected contains"},
+		{"{{check.output}} contains yes {{check.status}}", "quote the value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cond, func(t *testing.T) {
+			_, err := evaluateCondition(tt.cond, fakeLookup(values))
+			if err == nil {
+				t.Fatalf("expected error containing %q", tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error %q does not contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseConditionRefs(t *testing.T) {
+	c, err := parseCondition("{{a.output}} contains x or len({{b.status}}) > 1 and {{artifact.plan}} not_empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, ref := range c.refs {
+		got = append(got, strings.Join(ref, "."))
+	}
+	want := "a.output,b.status,artifact.plan"
+	if strings.Join(got, ",") != want {
+		t.Errorf("refs = %v, want %s", got, want)
+	}
+}
+
+func TestValidateReferences(t *testing.T) {
+	tests := []struct {
+		name    string
+		steps   []Step
+		wantErr string
+	}{
+		{
+			name: "valid sequential references",
+			steps: []Step{
+				{Name: "a", Prompt: "x"},
+				{Name: "b", Prompt: "{{a.output}}", When: "{{a.exit_code}} == 0"},
+			},
+		},
+		{
+			name: "unknown step in when",
+			steps: []Step{
+				{Name: "a", Prompt: "x", When: "{{nope.output}} contains x"},
+			},
+			wantErr: "unknown step \"nope\"",
+		},
+		{
+			name: "unknown field in when",
+			steps: []Step{
+				{Name: "a", Prompt: "x"},
+				{Name: "b", Prompt: "y", When: "{{a.stdout}} contains x"},
+			},
+			wantErr: "unknown field",
+		},
+		{
+			name: "later step in when",
+			steps: []Step{
+				{Name: "a", Prompt: "x", When: "{{b.output}} contains x"},
+				{Name: "b", Prompt: "y"},
+			},
+			wantErr: "does not run before this step",
+		},
+		{
+			name: "parallel sibling in when",
+			steps: []Step{
+				{Name: "a", Prompt: "x", DependsOn: []string{}},
+				{Name: "b", Prompt: "y", DependsOn: []string{}, When: "{{a.status}} == completed"},
+			},
+			wantErr: "does not run before this step",
+		},
+		{
+			name: "parallel sibling in prompt",
+			steps: []Step{
+				{Name: "a", Prompt: "x", DependsOn: []string{}},
+				{Name: "b", Prompt: "use {{a.output}}", DependsOn: []string{}},
+			},
+			wantErr: "does not run before this step",
+		},
+		{
+			name: "unknown step in prompt",
+			steps: []Step{
+				{Name: "a", Prompt: "use {{ghost.output}}"},
+			},
+			wantErr: "unknown step \"ghost\"",
+		},
+		{
+			name: "declared output",
+			steps: []Step{
+				{Name: "a", Prompt: "x", Outputs: map[string]OutputSpec{"verdict": {LastLine: true}}},
+				{Name: "b", Prompt: "{{a.outputs.verdict}}", When: "{{a.outputs.verdict}} == approve"},
+			},
+		},
+		{
+			name: "undeclared output in when",
+			steps: []Step{
+				{Name: "a", Prompt: "x"},
+				{Name: "b", Prompt: "y", When: "{{a.outputs.verdict}} == approve"},
+			},
+			wantErr: "does not declare output \"verdict\"",
+		},
+		{
+			name: "undeclared output in prompt",
+			steps: []Step{
+				{Name: "a", Prompt: "x"},
+				{Name: "b", Prompt: "use {{a.outputs.verdict}}"},
+			},
+			wantErr: "does not declare output \"verdict\"",
+		},
+		{
+			name: "syntax error in when",
+			steps: []Step{
+				{Name: "a", Prompt: "x"},
+				{Name: "b", Prompt: "y", When: "{{a.output}} >"},
+			},
+			wantErr: "expected a value",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Pipeline{Agent: AgentConfig{Cmd: "agent"}, Steps: tt.steps}
+			err := p.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// stepGraph holds the dependency edges between pipeline steps, by index
+type stepGraph struct {
+	deps       [][]int // deps[i] lists the steps that must finish before step i
+	dependents [][]int // dependents[i] lists the steps waiting on step i
+}
+
+// buildStepGraph resolves depends_on into index edges.
+// A step without depends_on waits for every step declared before it, which
+// keeps plain pipelines sequential. `depends_on: []` marks a root step.
+func buildStepGraph(steps []Step) (*stepGraph, error) {
+	index := make(map[string]int, len(steps))
+	for i, step := range steps {
+		index[step.Name] = i
+	}
+
+	g := &stepGraph{
+		deps:       make([][]int, len(steps)),
+		dependents: make([][]int, len(steps)),
+	}
+
+	for i, step := range steps {
+		if step.DependsOn == nil {
+			for j := 0; j < i; j++ {
+				g.addEdge(j, i)
+			}
+			continue
+		}
+		for _, dep := range step.DependsOn {
+			j, ok := index[dep]
+			if !ok {
+				return nil, fmt.Errorf("step %d (%s): depends_on references unknown step %q", i+1, step.Name, dep)
+			}
+			if j == i {
+				return nil, fmt.Errorf("step %d (%s): step cannot depend on itself", i+1, step.Name)
+			}
+			g.addEdge(j, i)
+		}
+	}
+
+	if cycle := g.findCycle(); cycle != nil {
+		names := make([]string, len(cycle))
+		for k, i := range cycle {
+			names[k] = steps[i].Name
+		}
+		return nil, fmt.Errorf("dependency cycle: %s", strings.Join(names, " → "))
+	}
+
+	return g, nil
+}
+
+func (g *stepGraph) addEdge(from, to int) {
+	for _, d := range g.deps[to] {
+		if d == from {
+			return
+		}
+	}
+	g.deps[to] = append(g.deps[to], from)
+	g.dependents[from] = append(g.dependents[from], to)
+}
+
+// findCycle returns the step indices forming a cycle, or nil if the graph is acyclic
+func (g *stepGraph) findCycle() []int {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	color := make([]int, len(g.deps))
+	var stack []int
+
+	var visit func(i int) []int
+	visit = func(i int) []int {
+		color[i] = visiting
+		stack = append(stack, i)
+		for _, next := range g.dependents[i] {
+			switch color[next] {
+			case visiting:
+				for k, s := range stack {
+					if s == next {
+						return append(append([]int{}, stack[k:]...), next)
+					}
+				}
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		color[i] = visited
+		return nil
+	}
+
+	for i := range g.deps {
+		if color[i] == unvisited {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// ancestors returns every step that step i transitively depends on
+func (g *stepGraph) ancestors(i int) map[int]bool {
+	seen := make(map[int]bool)
+	queue := append([]int{}, g.deps[i]...)
+	for len(queue) > 0 {
+		j := queue[0]
+		queue = queue[1:]
+		if seen[j] {
+			continue
+		}
+		seen[j] = true
+		queue = append(queue, g.deps[j]...)
+	}
+	return seen
+}
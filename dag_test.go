@@ -0,0 +1,109 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestBuildStepGraph(t *testing.T) {
+	tests := []struct {
+		name     string
+		steps    []Step
+		wantDeps [][]int
+		wantErr  string
+	}{
+		{
+			name:     "implicit sequential",
+			steps:    []Step{{Name: "a"}, {Name: "b"}, {Name: "c"}},
+			wantDeps: [][]int{nil, {0}, {0, 1}},
+		},
+		{
+			name: "fan out and join",
+			steps: []Step{
+				{Name: "analyze"},
+				{Name: "lint", DependsOn: []string{"analyze"}},
+				{Name: "docs", DependsOn: []string{"analyze"}},
+				{Name: "report", DependsOn: []string{"lint", "docs"}},
+			},
+			wantDeps: [][]int{nil, {0}, {0}, {1, 2}},
+		},
+		{
+			name:     "explicit roots",
+			steps:    []Step{{Name: "a", DependsOn: []string{}}, {Name: "b", DependsOn: []string{}}},
+			wantDeps: [][]int{nil, nil},
+		},
+		{
+			name:     "duplicate dependency",
+			steps:    []Step{{Name: "a"}, {Name: "b", DependsOn: []string{"a", "a"}}},
+			wantDeps: [][]int{nil, {0}},
+		},
+		{
+			name:    "unknown dependency",
+			steps:   []Step{{Name: "a", DependsOn: []string{"ghost"}}},
+			wantErr: "unknown step \"ghost\"",
+		},
+		{
+			name:    "self dependency",
+			steps:   []Step{{Name: "a", DependsOn: []string{"a"}}},
+			wantErr: "cannot depend on itself",
+		},
+		{
+			name:    "two step cycle",
+			steps:   []Step{{Name: "a", DependsOn: []string{"b"}}, {Name: "b"}},
+			wantErr: "dependency cycle: a → b → a",
+		},
+		{
+			name: "three step cycle",
+			steps: []Step{
+				{Name: "a", DependsOn: []string{"c"}},
+				{Name: "b", DependsOn: []string{"a"}},
+				{Name: "c", DependsOn: []string{"b"}},
+			},
+			wantErr: "dependency cycle",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := buildStepGraph(tt.steps)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(g.deps, tt.wantDeps) {
+				t.Errorf("deps = %v, want %v", g.deps, tt.wantDeps)
+			}
+		})
+	}
+}
+
+func TestStepGraphAncestors(t *testing.T) {
+	g, err := buildStepGraph([]Step{
+		{Name: "analyze"},
+		{Name: "lint", DependsOn: []string{"analyze"}},
+		{Name: "docs", DependsOn: []string{"analyze"}},
+		{Name: "report", DependsOn: []string{"lint"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int
+	for i := range g.ancestors(3) {
+		got = append(got, i)
+	}
+	sort.Ints(got)
+	if !reflect.DeepEqual(got, []int{0, 1}) {
+		t.Errorf("ancestors(report) = %v, want [0 1]", got)
+	}
+	if len(g.ancestors(0)) != 0 {
+		t.Errorf("ancestors(analyze) = %v, want none", g.ancestors(0))
+	}
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,48 +23,9 @@ var spinnerRegex = regexp.MustCompile(`[⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏]\s*`)
 var controlCharsRegex = regexp.MustCompile(`[\x00-\x08\x0B-\x0C\x0E-\x1F\x7F]`)
 var cursorMovementRegex = regexp.MustCompile(`\x1b\[[0-9]*[ABCDEFGHJKST]`)
 
-// evaluateCondition checks if a when condition is met
-func evaluateCondition(condition string, outputs map[string]string, artifacts map[string]string) bool {
-	if condition == "" {
-		return true
-	}
-
-	// Replace variables
-	cond := condition
-	for name, output := range outputs {
-		cond = strings.ReplaceAll(cond, fmt.Sprintf("{{%s.output}}", name), output)
-	}
-	for name, content := range artifacts {
-		cond = strings.ReplaceAll(cond, fmt.Sprintf("{{artifact.%s}}", name), content)
-	}
-
-	// Simple condition evaluation
-	if strings.Contains(cond, " contains ") {
-		parts := strings.SplitN(cond, " contains ", 2)
-		if len(parts) == 2 {
-			haystack := strings.Trim(parts[0], "' \"")
-			needle := strings.Trim(parts[1], "' \"")
-			return strings.Contains(strings.ToLower(haystack), strings.ToLower(needle))
-		}
-	}
-	if strings.Contains(cond, " equals ") {
-		parts := strings.SplitN(cond, " equals ", 2)
-		if len(parts) == 2 {
-			left := strings.Trim(parts[0], "' \"")
-			right := strings.Trim(parts[1], "' \"")
-			return left == right
-		}
-	}
-	if cond == "not_empty" || strings.HasSuffix(cond, " not_empty") {
-		return strings.TrimSpace(cond) != "" && cond != "not_empty"
-	}
-
-	return true
-}
-
 // loadArtifact loads content from artifacts directory
 func loadArtifact(filename string) (string, error) {
-	path := filepath.Join(".octos", "artifacts", filename)
+	path := filepath.Join(getArtifactsDir(), filename)
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return "", err
@@ -68,60 +35,11 @@ func loadArtifact(filename string) (string, error) {
 
 // saveArtifact saves content to artifacts directory
 func saveArtifact(filename, content string) error {
-	path := filepath.Join(".octos", "artifacts", filename)
-	return os.WriteFile(path, []byte(content), 0644)
-}
-
-// detectFileChanges compares directory state before/after to find changes
-func detectFileChanges(beforeFiles map[string]time.Time) []string {
-	afterFiles := scanDirectory(".")
-	var changes []string
-
-	// Check for new or modified files
-	for path, afterTime := range afterFiles {
-		if beforeTime, exists := beforeFiles[path]; !exists {
-			changes = append(changes, "+ "+path)
-		} else if afterTime.After(beforeTime) {
-			changes = append(changes, "M "+path)
-		}
-	}
-
-	// Check for deleted files
-	for path := range beforeFiles {
-		if _, exists := afterFiles[path]; !exists {
-			changes = append(changes, "- "+path)
-		}
+	path := filepath.Join(getArtifactsDir(), filename)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
 	}
-
-	return changes
-}
-
-// scanDirectory recursively scans directory and returns file paths with mod times
-func scanDirectory(root string) map[string]time.Time {
-	files := make(map[string]time.Time)
-	
-	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
-		
-		// Skip hidden dirs and common ignore patterns
-		if strings.Contains(path, "/.") || 
-		   strings.Contains(path, "/node_modules/") ||
-		   strings.Contains(path, "/.octos/") {
-			if info.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-		
-		if !info.IsDir() {
-			files[path] = info.ModTime()
-		}
-		return nil
-	})
-	
-	return files
+	return os.WriteFile(path, []byte(content), 0644)
 }
 
 func stripANSI(s string) string {
@@ -141,169 +59,716 @@ func stripANSI(s string) string {
 type Context struct {
 	Global  map[string]any
 	Outputs map[string]string
+	Values  map[string]map[string]string // extracted outputs, by step and name
+	Run     map[string]any               // run metadata for {{run.*}}
+	Files   map[string]string            // project files loaded by the step, for {{files.*}}
+	order   []string                     // presentation order of Outputs in buildPrompt, if set
+	stepRef tmplLookup                   // resolves other step fields (status, exit_code...), if set
+
+	artifactDirs []string // where {{artifact.*}} files are looked up, in order
 }
 
+// Errors reported when a step is stopped before it finishes
+var (
+	ErrStepTimedOut = errors.New("timed out")
+	ErrCancelled    = errors.New("cancelled")
+)
+
 type ProgressCallback func(stepIndex int, output string)
 type StepCallback func(stepIndex int, duration time.Duration, err error)
 type StreamCallback func(stepIndex int, line string)
-type FileChangesCallback func(stepIndex int, changes []string)
+
+// FileChangesCallback receives the files a step changed, and in a git
+// repository the unified diff of each of them, by path
+type FileChangesCallback func(stepIndex int, changes []string, diffs map[string]string)
+type AttemptCallback func(stepIndex int, attempt, maxAttempts int, err error)
+type UsageCallback func(stepIndex int, usage Usage, total Usage)
+type SkipCallback func(stepIndex int)
+
+// Callbacks receive events from a running pipeline. Any of them may be nil.
+type Callbacks struct {
+	OnStart       ProgressCallback
+	OnOutput      ProgressCallback
+	OnComplete    StepCallback
+	OnStream      StreamCallback
+	OnFileChanges FileChangesCallback
+	OnAttempt     AttemptCallback // a failed attempt is about to be retried
+	OnUsage       UsageCallback   // an agent call was metered; total is the run so far
+	OnSkip        SkipCallback    // the step's when condition was not met
+}
+
+// pipelineRun holds the state shared by the steps of one pipeline execution.
+// Steps may run concurrently, so ctx, artifacts and state are guarded by mu.
+type pipelineRun struct {
+	runCtx    context.Context
+	p         *Pipeline
+	graph     *stepGraph
+	ctx       *Context
+	artifacts map[string]string
+	state     *PipelineState
+	active    map[int]bool        // steps whose agent is running
+	shared    map[int]bool        // steps that ran alongside another step
+	scripts   map[int]shellScript // rendered commands of run steps
+	silent    bool
+	cb        Callbacks
+	cassette  *Cassette  // records or replays agent calls, if set
+	mock      *MockAgent // answers agent calls under octos test, if set
+	log       *runLog    // run store record, nil if it cannot be written
+	workspace *Workspace // where steps run, for an isolated run
+	scanner   *fileScanner
+	mu        sync.Mutex
+}
+
+type stepResult struct {
+	index int
+	err   error
+}
+
+// RunOptions controls a single pipeline execution
+type RunOptions struct {
+	Resume    bool // continue from the saved checkpoint
+	Iteration int  // loop iteration, starting at 1
+	Wait      bool // wait for another process running the pipeline, instead of failing
+
+	Select StepSelection // run only these steps, instead of resuming
+
+	Cassette *Cassette  // from --record or --replay
+	Mock     *MockAgent // scripted agent used by octos test
+
+	Isolate string // run in a fresh git worktree or a copy of the project, from --isolate
+}
+
+// newRunID returns a sortable, unique identifier for a pipeline run
+func newRunID() string {
+	var b [2]byte
+	rand.Read(b[:])
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b[:])
+}
+
+// runMetadata returns the {{run.*}} values for a run
+func runMetadata(p *Pipeline, runID string, iteration int) map[string]any {
+	if iteration == 0 {
+		iteration = 1
+	}
+	now := time.Now()
+	branch := ""
+	if out, err := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD").Output(); err == nil {
+		branch = strings.TrimSpace(string(out))
+	}
+	return map[string]any{
+		"id":        runID,
+		"iteration": iteration,
+		"date":      now.Format("2006-01-02"),
+		"time":      now.Format("15:04:05"),
+		"branch":    branch,
+		"pipeline":  strings.TrimSuffix(filepath.Base(p.File), filepath.Ext(p.File)),
+	}
+}
 
 func RunPipeline(p *Pipeline) error {
-	return RunPipelineWithResume(p, false)
+	return RunPipelineWithResume(context.Background(), p, false)
 }
 
-func RunPipelineWithResume(p *Pipeline, resume bool) error {
-	return RunPipelineWithCallbacks(p, nil, nil, nil, nil, nil, resume)
+func RunPipelineWithResume(runCtx context.Context, p *Pipeline, resume bool) error {
+	return RunPipelineWithCallbacks(runCtx, p, Callbacks{}, RunOptions{Resume: resume})
 }
 
-func RunPipelineWithCallbacks(p *Pipeline, onStart, onOutput ProgressCallback, onComplete StepCallback, onStream StreamCallback, onFileChanges FileChangesCallback, resume bool) error {
-	ctx := &Context{
-		Global:  p.Context,
-		Outputs: make(map[string]string),
+// RunPipelineWithCallbacks runs the pipeline until it finishes, fails or
+// runCtx is cancelled. Cancelling runCtx kills running agents.
+func RunPipelineWithCallbacks(runCtx context.Context, p *Pipeline, cb Callbacks, opts RunOptions) error {
+	graph, err := buildStepGraph(p.Steps)
+	if err != nil {
+		return err
 	}
 
-	startStep := 0
-	startTime := time.Now()
-	silent := onStart != nil || onComplete != nil // Silent mode if callbacks are set
-	artifacts := make(map[string]string)
+	lock, err := LockState(runCtx, p.File, opts.Wait)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.File, err)
+	}
+	defer lock.release()
+
+	run := &pipelineRun{
+		runCtx: runCtx,
+		p:      p,
+		graph:  graph,
+		ctx: &Context{
+			Global:  p.Context,
+			Outputs: make(map[string]string),
+		},
+		artifacts: make(map[string]string),
+		active:    make(map[int]bool),
+		shared:    make(map[int]bool),
+		scripts:   make(map[int]shellScript),
+		silent:    cb.OnStart != nil || cb.OnComplete != nil, // Silent mode if callbacks are set
+		cb:        cb,
+		cassette:  opts.Cassette,
+		mock:      opts.Mock,
+	}
+	run.state = &PipelineState{
+		PipelineFile: p.File,
+		Steps:        make(map[string]*StepCheckpoint),
+		Outputs:      run.ctx.Outputs,
+		Artifacts:    run.artifacts,
+		StartTime:    time.Now().Format(time.RFC3339),
+	}
+
+	finished := make([]bool, len(p.Steps))
 
 	// Load state if resuming
-	if resume && StateExists(p.File) {
+	if !opts.Select.IsZero() {
+		if err := run.selectSteps(opts.Select, finished); err != nil {
+			return err
+		}
+	} else if opts.Resume && StateExists(p.File) {
 		state, err := LoadState(p.File)
 		if err == nil {
-			startStep = state.LastCompletedStep + 1
-			ctx.Outputs = state.Outputs
-			if !silent {
-				fmt.Printf("→ Resuming from step %d (%s)\n", startStep+1, p.Steps[startStep].Name)
+			state.upgrade(p)
+			if err := state.checkResume(p, run.silent); err != nil {
+				return err
+			}
+			if state.Outputs == nil {
+				state.Outputs = make(map[string]string)
+			}
+			if state.Artifacts == nil {
+				state.Artifacts = make(map[string]string)
+			}
+			run.state = state
+			run.ctx.Outputs = state.Outputs
+			run.artifacts = state.Artifacts
+
+			// Skipped steps stay skipped, so conditions are not evaluated
+			// again against a different state, unless they were edited or
+			// what they depend on runs again
+			for _, name := range state.staleSkips(p, graph) {
+				delete(state.Steps, name)
+				if !run.silent {
+					fmt.Printf("↻ Evaluating the condition of skipped step %s again\n", name)
+				}
+			}
+			done, skipped := 0, 0
+			for i, step := range p.Steps {
+				switch {
+				case state.IsCompleted(step.Name):
+					done++
+				case state.IsFinished(step.Name):
+					skipped++
+				default:
+					continue
+				}
+				finished[i] = true
+			}
+			if !run.silent {
+				fmt.Printf("→ Resuming with %d/%d steps already completed", done, len(p.Steps))
+				if skipped > 0 {
+					fmt.Printf(" and %d skipped", skipped)
+				}
+				fmt.Println()
 			}
 		}
 	}
 
-	for i := startStep; i < len(p.Steps); i++ {
-		step := p.Steps[i]
+	if run.state.RunID == "" {
+		run.state.RunID = newRunID()
+	}
+	run.state.PipelineHash = p.fingerprint()
+	run.ctx.Run = runMetadata(p, run.state.RunID, opts.Iteration)
 
-		// Check condition
-		if !evaluateCondition(step.When, ctx.Outputs, artifacts) {
-			if !silent {
-				fmt.Printf("⊘ Skipping step: %s (condition not met)\n", step.Name)
-			}
-			continue
+	run.workspace, err = openWorkspace(opts.Isolate, run.state.RunID, opts.Resume && opts.Select.IsZero())
+	if err != nil {
+		return fmt.Errorf("isolate run: %w", err)
+	}
+	if run.workspace != nil && run.workspace.Branch != "" {
+		run.ctx.Run["branch"] = run.workspace.Branch
+	}
+
+	run.scanner = newFileScanner(run.workdir(), p.Watch)
+	if p.Watch.Mode == WatchNotify {
+		if err := run.scanner.startWatching(); err != nil && !run.silent {
+			fmt.Printf("⚠ Warning: could not watch files, scanning them instead: %v\n", err)
+		}
+	}
+
+	branch, _ := run.ctx.Run["branch"].(string)
+	run.log, err = openRunLog(p, run.state.RunID, opts.Iteration, branch)
+	if err != nil && !run.silent {
+		fmt.Printf("⚠ Warning: could not record run in %s: %v\n", getRunsDir(), err)
+	}
+	run.log.setWorkspace(run.workspace)
+	if run.workspace != nil && !run.silent {
+		fmt.Printf("🏝 Running in %s\n", run.workspace.Dir)
+	}
+	if p.Git.Checkpoint && !run.silent {
+		if _, err := gitOutput(run.workdir(), nil, "rev-parse", "--git-dir"); err != nil {
+			fmt.Println("⚠ Warning: git checkpoints are on, but this is not a git repository")
 		}
+	}
+
+	err = run.schedule(finished)
+	run.scanner.close()
+	if run.workspace != nil {
+		if wsErr := run.workspace.finish(run.state.RunID, err); wsErr != nil && !run.silent {
+			fmt.Printf("⚠ Warning: could not export the changes of the run from %s: %v\n", run.workspace.Root, wsErr)
+		}
+		run.log.setWorkspace(run.workspace)
+		if !run.silent {
+			fmt.Println("🏝 " + run.workspace.summary(err))
+		}
+	}
+	run.log.finish(err, run.state.Usage)
+	if !run.silent && !run.state.Usage.IsZero() {
+		fmt.Printf("💰 Usage: %s\n", run.state.Usage)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Clear state on completion. A run of a few steps keeps it, so the
+	// rest of the pipeline can still be resumed.
+	if opts.Select.IsZero() || run.allCompleted() {
+		ClearState(p.File)
+	}
+	return nil
+}
 
-		// Load artifact if specified
-		if step.LoadFrom != "" {
-			content, err := loadArtifact(step.LoadFrom)
-			if err != nil {
-				if !silent {
-					fmt.Printf("⚠ Warning: could not load artifact %s: %v\n", step.LoadFrom, err)
+// schedule runs every unfinished step once its dependencies have finished,
+// keeping at most p.Parallelism() steps in flight. After the first failure
+// no new steps are started; the ones already running are awaited.
+func (r *pipelineRun) schedule(finished []bool) error {
+	started := make([]bool, len(finished))
+	copy(started, finished)
+
+	results := make(chan stepResult)
+	running := 0
+	var firstErr error
+
+	for {
+		if firstErr == nil {
+			for i := range r.p.Steps {
+				if running >= r.p.Parallelism() {
+					break
 				}
-			} else {
-				artifactName := strings.TrimSuffix(step.LoadFrom, filepath.Ext(step.LoadFrom))
-				artifacts[artifactName] = content
-				ctx.Outputs["artifact."+artifactName] = content
+				if started[i] || !r.ready(i, finished) {
+					continue
+				}
+				if err := r.checkBudget(); err != nil {
+					firstErr = err
+					break
+				}
+				started[i] = true
+				running++
+				go func(i int) {
+					results <- stepResult{index: i, err: r.runStep(i)}
+				}(i)
 			}
 		}
 
-		// Build prompt before callback
-		prompt := interpolate(step.Prompt, ctx)
-		fullPrompt := buildPrompt(ctx, prompt)
+		if running == 0 {
+			break
+		}
 
-		if onStart != nil {
-			onStart(i, prompt)
+		res := <-results
+		running--
+		finished[res.index] = true
+		if res.err != nil && firstErr == nil {
+			firstErr = res.err
 		}
+	}
 
-		start := time.Now()
-		if !silent {
-			fmt.Printf("→ Running step: %s\n", step.Name)
+	return firstErr
+}
+
+// ready reports whether all dependencies of step i have finished
+func (r *pipelineRun) ready(i int, finished []bool) bool {
+	for _, dep := range r.graph.deps[i] {
+		if !finished[dep] {
+			return false
 		}
+	}
+	return true
+}
 
-		// Snapshot files before execution
-		beforeFiles := scanDirectory(".")
+func (r *pipelineRun) runStep(i int) error {
+	step := r.p.Steps[i]
+
+	if r.runCtx.Err() != nil {
+		return r.failStep(i, 0, -1, ErrCancelled, nil)
+	}
 
-		// Use step-specific agent or fallback to pipeline agent
-		agent := p.Agent
-		if step.Agent != nil {
-			agent = *step.Agent
+	// Check condition
+	r.mu.Lock()
+	met, err := evaluateCondition(step.When, r.lookupRef)
+	r.mu.Unlock()
+	if err != nil {
+		if r.cb.OnComplete != nil {
+			r.cb.OnComplete(i, 0, err)
+		}
+		return fmt.Errorf("step %s: when: %w", step.Name, err)
+	}
+	var condition *bool
+	if step.When != "" {
+		condition = &met
+	}
+	if !met {
+		if !r.silent {
+			fmt.Printf("⊘ Skipping step: %s (condition not met)\n", step.Name)
+		}
+		cp := &StepCheckpoint{
+			Status:      CheckpointSkipped,
+			FinishedAt:  time.Now().Format(time.RFC3339),
+			Fingerprint: r.p.stepFingerprint(i),
+			Condition:   condition,
 		}
+		r.mu.Lock()
+		r.state.Steps[step.Name] = cp
+		SaveState(r.state)
+		r.mu.Unlock()
+		r.log.finished(i, step.Name, cp, nil)
+		if r.cb.OnSkip != nil {
+			r.cb.OnSkip(i)
+		}
+		return nil
+	}
 
-		var output string
-		var err error
+	// Load artifacts and project files
+	r.loadArtifacts(i)
+	files := r.loadFiles(i)
+
+	// Build prompt before callback
+	r.mu.Lock()
+	visible := r.promptContext(i)
+	visible.Files = files
+	text := step.Prompt
+	if step.Run != "" {
+		text = step.Run
+	}
+	prompt, unresolved, err := interpolate(text, visible, r.p.Strict)
+	if err == nil && step.Run != "" {
+		r.scripts[i], _, err = renderShellTemplate(step.Run, visible.lookup, r.p.Strict)
+	}
+	selected := r.selectOutputs(i, visible)
+	session := r.sessionFor(i)
+	r.mu.Unlock()
+	if err != nil {
+		return r.failStep(i, 0, -1, err, nil)
+	}
+	// A continued session already holds the earlier outputs, so only the
+	// new task is sent
+	fullPrompt := prompt
+	if step.Run == "" && session == "" {
+		fullPrompt = r.fitBudget(i, selected, prompt)
+	}
+	if !r.silent {
+		for _, ref := range unresolved {
+			fmt.Printf("⚠ Warning: unresolved reference %s in step %s\n", ref, step.Name)
+		}
+	}
+
+	if r.cb.OnStart != nil {
+		r.cb.OnStart(i, prompt)
+	}
+	r.log.started(i, step.Name, fullPrompt)
 
-		if onStream != nil {
-			output, err = runAgentWithStreaming(agent, fullPrompt, func(line string) {
-				onStream(i, line)
-			})
-		} else {
-			output, err = runAgent(agent, fullPrompt)
+	start := time.Now()
+	if !r.silent {
+		fmt.Printf("→ Running step: %s\n", step.Name)
+		if session != "" {
+			fmt.Printf("↪ Continuing agent session %s\n", session)
 		}
+	}
 
-		duration := time.Since(start)
+	// Snapshot files before execution
+	r.beginChangeWindow(i)
+	snapshot := r.scanner.snapshot()
+	defer snapshot.close()
+
+	// Use step-specific agent or fallback to pipeline agent
+	agent := r.p.stepAgent(step)
+	agent.session = session
+	agent.dir = r.workdir()
+
+	stopLive := func() {}
+	if r.cb.OnFileChanges != nil {
+		stopLive = r.scanner.live(snapshot.files, func(changes []string) {
+			r.cb.OnFileChanges(i, r.p.stepPaths(step).markViolations(changes), nil)
+		})
+	}
+	res, attempts := r.runWithExpectations(i, agent, fullPrompt, snapshot)
+	stopLive()
+	r.recordSession(i, res.sessionID)
+	output := res.output
+	duration := time.Since(start)
+	shared := r.endChangeWindow(i)
+	r.checkpoint(i, snapshot)
+
+	// Detect file changes. Steps running in parallel share the working tree,
+	// so their changes cannot be told apart and are reported as shared.
+	// Failed steps report them too, as they may be why the step failed.
+	changes := r.cassette.fileChanges(step.Name, snapshot.changes())
+	diffs := snapshot.diffs(changes)
+	changes = append(r.p.stepPaths(step).markViolations(changes), res.reverted...)
+	if shared {
+		changes = markSharedChanges(changes)
+	}
+	r.log.diff(i, step.Name, joinDiffs(changes, diffs))
+	// Live changes are replaced, even when there are none left
+	if r.cb.OnFileChanges != nil && (len(changes) > 0 || r.scanner.watcher != nil) {
+		r.cb.OnFileChanges(i, changes, diffs)
+	}
+	if r.scanner.overLimit() && !r.silent {
+		fmt.Printf("⚠ Warning: more than %d files to track, changes past them are missed. Leave build outputs out with watch.exclude or .octosignore, or raise watch.max_files\n", r.p.Watch.maxFiles())
+	}
 
-		if err != nil {
-			if onComplete != nil {
-				onComplete(i, duration, err)
+	r.log.output(i, step.Name, output)
+	if res.err != nil {
+		if !step.allowsFailure(res) {
+			err := r.failStep(i, duration, res.exitCode, res.err, attempts)
+			r.log.update(i, step.Name, func(s *RunStep) { s.FileChanges = changes })
+			return err
+		}
+		if !r.silent {
+			fmt.Printf("⚠ Step %s exited with code %d (allowed)\n", step.Name, res.exitCode)
+		}
+	}
+
+	r.mu.Lock()
+	r.ctx.Outputs[step.Name] = output
+	r.mu.Unlock()
+
+	values, errs := step.extractOutputs(output)
+	if !r.silent {
+		for _, name := range sortedKeys(errs) {
+			fmt.Printf("⚠ Warning: could not extract output %s: %v\n", name, errs[name])
+		}
+	}
+
+	// Save artifact if specified
+	artifact := ""
+	if step.SaveTo.File != "" {
+		var err error
+		if artifact, err = r.saveArtifact(i, output); err != nil {
+			if !r.silent {
+				fmt.Printf("⚠ Warning: could not save artifact %s: %v\n", step.SaveTo.File, err)
 			}
-			return fmt.Errorf("step %s failed: %w", step.Name, err)
+		} else if !r.silent {
+			fmt.Printf("💾 Saved artifact: %s\n", artifact)
 		}
+	}
 
-		ctx.Outputs[step.Name] = output
+	if r.cb.OnOutput != nil {
+		r.cb.OnOutput(i, output)
+	}
 
-		// Detect file changes
-		changes := detectFileChanges(beforeFiles)
-		if onFileChanges != nil && len(changes) > 0 {
-			onFileChanges(i, changes)
+	if r.cb.OnComplete != nil {
+		r.cb.OnComplete(i, duration, nil)
+	}
+
+	// Save state after each successful step
+	cp := &StepCheckpoint{
+		Status:      CheckpointCompleted,
+		Duration:    duration.Seconds(),
+		FinishedAt:  time.Now().Format(time.RFC3339),
+		ExitCode:    res.exitCode,
+		Attempts:    attempts,
+		Outputs:     values,
+		Usage:       attemptsUsage(attempts),
+		SessionID:   res.sessionID,
+		Fingerprint: r.p.stepFingerprint(i),
+		Condition:   condition,
+		Artifact:    artifact,
+	}
+	r.mu.Lock()
+	r.state.Steps[step.Name] = cp
+	SaveState(r.state)
+	r.mu.Unlock()
+	r.log.finished(i, step.Name, cp, changes)
+
+	if !r.silent {
+		fmt.Printf("✓ Step %s completed\n\n", step.Name)
+	}
+	return nil
+}
+
+// failStep persists a failed, timed out or cancelled checkpoint for step i,
+// notifies the UI and returns the error that stops the pipeline
+func (r *pipelineRun) failStep(i int, duration time.Duration, exitCode int, err error, attempts []AttemptRecord) error {
+	step := r.p.Steps[i]
+
+	cp := &StepCheckpoint{
+		Status:      checkpointStatus(err),
+		Duration:    duration.Seconds(),
+		FinishedAt:  time.Now().Format(time.RFC3339),
+		ExitCode:    exitCode,
+		Error:       err.Error(),
+		Attempts:    attempts,
+		Usage:       attemptsUsage(attempts),
+		Fingerprint: r.p.stepFingerprint(i),
+	}
+	r.mu.Lock()
+	r.state.Steps[step.Name] = cp
+	SaveState(r.state)
+	r.mu.Unlock()
+	r.log.finished(i, step.Name, cp, nil)
+
+	if r.cb.OnComplete != nil {
+		r.cb.OnComplete(i, duration, err)
+	}
+	return fmt.Errorf("step %s failed: %w", step.Name, err)
+}
+
+// beginChangeWindow records that step i starts touching the working tree
+func (r *pipelineRun) beginChangeWindow(i int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.active) > 0 {
+		r.shared[i] = true
+		for j := range r.active {
+			r.shared[j] = true
 		}
+	}
+	r.active[i] = true
+}
 
-		// Save artifact if specified
-		if step.SaveTo != "" {
-			if err := saveArtifact(step.SaveTo, output); err != nil {
-				if !silent {
-					fmt.Printf("⚠ Warning: could not save artifact %s: %v\n", step.SaveTo, err)
-				}
-			} else if !silent {
-				fmt.Printf("💾 Saved artifact: %s\n", step.SaveTo)
+// endChangeWindow closes the window of step i and reports whether another
+// step was running at any point during it
+func (r *pipelineRun) endChangeWindow(i int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.active, i)
+	shared := r.shared[i]
+	delete(r.shared, i)
+	return shared
+}
+
+// sharedChangeSuffix flags changes that may belong to a parallel step
+const sharedChangeSuffix = " (shared with parallel steps)"
+
+// markSharedChanges flags changes that may belong to a parallel step
+func markSharedChanges(changes []string) []string {
+	marked := make([]string, len(changes))
+	for k, change := range changes {
+		marked[k] = change + sharedChangeSuffix
+	}
+	return marked
+}
+
+// lookupRef resolves {{step.field}} and {{artifact.name}} references for
+// conditions. Callers must hold r.mu.
+func (r *pipelineRun) lookupRef(path []string) (any, error) {
+	if len(path) >= 2 && path[0] == "artifact" {
+		name := strings.Join(path[1:], ".")
+		if content, ok := r.artifacts[name]; ok {
+			return content, nil
+		}
+		if file := findArtifact(r.artifactDirs(), name); file != "" {
+			if data, err := os.ReadFile(file); err == nil {
+				return string(data), nil
 			}
 		}
+		return "", nil
+	}
+	if len(path) == 3 && path[1] == "outputs" && r.p.StepIndex(path[0]) >= 0 {
+		if cp := r.state.Steps[path[0]]; cp != nil {
+			return cp.Outputs[path[2]], nil
+		}
+		return "", nil
+	}
+	if len(path) != 2 || r.p.StepIndex(path[0]) < 0 {
+		return nil, fmt.Errorf("unknown reference {{%s}}", strings.Join(path, "."))
+	}
 
-		if onOutput != nil {
-			onOutput(i, output)
+	name := path[0]
+	cp := r.state.Steps[name]
+
+	switch path[1] {
+	case "output":
+		return r.ctx.Outputs[name], nil
+	case "status":
+		if cp == nil {
+			return "pending", nil
+		}
+		return cp.Status, nil
+	case "exit_code":
+		if cp == nil || cp.Status == CheckpointSkipped {
+			return "", nil
 		}
+		return float64(cp.ExitCode), nil
+	case "duration":
+		if cp == nil {
+			return 0.0, nil
+		}
+		return cp.Duration, nil
+	}
+	return nil, fmt.Errorf("unknown reference {{%s}}", strings.Join(path, "."))
+}
 
-		if onComplete != nil {
-			onComplete(i, duration, nil)
+// promptContext returns the context visible to step i: outputs of the steps
+// it depends on (in pipeline order) plus loaded artifacts. Outputs of steps
+// running in parallel branches are left out so prompts stay deterministic.
+// Callers must hold r.mu.
+func (r *pipelineRun) promptContext(i int) *Context {
+	ancestors := r.graph.ancestors(i)
+	visible := &Context{
+		Global:  r.ctx.Global,
+		Outputs: make(map[string]string),
+		Values:  make(map[string]map[string]string),
+		Run:     r.ctx.Run,
+
+		artifactDirs: r.artifactDirs(),
+	}
+	visible.stepRef = func(path []string) (any, bool) {
+		j := r.p.StepIndex(path[0])
+		if j < 0 || !ancestors[j] {
+			return nil, false
 		}
+		v, err := r.lookupRef(path)
+		return v, err == nil
+	}
 
-		// Save state after each successful step
-		state := &PipelineState{
-			PipelineFile:      p.File,
-			LastCompletedStep: i,
-			Outputs:           ctx.Outputs,
-			StartTime:         startTime.Format(time.RFC3339),
+	for j, step := range r.p.Steps {
+		if !ancestors[j] {
+			continue
+		}
+		if cp := r.state.Steps[step.Name]; cp != nil && cp.Outputs != nil {
+			visible.Values[step.Name] = cp.Outputs
+		}
+		if output, ok := r.ctx.Outputs[step.Name]; ok {
+			visible.Outputs[step.Name] = output
+			visible.order = append(visible.order, step.Name)
 		}
-		SaveState(state)
+	}
 
-		if !silent {
-			fmt.Printf("✓ Step %s completed\n\n", step.Name)
+	var extra []string
+	for name, output := range r.ctx.Outputs {
+		if r.p.StepIndex(name) >= 0 {
+			continue
 		}
+		visible.Outputs[name] = output
+		extra = append(extra, name)
 	}
+	sort.Strings(extra)
+	visible.order = append(visible.order, extra...)
 
-	// Clear state on completion
-	ClearState(p.File)
-	return nil
+	return visible
 }
 
 func buildPrompt(ctx *Context, newTask string) string {
 	var buf bytes.Buffer
 
 	buf.WriteString("=== CONTEXTO GLOBAL ===\n")
-	for k, v := range ctx.Global {
-		buf.WriteString(fmt.Sprintf("%s: %v\n", k, v))
+	for _, k := range sortedKeys(ctx.Global) {
+		buf.WriteString(fmt.Sprintf("%s: %v\n", k, ctx.Global[k]))
 	}
 
 	if len(ctx.Outputs) > 0 {
+		order := ctx.order
+		if order == nil {
+			order = sortedKeys(ctx.Outputs)
+		}
 		buf.WriteString("\n=== OUTPUT PASOS ANTERIORES ===\n")
-		for name, output := range ctx.Outputs {
-			buf.WriteString(fmt.Sprintf("[%s]:\n%s\n\n", name, output))
+		for _, name := range order {
+			buf.WriteString(fmt.Sprintf("[%s]:\n%s\n\n", name, ctx.Outputs[name]))
 		}
 	}
 
@@ -313,86 +778,206 @@ func buildPrompt(ctx *Context, newTask string) string {
 	return buf.String()
 }
 
-func interpolate(text string, ctx *Context) string {
-	result := text
-
-	for name, output := range ctx.Outputs {
-		placeholder := fmt.Sprintf("{{%s.output}}", name)
-		result = strings.ReplaceAll(result, placeholder, output)
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	return keys
+}
+
+// interpolate renders the template placeholders in text against ctx. See
+// template.go for the syntax.
+func interpolate(text string, ctx *Context, strict bool) (string, []string, error) {
+	return renderTemplate(text, ctx.lookup, strict)
+}
 
-	if rules, ok := ctx.Global["rules"].([]any); ok {
-		var rulesList []string
-		for _, r := range rules {
-			rulesList = append(rulesList, fmt.Sprintf("- %v", r))
+// lookup resolves a template path against the context
+func (c *Context) lookup(path []string) (any, bool) {
+	switch path[0] {
+	case "context":
+		return lookupValue(c.Global, path[1:])
+	case "run":
+		return lookupValue(c.Run, path[1:])
+	case "env":
+		if len(path) != 2 {
+			return nil, false
+		}
+		return os.LookupEnv(path[1])
+	case "artifact":
+		name := strings.Join(path[1:], ".")
+		if content, ok := c.Outputs["artifact."+name]; ok {
+			return content, true
 		}
-		result = strings.ReplaceAll(result, "{{context.rules}}", strings.Join(rulesList, "\n"))
+		dirs := c.artifactDirs
+		if dirs == nil {
+			dirs = []string{getArtifactsDir()}
+		}
+		if file := findArtifact(dirs, name); file != "" {
+			if data, err := os.ReadFile(file); err == nil {
+				return string(data), true
+			}
+		}
+		return nil, false
+	case "files":
+		if len(path) == 1 {
+			return renderFiles(c.Files), c.Files != nil
+		}
+		content, ok := c.Files[strings.Join(path[1:], ".")]
+		return content, ok
 	}
 
-	return result
+	switch {
+	case len(path) == 2 && path[1] == "output":
+		output, ok := c.Outputs[path[0]]
+		return output, ok
+	case len(path) == 3 && path[1] == "outputs":
+		value, ok := c.Values[path[0]][path[2]]
+		return value, ok
+	case c.stepRef != nil:
+		return c.stepRef(path)
+	}
+	return nil, false
 }
 
-func runAgent(agent AgentConfig, prompt string) (string, error) {
-	args := append(agent.Args, prompt)
-	cmd := exec.Command(agent.Cmd, args...)
+// agentKillGrace bounds how long Wait blocks on output pipes after the
+// agent was killed, in case a grandchild process still holds them open
+const agentKillGrace = 5 * time.Second
+
+// newAgentCommand builds the agent invocation bound to runCtx, passing the
+// prompt as prompt_mode says. cleanup removes the prompt file, if any, and
+// must be called once the command has finished.
+func newAgentCommand(runCtx context.Context, agent AgentConfig, prompt string) (cmd *exec.Cmd, cleanup func(), err error) {
+	cleanup = func() {}
+	args := append([]string{}, agent.Args...)
+
+	switch agent.PromptMode {
+	case PromptModeStdin:
+	case PromptModeFile:
+		// CreateTemp makes the file readable by the current user only
+		f, err := os.CreateTemp("", "octos-prompt-*.txt")
+		if err != nil {
+			return nil, nil, fmt.Errorf("prompt file: %w", err)
+		}
+		cleanup = func() { os.Remove(f.Name()) }
+		_, err = f.WriteString(prompt)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("prompt file: %w", err)
+		}
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("%w: %s", err, string(output))
+		placed := false
+		for k, arg := range args {
+			if strings.Contains(arg, promptFilePlaceholder) {
+				args[k] = strings.ReplaceAll(arg, promptFilePlaceholder, f.Name())
+				placed = true
+			}
+		}
+		if !placed {
+			args = append(args, f.Name())
+		}
+	default:
+		args = append(args, prompt)
 	}
 
-	return stripANSI(string(output)), nil
+	cmd = exec.CommandContext(runCtx, agent.Cmd, args...)
+	cmd.Dir = agent.dir
+	if agent.PromptMode == PromptModeStdin {
+		cmd.Stdin = strings.NewReader(prompt)
+	}
+	setProcessGroup(cmd)
+	cmd.WaitDelay = agentKillGrace
+	return cmd, cleanup, nil
 }
 
-func runAgentWithStreaming(agent AgentConfig, prompt string, onLine func(string)) (string, error) {
-	args := append(agent.Args, prompt)
-	cmd := exec.Command(agent.Cmd, args...)
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return "", err
+// newShellCommand runs script through the platform shell, in dir
+func newShellCommand(runCtx context.Context, dir, script string) *exec.Cmd {
+	name, flag := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		name, flag = "cmd", "/C"
 	}
+	cmd := exec.CommandContext(runCtx, name, flag, script)
+	cmd.Dir = dir
+	setProcessGroup(cmd)
+	cmd.WaitDelay = agentKillGrace
+	return cmd
+}
 
-	stderr, err := cmd.StderrPipe()
+// runCommand runs an agent or shell command and returns its combined output.
+// The output is returned even when the command fails, so run steps with
+// allow_failure and retry_on can inspect it.
+func runCommand(cmd *exec.Cmd) (string, error) {
+	raw, err := cmd.CombinedOutput()
+	output := stripANSI(string(raw))
 	if err != nil {
-		return "", err
+		if msg := strings.TrimSpace(output); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return output, err
 	}
 
-	if err := cmd.Start(); err != nil {
-		return "", err
-	}
+	return output, nil
+}
 
+func runCommandWithStreaming(cmd *exec.Cmd, onLine func(string)) (string, error) {
 	var output strings.Builder
-	scanner := bufio.NewScanner(stdout)
-
-	go func() {
-		for scanner.Scan() {
-			line := scanner.Text()
-			cleanLine := stripANSI(line)
-			output.WriteString(cleanLine + "\n")
-			if onLine != nil {
-				onLine(cleanLine)
-			}
-		}
-	}()
-
-	// Also capture stderr
-	stderrScanner := bufio.NewScanner(stderr)
-	go func() {
-		for stderrScanner.Scan() {
-			line := stderrScanner.Text()
-			cleanLine := stripANSI(line)
-			output.WriteString(cleanLine + "\n")
-			if onLine != nil {
-				onLine(cleanLine)
-			}
-		}
-	}()
+	var mu sync.Mutex
+	stdout := &lineWriter{mu: &mu, output: &output, onLine: onLine}
+	stderr := &lineWriter{mu: &mu, output: &output, onLine: onLine}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	stdout.flush()
+	stderr.flush()
+
+	return output.String(), err
+}
+
+// lineWriter splits a command's output into lines, cleaning each one and
+// forwarding it to onLine. Writers for stdout and stderr share mu and output.
+type lineWriter struct {
+	mu     *sync.Mutex
+	output *strings.Builder
+	onLine func(string)
+	buf    []byte
+}
 
-	if err := cmd.Wait(); err != nil {
-		return output.String(), err
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.emit(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
 	}
+	return len(p), nil
+}
+
+// flush emits a trailing line without newline, if any
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	return output.String(), nil
+	if len(w.buf) > 0 {
+		w.emit(string(w.buf))
+		w.buf = nil
+	}
 }
 
+func (w *lineWriter) emit(line string) {
+	cleanLine := stripANSI(line)
+	w.output.WriteString(cleanLine + "\n")
+	if w.onLine != nil {
+		w.onLine(cleanLine)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewAgentCommandPromptModes(t *testing.T) {
+	prompt := "line one\nline 'two' $HOME"
+
+	tests := []struct {
+		name  string
+		agent AgentConfig
+	}{
+		{"arg", AgentConfig{Cmd: "sh", Args: []string{"-c", `printf %s "$1"`, "sh"}}},
+		{"stdin", AgentConfig{Cmd: "cat", PromptMode: PromptModeStdin}},
+		{"file placeholder", AgentConfig{Cmd: "sh", Args: []string{"-c", `cat "$1"`, "sh", "{{prompt_file}}"}, PromptMode: PromptModeFile}},
+		{"file appended", AgentConfig{Cmd: "cat", PromptMode: PromptModeFile}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, cleanup, err := newAgentCommand(context.Background(), tt.agent, prompt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err := runCommand(cmd)
+			cleanup()
+			if err != nil {
+				t.Fatalf("runCommand() error = %v", err)
+			}
+			if output != prompt {
+				t.Errorf("agent received %q, want %q", output, prompt)
+			}
+			if tt.agent.PromptMode != PromptModeArg && tt.agent.PromptMode != "" {
+				for _, arg := range cmd.Args {
+					if strings.Contains(arg, "line one") {
+						t.Errorf("prompt leaked into argv: %q", cmd.Args)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPromptFileRemoved(t *testing.T) {
+	agent := AgentConfig{Cmd: "true", Args: []string{"{{prompt_file}}"}, PromptMode: PromptModeFile}
+	cmd, cleanup, err := newAgentCommand(context.Background(), agent, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := cmd.Args[1]
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		t.Errorf("prompt file mode = %o, want it private to the user", perm)
+	}
+
+	cleanup()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("prompt file %s still exists after cleanup", path)
+	}
+}
+
+func TestAgentConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		agent   AgentConfig
+		wantErr string
+	}{
+		{"default", AgentConfig{Cmd: "claude", Args: []string{"-p"}}, ""},
+		{"stdin", AgentConfig{Cmd: "claude", PromptMode: "stdin"}, ""},
+		{"file", AgentConfig{Cmd: "kiro-cli", Args: []string{"--input", "{{prompt_file}}"}, PromptMode: "file"}, ""},
+		{"missing cmd", AgentConfig{}, "cmd is required"},
+		{"unknown mode", AgentConfig{Cmd: "claude", PromptMode: "pipe"}, "prompt_mode must be"},
+		{"placeholder without file mode", AgentConfig{Cmd: "claude", Args: []string{"{{prompt_file}}"}}, "requires prompt_mode: file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.agent.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validate() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("validate() = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
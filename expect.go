@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultExpectAttempts is the total number of tries for on_fail: retry
+const defaultExpectAttempts = 3
+
+// ErrExpectationFailed marks a step whose output did not pass its expect block
+var ErrExpectationFailed = errors.New("expectation failed")
+
+// Expect describes what a step's output must look like to count as a success
+type Expect struct {
+	Match      string   `yaml:"match"`       // regex the trimmed output must match
+	OneOf      []string `yaml:"one_of"`      // allowed answers, compared after trimming
+	MaxLength  int      `yaml:"max_length"`  // maximum length in characters
+	JSON       bool     `yaml:"json"`        // output (or its first fenced block) must be JSON
+	JSONSchema any      `yaml:"json_schema"` // inline schema, or path to a schema file
+	Command    string   `yaml:"command"`     // shell command that must exit 0, output in $OCTOS_OUTPUT
+	OnFail     string   `yaml:"on_fail"`     // fail (default) or retry
+	Attempts   int      `yaml:"attempts"`    // total tries with on_fail: retry
+}
+
+// maxAttempts returns how many times the agent may answer before the step fails
+func (e *Expect) maxAttempts() int {
+	if e.OnFail != "retry" {
+		return 1
+	}
+	if e.Attempts == 0 {
+		return defaultExpectAttempts
+	}
+	return e.Attempts
+}
+
+func (e *Expect) validate(baseDir string) error {
+	if e.Match != "" {
+		if _, err := regexp.Compile(e.Match); err != nil {
+			return fmt.Errorf("expect.match: %w", err)
+		}
+	}
+	if e.MaxLength < 0 {
+		return fmt.Errorf("expect.max_length must be positive")
+	}
+	if e.Attempts < 0 {
+		return fmt.Errorf("expect.attempts must be positive")
+	}
+	switch e.OnFail {
+	case "", "fail", "retry":
+	default:
+		return fmt.Errorf("expect.on_fail must be fail or retry, got %q", e.OnFail)
+	}
+	if e.JSONSchema != nil {
+		if _, err := e.schema(baseDir); err != nil {
+			return fmt.Errorf("expect.json_schema: %w", err)
+		}
+	}
+	return nil
+}
+
+// schema returns the JSON Schema to validate against. A string is read as a
+// JSON or YAML file, relative to the pipeline file.
+func (e *Expect) schema(baseDir string) (map[string]any, error) {
+	raw := e.JSONSchema
+	if path, ok := raw.(string); ok {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		raw = nil
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	schema, ok := normalizeJSON(raw).(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("schema must be an object")
+	}
+	return schema, nil
+}
+
+// check runs every assertion against output and returns the first failure.
+// Schema files are read from baseDir and the command runs in workdir.
+func (e *Expect) check(runCtx context.Context, baseDir, workdir, output string) error {
+	answer := strings.TrimSpace(output)
+
+	if e.Match != "" {
+		re, err := regexp.Compile(e.Match)
+		if err != nil {
+			return err
+		}
+		if !re.MatchString(answer) {
+			return fmt.Errorf("output does not match %q", e.Match)
+		}
+	}
+
+	if len(e.OneOf) > 0 {
+		found := false
+		for _, allowed := range e.OneOf {
+			if answer == strings.TrimSpace(allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("output %q is not one of: %s", truncate(answer, 80), strings.Join(e.OneOf, ", "))
+		}
+	}
+
+	if e.MaxLength > 0 {
+		if n := len([]rune(answer)); n > e.MaxLength {
+			return fmt.Errorf("output is %d characters long, maximum is %d", n, e.MaxLength)
+		}
+	}
+
+	if e.JSON || e.JSONSchema != nil {
+		value, err := parseJSONOutput(output)
+		if err != nil {
+			return err
+		}
+		if e.JSONSchema != nil {
+			schema, err := e.schema(baseDir)
+			if err != nil {
+				return err
+			}
+			if err := validateSchema(schema, value); err != nil {
+				return fmt.Errorf("output does not match the JSON schema: %w", err)
+			}
+		}
+	}
+
+	if e.Command != "" {
+		cmd := newShellCommand(runCtx, workdir, e.Command)
+		cmd.Env = append(os.Environ(), "OCTOS_OUTPUT="+output)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			msg := strings.TrimSpace(stripANSI(string(out)))
+			if msg == "" {
+				return fmt.Errorf("command %q failed: %w", e.Command, err)
+			}
+			return fmt.Errorf("command %q failed: %w: %s", e.Command, err, truncate(msg, 500))
+		}
+	}
+
+	return nil
+}
+
+// rejectionFeedback is appended to the prompt when an answer is re-requested
+func rejectionFeedback(reason error, output string) string {
+	var buf strings.Builder
+	buf.WriteString("\n\n=== RESPUESTA ANTERIOR RECHAZADA ===\n")
+	buf.WriteString(truncate(strings.TrimSpace(output), 2000))
+	buf.WriteString("\n\nMotivo: ")
+	buf.WriteString(reason.Error())
+	buf.WriteString("\nCorrige la respuesta y vuelve a intentarlo.")
+	return buf.String()
+}
+
+// runWithExpectations runs the step with retries and checks its output
+// against the expect block, and the files it changed since snapshot against
+// its path rules. With on_fail or on_violation: retry a rejected answer is
+// asked for again, with the reason appended to the prompt.
+func (r *pipelineRun) runWithExpectations(i int, agent AgentConfig, prompt string, snapshot *worktreeSnapshot) (attemptResult, []AttemptRecord) {
+	step := r.p.Steps[i]
+	baseDir := filepath.Dir(r.p.File)
+	var records []AttemptRecord
+	var reverted []string
+
+	for try := 1; ; try++ {
+		res, attempts := r.runWithRetries(i, agent, prompt)
+		res.reverted = reverted
+		for _, a := range attempts {
+			a.Attempt += len(records)
+			records = append(records, a)
+		}
+
+		if res.err != nil {
+			return res, records
+		}
+
+		var rejected error
+		maxTries := 1
+		undone, reason := r.checkPaths(i, snapshot)
+		reverted = append(reverted, undone...)
+		res.reverted = reverted
+		if reason != nil {
+			rejected = ErrPathViolation
+			maxTries = r.p.stepPaths(step).maxAttempts()
+		} else if step.Expect != nil {
+			if reason = step.Expect.check(r.runCtx, baseDir, agent.dir, res.output); reason != nil {
+				rejected = ErrExpectationFailed
+				maxTries = step.Expect.maxAttempts()
+			}
+		}
+		if reason == nil {
+			return res, records
+		}
+		if r.runCtx.Err() != nil {
+			records[len(records)-1].Error = ErrCancelled.Error()
+			return attemptResult{exitCode: -1, err: ErrCancelled}, records
+		}
+
+		res.err = fmt.Errorf("%w: %v", rejected, reason)
+		records[len(records)-1].Error = res.err.Error()
+		if try >= maxTries {
+			return res, records
+		}
+
+		r.recordRetry(i, records)
+		if !r.silent {
+			what := "output"
+			if rejected == ErrPathViolation {
+				what = "changes"
+			}
+			fmt.Printf("↻ Step %s %s rejected (attempt %d/%d): %v\n", step.Name, what, try, maxTries, reason)
+		}
+		if r.cb.OnAttempt != nil {
+			r.cb.OnAttempt(i, try+1, maxTries, res.err)
+		}
+		prompt += rejectionFeedback(reason, res.output)
+	}
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "…"
+}
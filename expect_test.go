@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpectCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		expect  Expect
+		output  string
+		wantErr string
+	}{
+		{"match", Expect{Match: "^(yes|no)$"}, "yes\n", ""},
+		{"match fails", Expect{Match: "^(yes|no)$"}, "maybe", `does not match "^(yes|no)$"`},
+		{"one_of", Expect{OneOf: []string{"approve", "reject"}}, "  reject\n", ""},
+		{"one_of fails", Expect{OneOf: []string{"approve", "reject"}}, "I think approve", "is not one of: approve, reject"},
+		{"max_length", Expect{MaxLength: 5}, "short", ""},
+		{"max_length fails", Expect{MaxLength: 5}, "too long", "8 characters long, maximum is 5"},
+		{"json", Expect{JSON: true}, "```json\n{\"a\": 1}\n```", ""},
+		{"json fails", Expect{JSON: true}, "{a: 1}", "not valid JSON"},
+		{"inline schema", Expect{JSONSchema: map[string]any{"type": "object", "required": []any{"a"}}}, `{"a": 1}`, ""},
+		{"inline schema fails", Expect{JSONSchema: map[string]any{"type": "object", "required": []any{"a"}}}, `{"b": 1}`, `missing required property "a"`},
+		{"command", Expect{Command: `test "$OCTOS_OUTPUT" = ok`}, "ok", ""},
+		{"command fails", Expect{Command: "echo broken >&2; exit 3"}, "ok", "exit status 3: broken"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.expect.check(context.Background(), ".", "", tt.output)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("check() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("check() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExpectSchemaFile(t *testing.T) {
+	dir := t.TempDir()
+	schema := "type: object\nrequired: [verdict]\n"
+	if err := os.WriteFile(filepath.Join(dir, "verdict.yaml"), []byte(schema), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	e := Expect{JSONSchema: "verdict.yaml"}
+	if err := e.validate(dir); err != nil {
+		t.Fatalf("validate() = %v", err)
+	}
+	if err := e.check(context.Background(), dir, "", `{"verdict": "ok"}`); err != nil {
+		t.Errorf("check() = %v, want nil", err)
+	}
+	if err := e.check(context.Background(), dir, "", `{}`); err == nil {
+		t.Error("check() = nil, want missing property error")
+	}
+}
+
+func TestExpectValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		expect  Expect
+		wantErr bool
+	}{
+		{"valid", Expect{Match: "^ok$", OnFail: "retry", Attempts: 2}, false},
+		{"invalid regex", Expect{Match: "("}, true},
+		{"unknown on_fail", Expect{OnFail: "ignore"}, true},
+		{"negative attempts", Expect{Attempts: -1}, true},
+		{"missing schema file", Expect{JSONSchema: "nope.json"}, true},
+		{"schema not an object", Expect{JSONSchema: []any{"string"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.expect.validate(t.TempDir()); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExpectMaxAttempts(t *testing.T) {
+	tests := []struct {
+		expect Expect
+		want   int
+	}{
+		{Expect{}, 1},
+		{Expect{Attempts: 5}, 1},
+		{Expect{OnFail: "retry"}, defaultExpectAttempts},
+		{Expect{OnFail: "retry", Attempts: 2}, 2},
+	}
+
+	for _, tt := range tests {
+		if got := tt.expect.maxAttempts(); got != tt.want {
+			t.Errorf("%+v.maxAttempts() = %d, want %d", tt.expect, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// maxFileDiffSize caps the diff kept for one changed file
+const maxFileDiffSize = 256 << 10
+
+// worktreeSnapshot is the state of the working tree before a step runs. In
+// a git repository it is a tree object holding the index and the worktree,
+// so changes are real content changes and come with a diff. Elsewhere it
+// falls back to file modification times.
+type worktreeSnapshot struct {
+	dir     string              // the working tree
+	tree    string              // tree of the worktree, in a git repository
+	after   string              // tree once the step finished
+	files   map[string]fileStat // sizes and modification times, outside git or while watching
+	scanner *fileScanner
+	index   *gitIndex  // copy of the index holding tree, kept while watching
+	log     *changeLog // paths the watcher saw change since s was taken
+}
+
+// snapshotWorktree snapshots dir, tracking every file that is not ignored
+func snapshotWorktree(dir string) *worktreeSnapshot {
+	return newFileScanner(dir, WatchConfig{}).snapshot()
+}
+
+// changes lists the files changed since s was taken, as "+ path",
+// "M path" or "- path"
+func (s *worktreeSnapshot) changes() []string {
+	if s.tree == "" {
+		return s.scanner.diff(s.files, s.scanner.state())
+	}
+	if err := s.finish(); err != nil {
+		return nil
+	}
+
+	out, err := gitOutput(s.dir, nil, "diff", "--name-status", "-z", "--no-renames", "--relative", s.tree, s.after)
+	if err != nil {
+		return nil
+	}
+	var changes []string
+	for _, change := range parseNameStatus(out) {
+		if s.scanner.watched(changePath(change)) {
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// finish snapshots the worktree once the step is done, in a git repository
+func (s *worktreeSnapshot) finish() error {
+	if s.tree == "" || s.after != "" {
+		return nil
+	}
+	if s.index == nil {
+		after, err := s.scanner.gitTree()
+		if err != nil {
+			return err
+		}
+		s.after = after
+		return nil
+	}
+
+	// Only the paths that changed need adding, unless events were lost
+	paths, ok := s.scanner.watcher.since(s.log)
+	if !ok || s.index.add(paths) != nil {
+		if err := s.index.addAll(); err != nil {
+			return err
+		}
+	}
+	after, err := s.index.writeTree()
+	if err != nil {
+		return err
+	}
+	s.after = after
+	return nil
+}
+
+// close releases the copy of the index and stops recording changes
+func (s *worktreeSnapshot) close() {
+	if s.log != nil && s.scanner.watcher != nil {
+		s.scanner.watcher.forget(s.log)
+	}
+	s.log = nil
+	if s.index != nil {
+		s.index.remove()
+		s.index = nil
+	}
+}
+
+// refresh makes the next call to changes compare against the worktree as
+// it is now, not as it was when the step finished
+func (s *worktreeSnapshot) refresh() {
+	s.after = ""
+}
+
+// revert puts the files of changes back as they were when s was taken. It
+// needs a git repository.
+func (s *worktreeSnapshot) revert(changes []string) error {
+	if s.tree == "" {
+		return errors.New("reverting changes needs a git repository")
+	}
+	var remove, restore []string
+	for _, change := range changes {
+		if strings.HasPrefix(change, "+ ") {
+			remove = append(remove, changePath(change))
+		} else {
+			restore = append(restore, changePath(change))
+		}
+	}
+	s.refresh()
+	return restorePaths(s.dir, s.tree, remove, restore)
+}
+
+// diffs returns the unified diff of each of changes, by path. It is empty
+// outside git repositories.
+func (s *worktreeSnapshot) diffs(changes []string) map[string]string {
+	if s.after == "" || len(changes) == 0 {
+		return nil
+	}
+	paths := make([]string, len(changes))
+	for k, change := range changes {
+		paths[k] = changePath(change)
+	}
+
+	args := append([]string{"-c", "core.quotePath=false", "diff", "--no-color", "--no-ext-diff", "--no-renames", "--relative", s.tree, s.after, "--"}, paths...)
+	out, err := gitOutput(s.dir, []string{"GIT_LITERAL_PATHSPECS=1"}, args...)
+	if err != nil {
+		return nil
+	}
+	return splitDiff(out, paths)
+}
+
+// parseNameStatus turns the output of git diff --name-status -z into
+// change lines
+func parseNameStatus(out string) []string {
+	var changes []string
+	fields := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	for k := 0; k+1 < len(fields); k += 2 {
+		switch fields[k] {
+		case "A":
+			changes = append(changes, "+ "+fields[k+1])
+		case "D":
+			changes = append(changes, "- "+fields[k+1])
+		default:
+			changes = append(changes, "M "+fields[k+1])
+		}
+	}
+	return changes
+}
+
+// splitDiff splits a unified diff into the diff of each of paths
+func splitDiff(diff string, paths []string) map[string]string {
+	headers := make(map[string]string, len(paths))
+	for _, path := range paths {
+		headers["diff --git a/"+path+" b/"+path] = path
+	}
+
+	builders := make(map[string]*strings.Builder)
+	var b *strings.Builder
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		if strings.HasPrefix(line, "diff --git ") {
+			b = nil
+			if path, ok := headers[strings.TrimSuffix(line, "\n")]; ok {
+				b = &strings.Builder{}
+				builders[path] = b
+			}
+		}
+		if b == nil || b.Len() > maxFileDiffSize {
+			continue
+		}
+		b.WriteString(line)
+		if b.Len() > maxFileDiffSize {
+			b.WriteString("\n[... truncated]\n")
+		}
+	}
+
+	diffs := make(map[string]string, len(builders))
+	for path, b := range builders {
+		diffs[path] = b.String()
+	}
+	return diffs
+}
+
+// changePath returns the path of a change line
+func changePath(change string) string {
+	if len(change) < 2 {
+		return change
+	}
+	path := strings.TrimSuffix(change[2:], sharedChangeSuffix)
+	path = strings.TrimSuffix(path, violationSuffix)
+	return strings.TrimSuffix(path, revertedSuffix)
+}
+
+// joinDiffs concatenates the diffs of changes, in their order
+func joinDiffs(changes []string, diffs map[string]string) string {
+	var b strings.Builder
+	for _, change := range changes {
+		b.WriteString(diffs[changePath(change)])
+	}
+	return b.String()
+}
+
+// gitWorktreeTree writes the index and the worktree below dir, untracked
+// files included and ignored ones and .octos left out, as a tree object. A
+// copy of the index is used, so the repository's own index is never touched.
+func gitWorktreeTree(dir string) (string, error) {
+	index, err := newGitIndex(dir, nil)
+	if err != nil {
+		return "", err
+	}
+	defer index.remove()
+	if err := index.addAll(); err != nil {
+		return "", err
+	}
+	return index.writeTree()
+}
+
+// gitIndex is a copy of the index of the repository dir is in, that the
+// worktree is added to without touching the repository's own index
+type gitIndex struct {
+	dir      string
+	file     string
+	excludes string // file of extra ignore rules, if any
+}
+
+// newGitIndex copies the index of the repository of dir. Untracked files
+// matching excludes, gitignore lines relative to dir, are never added.
+func newGitIndex(dir string, excludes []string) (*gitIndex, error) {
+	index, err := gitOutput(dir, nil, "rev-parse", "--git-path", "index")
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "octos-index-*")
+	if err != nil {
+		return nil, err
+	}
+	index = strings.TrimSpace(index)
+	if !filepath.IsAbs(index) {
+		index = filepath.Join(dir, index)
+	}
+	data, err := os.ReadFile(index)
+	tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name()) // git starts a missing index, not an empty one
+	}
+	x := &gitIndex{dir: dir, file: tmp.Name()}
+
+	if len(excludes) > 0 {
+		if x.excludes, err = writeGitExcludes(dir, excludes); err != nil {
+			x.remove()
+			return nil, err
+		}
+	}
+	return x, nil
+}
+
+// writeGitExcludes writes excludes, anchored at dir, after the user's
+// global excludes, which the file replaces
+func writeGitExcludes(dir string, excludes []string) (string, error) {
+	prefix, err := gitOutput(dir, nil, "rev-parse", "--show-prefix")
+	if err != nil {
+		return "", err
+	}
+	prefix = strings.TrimSpace(prefix)
+
+	var b strings.Builder
+	global, _ := gitOutput(dir, nil, "config", "--path", "--get", "core.excludesFile")
+	if global = strings.TrimSpace(global); global == "" {
+		if config, err := os.UserConfigDir(); err == nil {
+			global = filepath.Join(config, "git", "ignore")
+		}
+	}
+	if data, err := os.ReadFile(global); err == nil {
+		b.Write(data)
+		b.WriteString("\n")
+	}
+	for _, line := range excludes {
+		negate := strings.HasPrefix(line, "!")
+		line = "/" + prefix + strings.TrimPrefix(strings.TrimPrefix(line, "!"), "/")
+		if negate {
+			line = "!" + line
+		}
+		b.WriteString(line + "\n")
+	}
+
+	tmp, err := os.CreateTemp("", "octos-exclude-*")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// env makes git use the copy of the index and the extra ignore rules
+func (x *gitIndex) env() []string {
+	env := []string{"GIT_INDEX_FILE=" + x.file, "GIT_LITERAL_PATHSPECS=1"}
+	if x.excludes != "" {
+		env = append(env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=core.excludesFile", "GIT_CONFIG_VALUE_0="+x.excludes)
+	}
+	return env
+}
+
+func (x *gitIndex) git(args ...string) (string, error) {
+	return gitOutput(x.dir, x.env(), args...)
+}
+
+// addAll adds the whole worktree below dir
+func (x *gitIndex) addAll() error {
+	if _, err := x.git("add", "-A", "--", "."); err != nil {
+		return err
+	}
+	return x.dropOctos()
+}
+
+// add adds the files and directories of paths, relative to dir, as they
+// are now: removed ones are taken out, ignored ones left alone
+func (x *gitIndex) add(paths []string) error {
+	var exist, gone []string
+	for _, name := range paths {
+		if _, err := os.Lstat(filepath.Join(x.dir, filepath.FromSlash(name))); err == nil {
+			exist = append(exist, name)
+		} else {
+			gone = append(gone, name)
+		}
+	}
+
+	if len(gone) > 0 {
+		if _, err := x.git(append([]string{"rm", "-r", "-q", "--cached", "--ignore-unmatch", "--"}, gone...)...); err != nil {
+			return err
+		}
+	}
+	if len(exist) > 0 {
+		// Naming an ignored path fails git add, so those are left out first
+		cmd := exec.Command("git", "check-ignore", "-z", "--stdin")
+		cmd.Dir = x.dir
+		cmd.Env = append(os.Environ(), x.env()...)
+		cmd.Stdin = strings.NewReader(strings.Join(exist, "\x00") + "\x00")
+		out, err := cmd.Output()
+		var exit *exec.ExitError
+		if err != nil && !(errors.As(err, &exit) && exit.ExitCode() == 1) { // 1: none is ignored
+			return fmt.Errorf("git check-ignore: %w", err)
+		}
+		ignored := make(map[string]bool)
+		for _, name := range strings.Split(string(out), "\x00") {
+			ignored[name] = true
+		}
+		add := []string{"add", "-A", "--"}
+		for _, name := range exist {
+			if !ignored[name] {
+				add = append(add, name)
+			}
+		}
+		if len(add) > 3 {
+			if _, err := x.git(add...); err != nil {
+				return err
+			}
+		}
+	}
+	return x.dropOctos()
+}
+
+// dropOctos takes .octos out of the index. An exclude pathspec fails when
+// .octos is ignored, so it is added and taken out again.
+func (x *gitIndex) dropOctos() error {
+	_, err := x.git("rm", "-r", "-q", "--cached", "--ignore-unmatch", "--", ".octos")
+	return err
+}
+
+func (x *gitIndex) writeTree() (string, error) {
+	tree, err := x.git("write-tree")
+	return strings.TrimSpace(tree), err
+}
+
+// remove deletes the copy of the index
+func (x *gitIndex) remove() {
+	os.Remove(x.file)
+	if x.excludes != "" {
+		os.Remove(x.excludes)
+	}
+}
+
+// gitOutput runs git in dir with args and extra environment variables
+func gitOutput(dir string, env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNameStatus(t *testing.T) {
+	tests := []struct {
+		out  string
+		want []string
+	}{
+		{"", nil},
+		{"A\x00new.go\x00", []string{"+ new.go"}},
+		{"M\x00a b.go\x00D\x00old.go\x00T\x00link\x00", []string{"M a b.go", "- old.go", "M link"}},
+	}
+
+	for _, tt := range tests {
+		if got := parseNameStatus(tt.out); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseNameStatus(%q) = %q, want %q", tt.out, got, tt.want)
+		}
+	}
+}
+
+func TestSplitDiff(t *testing.T) {
+	a := "diff --git a/a.go b/a.go\n--- a/a.go\n+++ b/a.go\n@@ -1 +1 @@\n-x\n+y\n"
+	b := "diff --git a/dir/b c.txt b/dir/b c.txt\nnew file mode 100644\n"
+
+	got := splitDiff(a+b, []string{"a.go", "dir/b c.txt"})
+	if want := map[string]string{"a.go": a, "dir/b c.txt": b}; !reflect.DeepEqual(got, want) {
+		t.Errorf("splitDiff() = %q, want %q", got, want)
+	}
+	if got := splitDiff(a, []string{"other.go"}); len(got) != 0 {
+		t.Errorf("diff of an unknown path kept: %q", got)
+	}
+
+	long := "diff --git a/l b/l\n" + strings.Repeat("+line\n", maxFileDiffSize/6+10)
+	if got := splitDiff(long, []string{"l"})["l"]; !strings.HasSuffix(got, "[... truncated]\n") || len(got) > maxFileDiffSize+100 {
+		t.Errorf("long diff was not truncated: %d bytes", len(got))
+	}
+}
+
+func TestChangePath(t *testing.T) {
+	tests := map[string]string{
+		"+ a.go":                      "a.go",
+		"M dir/b.go":                  "dir/b.go",
+		"- c.go" + sharedChangeSuffix: "c.go",
+	}
+	for change, want := range tests {
+		if got := changePath(change); got != want {
+			t.Errorf("changePath(%q) = %q, want %q", change, got, want)
+		}
+	}
+}
+
+func TestWorktreeSnapshotGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	// .octos is left out whether git ignores it or not
+	for _, gitignore := range []string{"build/\n", "build/\n.octos/\n"} {
+		t.Run(strings.ReplaceAll(gitignore, "\n", " "), func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			gitRun := func(args ...string) {
+				t.Helper()
+				cmd := exec.Command("git", append([]string{"-c", "user.name=t", "-c", "user.email=t@t"}, args...)...)
+				if out, err := cmd.CombinedOutput(); err != nil {
+					t.Fatalf("git %v: %v\n%s", args, err, out)
+				}
+			}
+			write := func(name, content string) {
+				os.MkdirAll(filepath.Dir(name), 0755)
+				os.WriteFile(name, []byte(content), 0644)
+			}
+
+			gitRun("init", "-q")
+			write(".gitignore", gitignore)
+			write("main.go", "package main\n")
+			write("same.go", "package same\n")
+			write("gone.go", "package gone\n")
+			write("staged.go", "package staged\n")
+			gitRun("add", ".")
+			gitRun("commit", "-qm", "init")
+			write("staged.go", "package staged // edited\n")
+			gitRun("add", "staged.go")
+			// Its modification time no longer matches the index, whenever it was written
+			os.Chtimes("main.go", time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+
+			s := snapshotWorktree(".")
+			if s.tree == "" {
+				t.Fatal("no git snapshot taken")
+			}
+
+			// An edit that keeps the modification time and size
+			info, _ := os.Stat("main.go")
+			write("main.go", "package niam\n")
+			os.Chtimes("main.go", info.ModTime(), info.ModTime())
+			// Touched but unchanged
+			os.Chtimes("same.go", time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+			os.Remove("gone.go")
+			write(".github/workflows/ci.yml", "on: push\n")
+			write("build/out.bin", "ignored")
+			write(".octos/state/x.json", "{}")
+
+			changes := s.changes()
+			want := []string{"+ .github/workflows/ci.yml", "- gone.go", "M main.go"}
+			if !reflect.DeepEqual(changes, want) {
+				t.Fatalf("changes = %q, want %q", changes, want)
+			}
+
+			diffs := s.diffs(changes)
+			if d := diffs["main.go"]; !strings.Contains(d, "-package main\n+package niam\n") {
+				t.Errorf("diff of main.go = %q", d)
+			}
+			if d := diffs["gone.go"]; !strings.Contains(d, "deleted file mode") {
+				t.Errorf("diff of gone.go = %q", d)
+			}
+
+			// The snapshot used a copy of the index
+			out, _ := exec.Command("git", "diff", "--cached", "--name-only").Output()
+			if string(out) != "staged.go\n" {
+				t.Errorf("index changed, staged files: %q", out)
+			}
+		})
+	}
+}
+
+func TestWorktreeSnapshotWithoutGit(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	t.Setenv("GIT_CEILING_DIRECTORIES", filepath.Dir(dir))
+	os.WriteFile("a.txt", []byte("a"), 0644)
+
+	s := snapshotWorktree(".")
+	os.WriteFile("b.txt", []byte("b"), 0644)
+	changes := s.changes()
+	if !reflect.DeepEqual(changes, []string{"+ b.txt"}) {
+		t.Errorf("changes = %q", changes)
+	}
+	if diffs := s.diffs(changes); diffs != nil {
+		t.Errorf("diffs outside git = %q", diffs)
+	}
+}
+
+func TestWorktreeSnapshotExcludes(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "config"))
+	writeTree(t, map[string]string{"config/git/ignore": "*.tmp\n"})
+	if _, err := gitOutput(".", nil, "init", "-q"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The project is a subdirectory of the repository
+	os.Mkdir("project", 0755)
+	t.Chdir("project")
+	writeTree(t, map[string]string{
+		".octosignore":     "secret/\n*.gen\n!keep.gen\n",
+		"main.go":          "",
+		"secret/key":       "",
+		"a.gen":            "",
+		"sub/b.gen":        "",
+		"keep.gen":         "",
+		"vendor/lib/x.go":  "",
+		"scratch.tmp":      "",
+		"sub/vendor/v.txt": "", // vendor/** only matches at the top
+	})
+
+	s := newFileScanner(".", WatchConfig{Exclude: StringList{"vendor/**"}}).snapshot()
+	if s.tree == "" {
+		t.Fatal("no git snapshot taken")
+	}
+	out, err := gitOutput(".", nil, "ls-tree", "-r", "--name-only", s.tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ".octosignore\nkeep.gen\nmain.go\nsub/vendor/v.txt\n"
+	if out != want {
+		t.Errorf("snapshot tree holds:\n%s\nwant:\n%s", out, want)
+	}
+}
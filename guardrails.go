@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ErrPathViolation marks a step that changed files it may not change
+var ErrPathViolation = errors.New("path not allowed")
+
+// Markers of changes to paths a step may not change
+const (
+	violationSuffix = " (path not allowed)"
+	revertedSuffix  = " (path not allowed, reverted)"
+)
+
+// PathRules limit the files a step may change. Set on the pipeline they
+// apply to every step; a step's allowed_paths replace the pipeline's, its
+// forbidden_paths add to them.
+type PathRules struct {
+	AllowedPaths     StringList `yaml:"allowed_paths"`     // globs of the files a step may change; empty allows all
+	ForbiddenPaths   StringList `yaml:"forbidden_paths"`   // globs of the files a step must not change
+	OnViolation      string     `yaml:"on_violation"`      // fail (default) or retry
+	RevertViolations *bool      `yaml:"revert_violations"` // undo changes to paths not allowed, in a git repository
+}
+
+func (rules PathRules) validate() error {
+	for _, pattern := range rules.AllowedPaths {
+		if err := validateGlob(pattern); err != nil {
+			return fmt.Errorf("allowed_paths: %w", err)
+		}
+	}
+	for _, pattern := range rules.ForbiddenPaths {
+		if err := validateGlob(pattern); err != nil {
+			return fmt.Errorf("forbidden_paths: %w", err)
+		}
+	}
+	switch rules.OnViolation {
+	case "", "fail", "retry":
+	default:
+		return fmt.Errorf("on_violation must be fail or retry, got %q", rules.OnViolation)
+	}
+	return nil
+}
+
+// stepPaths returns the path rules of step, on top of the pipeline's
+func (p *Pipeline) stepPaths(step Step) PathRules {
+	rules := p.PathRules
+	if len(step.AllowedPaths) > 0 {
+		rules.AllowedPaths = step.AllowedPaths
+	}
+	rules.ForbiddenPaths = append(slices.Clone(p.ForbiddenPaths), step.ForbiddenPaths...)
+	if step.OnViolation != "" {
+		rules.OnViolation = step.OnViolation
+	}
+	if step.RevertViolations != nil {
+		rules.RevertViolations = step.RevertViolations
+	}
+	return rules
+}
+
+// active reports whether the rules limit anything
+func (rules PathRules) active() bool {
+	return len(rules.AllowedPaths) > 0 || len(rules.ForbiddenPaths) > 0
+}
+
+// maxAttempts returns how many times the agent may answer before a
+// violation fails the step
+func (rules PathRules) maxAttempts() int {
+	if rules.OnViolation != "retry" {
+		return 1
+	}
+	return defaultExpectAttempts
+}
+
+func (rules PathRules) revert() bool {
+	return rules.RevertViolations != nil && *rules.RevertViolations
+}
+
+// check returns why path may not be changed, or ""
+func (rules PathRules) check(path string) string {
+	path = filepath.ToSlash(path)
+	for _, pattern := range rules.ForbiddenPaths {
+		if matchGlob(pattern, path) {
+			return "forbidden by " + pattern
+		}
+	}
+	if len(rules.AllowedPaths) > 0 && !slices.ContainsFunc(rules.AllowedPaths, func(pattern string) bool { return matchGlob(pattern, path) }) {
+		return "outside allowed_paths " + strings.Join(rules.AllowedPaths, ", ")
+	}
+	return ""
+}
+
+// violations returns the changes to paths the rules do not allow, and an
+// error explaining them
+func (rules PathRules) violations(changes []string) ([]string, error) {
+	var bad, reasons []string
+	for _, change := range changes {
+		if why := rules.check(changePath(change)); why != "" {
+			bad = append(bad, change)
+			reasons = append(reasons, fmt.Sprintf("%s (%s)", change, why))
+		}
+	}
+	if len(bad) == 0 {
+		return nil, nil
+	}
+	return bad, fmt.Errorf("changed files it may not change: %s", strings.Join(reasons, "; "))
+}
+
+// markViolations flags the changes to paths the rules do not allow
+func (rules PathRules) markViolations(changes []string) []string {
+	if !rules.active() {
+		return changes
+	}
+	marked := make([]string, len(changes))
+	for k, change := range changes {
+		marked[k] = change
+		if rules.check(changePath(change)) != "" {
+			marked[k] += violationSuffix
+		}
+	}
+	return marked
+}
+
+// isViolation reports whether a change line is marked as a path violation
+func isViolation(change string) bool {
+	change = strings.TrimSuffix(change, sharedChangeSuffix)
+	return strings.HasSuffix(change, violationSuffix) || strings.HasSuffix(change, revertedSuffix)
+}
+
+// checkPaths compares the files changed since snapshot against the path
+// rules of step i. Violations are reverted when the rules say so, and
+// returned, marked, along with the error explaining them.
+//
+// While other steps run alongside step i, the changes in the shared working
+// tree cannot be told apart, so violations are only warned about. Replayed
+// changes were recorded, so they are never reverted.
+func (r *pipelineRun) checkPaths(i int, snapshot *worktreeSnapshot) ([]string, error) {
+	step := r.p.Steps[i]
+	rules := r.p.stepPaths(step)
+	if !rules.active() {
+		return nil, nil
+	}
+
+	snapshot.refresh()
+	bad, reason := rules.violations(r.cassette.fileChanges(step.Name, snapshot.changes()))
+	if reason == nil {
+		return nil, nil
+	}
+	r.mu.Lock()
+	shared := r.shared[i]
+	r.mu.Unlock()
+	if shared {
+		if !r.silent {
+			fmt.Printf("⚠ Warning: step %s ran alongside other steps, so its changes cannot be checked: %v\n", step.Name, reason)
+		}
+		return nil, nil
+	}
+	if !rules.revert() || r.cassette.replaying() {
+		return nil, reason
+	}
+
+	if err := snapshot.revert(bad); err != nil {
+		if !r.silent {
+			fmt.Printf("⚠ Warning: could not revert the changes of step %s: %v\n", step.Name, err)
+		}
+		return nil, reason
+	}
+	if !r.silent {
+		fmt.Printf("↺ Reverted changes to %d paths step %s may not change\n", len(bad), step.Name)
+	}
+	reverted := make([]string, len(bad))
+	for k, change := range bad {
+		reverted[k] = change + revertedSuffix
+	}
+	return reverted, fmt.Errorf("%w (reverted)", reason)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPathRulesCheck(t *testing.T) {
+	rules := PathRules{
+		AllowedPaths:   StringList{"src/**", "go.mod"},
+		ForbiddenPaths: StringList{"**/*_test.go", "src/vendor/**"},
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"src/main.go", ""},
+		{"src/pkg/util.go", ""},
+		{"go.mod", ""},
+		{"src/main_test.go", "forbidden by **/*_test.go"},
+		{"src/vendor/lib/lib.go", "forbidden by src/vendor/**"},
+		{"README.md", "outside allowed_paths src/**, go.mod"},
+		{"go.sum", "outside allowed_paths src/**, go.mod"},
+	}
+
+	for _, tt := range tests {
+		if got := rules.check(tt.path); got != tt.want {
+			t.Errorf("check(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+
+	if got := (PathRules{ForbiddenPaths: StringList{"tests/**"}}).check("docs/x.md"); got != "" {
+		t.Errorf("without allowed_paths, check(docs/x.md) = %q, want it allowed", got)
+	}
+}
+
+func TestPathRulesValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   PathRules
+		wantErr string
+	}{
+		{"valid", PathRules{AllowedPaths: StringList{"src/**"}, ForbiddenPaths: StringList{"*.lock"}, OnViolation: "retry"}, ""},
+		{"absolute allowed path", PathRules{AllowedPaths: StringList{"/etc/**"}}, "allowed_paths: /etc/**"},
+		{"forbidden path outside", PathRules{ForbiddenPaths: StringList{"../x"}}, "forbidden_paths: ../x"},
+		{"bad pattern", PathRules{ForbiddenPaths: StringList{"[a"}}, "forbidden_paths: [a"},
+		{"unknown on_violation", PathRules{OnViolation: "ignore"}, "on_violation must be fail or retry"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rules.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStepPaths(t *testing.T) {
+	yes, no := true, false
+	p := &Pipeline{PathRules: PathRules{
+		AllowedPaths:     StringList{"src/**"},
+		ForbiddenPaths:   StringList{"tests/**"},
+		RevertViolations: &yes,
+	}}
+
+	tests := []struct {
+		name string
+		step PathRules
+		want PathRules
+	}{
+		{"inherits", PathRules{}, PathRules{AllowedPaths: StringList{"src/**"}, ForbiddenPaths: StringList{"tests/**"}, RevertViolations: &yes}},
+		{
+			"overrides",
+			PathRules{AllowedPaths: StringList{"docs/**"}, ForbiddenPaths: StringList{"docs/api/**"}, OnViolation: "retry", RevertViolations: &no},
+			PathRules{AllowedPaths: StringList{"docs/**"}, ForbiddenPaths: StringList{"tests/**", "docs/api/**"}, OnViolation: "retry", RevertViolations: &no},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.stepPaths(Step{PathRules: tt.step}); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stepPaths = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if len(p.ForbiddenPaths) != 1 {
+		t.Errorf("pipeline forbidden_paths changed to %q", p.ForbiddenPaths)
+	}
+}
+
+func TestMarkViolations(t *testing.T) {
+	rules := PathRules{ForbiddenPaths: StringList{"tests/**"}}
+	changes := markSharedChanges(rules.markViolations([]string{"M src/a.go", "+ tests/a_test.go"}))
+
+	for k, want := range []struct {
+		path      string
+		violation bool
+	}{{"src/a.go", false}, {"tests/a_test.go", true}} {
+		if got := changePath(changes[k]); got != want.path {
+			t.Errorf("changePath(%q) = %q, want %q", changes[k], got, want.path)
+		}
+		if got := isViolation(changes[k]); got != want.violation {
+			t.Errorf("isViolation(%q) = %v, want %v", changes[k], got, want.violation)
+		}
+	}
+	if got := changePath("- tests/b_test.go" + revertedSuffix); got != "tests/b_test.go" {
+		t.Errorf("changePath of a reverted change = %q", got)
+	}
+}
+
+func TestPathViolation(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	yes := true
+
+	// The agent edits the tests at first, and only src/ once told why its
+	// changes were rejected
+	agent := `sleep "${AGENT_DELAY:-0}"
+case "$1" in
+  *RECHAZADA*) echo fixed > src/a.go ;;
+  *) echo hacked > tests/a_test.go; echo new > tests/b_test.go; echo half > src/a.go ;;
+esac`
+
+	tests := []struct {
+		name     string
+		rules    PathRules
+		parallel *Step // runs alongside the checked step
+		wantErr  bool
+		files    map[string]string // contents afterwards, "" for missing
+		changes  []string
+	}{
+		{
+			name:    "fail",
+			rules:   PathRules{ForbiddenPaths: StringList{"tests/**"}},
+			wantErr: true,
+			files:   map[string]string{"tests/a_test.go": "hacked\n", "tests/b_test.go": "new\n", "src/a.go": "half\n"},
+			changes: []string{"M src/a.go", "M tests/a_test.go" + violationSuffix, "+ tests/b_test.go" + violationSuffix},
+		},
+		{
+			name:    "fail and revert",
+			rules:   PathRules{AllowedPaths: StringList{"src/**"}, RevertViolations: &yes},
+			wantErr: true,
+			files:   map[string]string{"tests/a_test.go": "test\n", "tests/b_test.go": "", "src/a.go": "half\n"},
+			changes: []string{"M src/a.go", "M tests/a_test.go" + revertedSuffix, "+ tests/b_test.go" + revertedSuffix},
+		},
+		{
+			name:    "retry and revert",
+			rules:   PathRules{ForbiddenPaths: StringList{"tests/**"}, OnViolation: "retry", RevertViolations: &yes},
+			files:   map[string]string{"tests/a_test.go": "test\n", "tests/b_test.go": "", "src/a.go": "fixed\n"},
+			changes: []string{"M src/a.go", "M tests/a_test.go" + revertedSuffix, "+ tests/b_test.go" + revertedSuffix},
+		},
+		{
+			// The changes of both steps are in the shared tree: they are
+			// only warned about, and neither is reverted
+			name:     "parallel",
+			rules:    PathRules{AllowedPaths: StringList{"src/**"}, RevertViolations: &yes},
+			parallel: &Step{Name: "docs", Run: "echo docs > docs.txt", DependsOn: []string{}},
+			files:    map[string]string{"tests/a_test.go": "hacked\n", "tests/b_test.go": "new\n", "src/a.go": "half\n", "docs.txt": "docs\n"},
+			changes: markSharedChanges([]string{
+				"+ docs.txt" + violationSuffix, "M src/a.go", "M tests/a_test.go" + violationSuffix, "+ tests/b_test.go" + violationSuffix,
+			}),
+		},
+		{
+			name:    "allowed",
+			rules:   PathRules{AllowedPaths: StringList{"src/**", "tests/**"}},
+			files:   map[string]string{"tests/a_test.go": "hacked\n", "src/a.go": "half\n"},
+			changes: []string{"M src/a.go", "M tests/a_test.go", "+ tests/b_test.go"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			os.MkdirAll("src", 0755)
+			os.MkdirAll("tests", 0755)
+			os.WriteFile("src/a.go", []byte("orig\n"), 0644)
+			os.WriteFile("tests/a_test.go", []byte("test\n"), 0644)
+			os.WriteFile(".gitignore", []byte(".octos/\nagent.sh\n"), 0644)
+			os.WriteFile("agent.sh", []byte(agent), 0755)
+			for _, args := range [][]string{{"init", "-q"}, {"add", "."}, {"commit", "-qm", "init"}} {
+				if _, err := gitOutput(".", checkpointEnv, args...); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p := &Pipeline{
+				File:  "p.yaml",
+				Agent: AgentConfig{Cmd: "sh", Args: []string{"agent.sh"}},
+				Steps: []Step{{Name: "fix", Prompt: "Make the tests pass", PathRules: tt.rules}},
+			}
+			if tt.parallel != nil {
+				// Give the parallel step time to change the tree
+				t.Setenv("AGENT_DELAY", "0.3")
+				p.Steps[0].DependsOn = []string{}
+				p.Steps = append(p.Steps, *tt.parallel)
+			}
+			var changes []string
+			cb := Callbacks{
+				OnStart: func(int, string) {},
+				OnFileChanges: func(i int, c []string, _ map[string]string) {
+					if i == 0 {
+						changes = c
+					}
+				},
+			}
+			err := RunPipelineWithCallbacks(context.Background(), p, cb, RunOptions{Iteration: 1})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrPathViolation) {
+				t.Errorf("err = %v, want a path violation", err)
+			}
+
+			for name, want := range tt.files {
+				data, _ := os.ReadFile(name)
+				if string(data) != want {
+					t.Errorf("%s = %q, want %q", name, data, want)
+				}
+			}
+			if !reflect.DeepEqual(changes, tt.changes) {
+				t.Errorf("changes = %q, want %q", changes, tt.changes)
+			}
+
+			run, err := latestRun(p.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := run.Steps[0].FileChanges; !reflect.DeepEqual(got, tt.changes) {
+				t.Errorf("recorded changes = %q, want %q", got, tt.changes)
+			}
+		})
+	}
+}
+
+func TestPathViolationReplay(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Chdir(t.TempDir())
+	os.MkdirAll("src", 0755)
+	os.MkdirAll("tests", 0755)
+	os.WriteFile("src/a.go", []byte("orig\n"), 0644)
+	os.WriteFile("tests/a_test.go", []byte("test\n"), 0644)
+	os.WriteFile(".gitignore", []byte(".octos/\nagent.sh\ncassette.json\n"), 0644)
+	os.WriteFile("agent.sh", []byte("echo hacked > tests/a_test.go; echo new > tests/b_test.go; echo half > src/a.go"), 0755)
+	for _, args := range [][]string{{"init", "-q"}, {"add", "."}, {"commit", "-qm", "init"}} {
+		if _, err := gitOutput(".", checkpointEnv, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	yes := true
+	p := &Pipeline{
+		File:  "p.yaml",
+		Agent: AgentConfig{Cmd: "sh", Args: []string{"agent.sh"}},
+		Steps: []Step{{Name: "fix", Prompt: "Fix it", PathRules: PathRules{AllowedPaths: StringList{"src/**"}, RevertViolations: &yes}}},
+	}
+	cb := Callbacks{OnStart: func(int, string) {}}
+	rec := NewCassette("cassette.json", p.File)
+	if err := RunPipelineWithCallbacks(context.Background(), p, cb, RunOptions{Iteration: 1, Cassette: rec}); !errors.Is(err, ErrPathViolation) {
+		t.Fatalf("recording: err = %v, want a path violation", err)
+	}
+
+	// The replayed agent changes nothing, so the files are the user's own
+	os.WriteFile("tests/a_test.go", []byte("mine\n"), 0644)
+	os.WriteFile("tests/b_test.go", []byte("mine\n"), 0644)
+	play, err := LoadCassette("cassette.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RunPipelineWithCallbacks(context.Background(), p, cb, RunOptions{Iteration: 1, Cassette: play}); !errors.Is(err, ErrPathViolation) {
+		t.Fatalf("replay: err = %v, want the recorded path violation", err)
+	}
+	for _, name := range []string{"tests/a_test.go", "tests/b_test.go"} {
+		if data, _ := os.ReadFile(name); string(data) != "mine\n" {
+			t.Errorf("replay reverted %s: %q", name, data)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrPipelineLocked is returned when another octos process is running the
+// same pipeline
+var ErrPipelineLocked = errors.New("pipeline is already running")
+
+const lockPollInterval = 500 * time.Millisecond
+
+// stateLock is an advisory lock on the state of one pipeline, held for the
+// whole run
+type stateLock struct {
+	f *os.File
+}
+
+func getLockFile(pipelineFile string) string {
+	return strings.TrimSuffix(getStateFile(pipelineFile), ".json") + ".lock"
+}
+
+// LockState takes the lock on the state of pipelineFile. When another
+// process holds it, LockState fails with ErrPipelineLocked, or with wait
+// retries until the lock is free or ctx is cancelled.
+func LockState(ctx context.Context, pipelineFile string, wait bool) (*stateLock, error) {
+	path := getLockFile(pipelineFile)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	for {
+		l, err := tryLock(path)
+		if err == nil {
+			return l, nil
+		}
+		if !wait || !errors.Is(err, ErrPipelineLocked) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ErrCancelled
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// lockedError reports the process holding a lock, from the pid it wrote
+func lockedError(pid []byte) error {
+	if holder := strings.TrimSpace(string(pid)); holder != "" {
+		return fmt.Errorf("%w (pid %s)", ErrPipelineLocked, holder)
+	}
+	return ErrPipelineLocked
+}
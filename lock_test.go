@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockState(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	held, err := LockState(t.Context(), "p.yaml", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LockState(t.Context(), "p.yaml", false)
+	if !errors.Is(err, ErrPipelineLocked) || !strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+		t.Fatalf("second lock error = %v, want ErrPipelineLocked naming this process", err)
+	}
+
+	other, err := LockState(t.Context(), "other/p.yaml", false)
+	if err != nil {
+		t.Fatalf("a pipeline with the same name elsewhere is locked: %v", err)
+	}
+	other.release()
+
+	ctx, cancel := context.WithTimeout(t.Context(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := LockState(ctx, "p.yaml", true); !errors.Is(err, ErrCancelled) {
+		t.Fatalf("waiting on a cancelled context returned %v", err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		held.release()
+	}()
+	waited, err := LockState(t.Context(), "p.yaml", true)
+	if err != nil {
+		t.Fatalf("waiting for the lock: %v", err)
+	}
+	waited.release()
+}
+
+func TestRunRefusesLockedPipeline(t *testing.T) {
+	t.Chdir(t.TempDir())
+	p := &Pipeline{File: "p.yaml", Agent: AgentConfig{Cmd: "echo"}, Steps: []Step{{Name: "a", Run: "true"}}}
+
+	lock, err := LockState(t.Context(), p.File, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.release()
+
+	err = RunPipelineWithCallbacks(t.Context(), p, Callbacks{}, RunOptions{Iteration: 1})
+	if !errors.Is(err, ErrPipelineLocked) {
+		t.Errorf("RunPipelineWithCallbacks() error = %v, want ErrPipelineLocked", err)
+	}
+}
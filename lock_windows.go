@@ -0,0 +1,32 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+)
+
+// tryLock creates path exclusively. A run that crashed leaves the file
+// behind; deleting it releases the lock.
+func tryLock(path string) (*stateLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		pid, _ := os.ReadFile(path)
+		return nil, lockedError(pid)
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	return &stateLock{f: f}, nil
+}
+
+func (l *stateLock) release() {
+	if l == nil {
+		return
+	}
+	l.f.Close()
+	os.Remove(l.f.Name())
+}
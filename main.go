@@ -1,19 +1,41 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	tea "github.com/charmbracelet/bubbletea"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		os.Exit(runTestCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "runs" {
+		os.Exit(runRunsCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rollback" {
+		os.Exit(runRollbackCommand(os.Args[2:]))
+	}
+
 	useTUI := flag.Bool("tui", true, "Use TUI mode (default)")
 	showVersion := flag.Bool("version", false, "Show version")
 	resume := flag.Bool("resume", false, "Resume from last checkpoint")
 	clean := flag.Bool("clean", false, "Clean state and start fresh")
 	loop := flag.Int("loop", 0, "Number of times to run pipeline (0 = infinite, default in TUI)")
+	record := flag.String("record", "", "Record every agent call to a cassette file")
+	replay := flag.String("replay", "", "Answer agent calls from a recorded cassette file")
+	from := flag.String("from", "", "Re-run from this step, using the saved outputs of earlier steps")
+	until := flag.String("until", "", "Stop after this step")
+	only := flag.String("only", "", "Only run these steps (comma-separated)")
+	wait := flag.Bool("wait", false, "Wait for another run of the same pipeline to finish instead of failing")
+	isolate := flag.String("isolate", "", "Run in a new git worktree (worktree) or a copy of the project (copy)")
 	flag.Parse()
 
 	if *showVersion {
@@ -23,12 +45,21 @@ func main() {
 
 	args := flag.Args()
 	if len(args) < 1 {
-		log.Fatal("Usage: octos [--tui] [--resume] [--clean] [--loop N] <pipeline.yaml>")
+		log.Fatal("Usage: octos [--tui] [--resume] [--clean] [--wait] [--loop N] [--record|--replay cassette.json]\n" +
+			"             [--from step] [--until step] [--only step,...] [--isolate worktree|copy] <pipeline.yaml>\n" +
+			"       octos test [--junit report.xml] [--run name] <pipeline.yaml> <tests.yaml>\n" +
+			"       octos runs list|show|prune\n" +
+			"       octos rollback <run> --to <step>")
 	}
 
 	pipelineFile := args[0]
 
 	if *clean {
+		lock, err := LockState(context.Background(), pipelineFile, *wait)
+		if err != nil {
+			log.Fatalf("%s: %v", pipelineFile, err)
+		}
+		defer lock.release()
 		if err := ClearState(pipelineFile); err != nil {
 			log.Fatalf("Failed to clear state: %v", err)
 		}
@@ -41,32 +72,85 @@ func main() {
 		log.Fatal(err)
 	}
 
+	sel := StepSelection{From: *from, Until: *until}
+	if *only != "" {
+		for _, name := range strings.Split(*only, ",") {
+			sel.Only = append(sel.Only, strings.TrimSpace(name))
+		}
+	}
+	if !sel.IsZero() {
+		if *resume {
+			log.Fatal("--resume cannot be combined with --from, --until or --only")
+		}
+		if err := sel.validate(pipeline); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := validateIsolation(*isolate); err != nil {
+		log.Fatal(err)
+	}
+
+	var cassette *Cassette
+	switch {
+	case *record != "" && *replay != "":
+		log.Fatal("--record and --replay cannot be used together")
+	case *record != "":
+		cassette = NewCassette(*record, pipelineFile)
+	case *replay != "":
+		if cassette, err = LoadCassette(*replay); err != nil {
+			log.Fatalf("Failed to load cassette: %v", err)
+		}
+	}
+
 	if *useTUI {
 		// TUI mode
 		m := NewTUIModel(pipeline, *resume)
 		m.maxLoops = *loop
+		m.cassette = cassette
+		m.wait = *wait
+		m.isolate = *isolate
+		m.selectSteps(sel)
 		p := tea.NewProgram(&m, tea.WithAltScreen())
 		m.program = p
-		if _, err := p.Run(); err != nil {
+		_, err := p.Run()
+		// Quitting the UI must not leave agents running
+		m.Shutdown()
+		if err != nil {
 			log.Fatal(err)
 		}
 	} else {
 		// Headless mode - loop must be finite (default to 1 if 0)
+		runCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
 		loopCount := *loop
 		if loopCount == 0 {
 			loopCount = 1
 		}
 		
+		var usage Usage // over all loops
 		for i := 1; i <= loopCount; i++ {
 			if loopCount > 1 {
 				fmt.Printf("\n→ Loop iteration %d/%d\n", i, loopCount)
 			}
 			
-			if err := RunPipelineWithResume(pipeline, *resume && i == 1); err != nil {
+			var runUsage Usage
+			cb := Callbacks{OnUsage: func(_ int, _ Usage, total Usage) { runUsage = total }}
+			opts := RunOptions{Resume: *resume && i == 1, Iteration: i, Wait: *wait, Cassette: cassette, Isolate: *isolate}
+			if i == 1 {
+				opts.Select = sel
+			}
+			err := RunPipelineWithCallbacks(runCtx, pipeline, cb, opts)
+			usage.Add(runUsage)
+			if err != nil {
 				log.Fatal(err)
 			}
 		}
 		
 		fmt.Println("✓ Pipeline completed")
+		if loopCount > 1 && !usage.IsZero() {
+			fmt.Printf("💰 Usage over %d loops: %s\n", loopCount, usage)
+		}
 	}
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mockSummaryKey is the responses entry that answers summarize calls
+const mockSummaryKey = "summarize"
+
+// MockResponse is one scripted answer of the mock agent
+type MockResponse struct {
+	Output string `yaml:"output"`
+	Exit   int    `yaml:"exit"` // non-zero fails the call with this exit code
+}
+
+// MockResponses are the answers for one step, one per call; the last one
+// repeats. In YAML it is an output string, a response, or a list of either.
+type MockResponses []MockResponse
+
+func (m *MockResponses) UnmarshalYAML(node *yaml.Node) error {
+	nodes := []*yaml.Node{node}
+	if node.Kind == yaml.SequenceNode {
+		nodes = node.Content
+	}
+
+	var responses MockResponses
+	for _, n := range nodes {
+		var r MockResponse
+		if n.Kind == yaml.ScalarNode {
+			if err := n.Decode(&r.Output); err != nil {
+				return err
+			}
+		} else if err := n.Decode(&r); err != nil {
+			return err
+		}
+		responses = append(responses, r)
+	}
+	*m = responses
+	return nil
+}
+
+// MockAgent answers every agent call of a pipeline from scripted responses,
+// and replaces the run steps it has responses for. Steps without responses
+// get an empty output.
+type MockAgent struct {
+	Responses map[string]MockResponses
+
+	mu      sync.Mutex
+	calls   map[string]int
+	prompts map[string]string // last prompt per step
+}
+
+func NewMockAgent(responses map[string]MockResponses) *MockAgent {
+	return &MockAgent{
+		Responses: responses,
+		calls:     make(map[string]int),
+		prompts:   make(map[string]string),
+	}
+}
+
+// scripts reports whether the mock has responses for the named step
+func (m *MockAgent) scripts(step string) bool {
+	if m == nil {
+		return false
+	}
+	_, ok := m.Responses[step]
+	return ok
+}
+
+// agent returns the Agent answering calls made for the named step
+func (m *MockAgent) agent(step string) Agent {
+	return &mockStepAgent{m: m, step: step}
+}
+
+// Prompt returns the last prompt sent for the named step
+func (m *MockAgent) Prompt(step string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prompt, ok := m.prompts[step]
+	return prompt, ok
+}
+
+// respond records prompt and returns the next response for step
+func (m *MockAgent) respond(step, prompt string) MockResponse {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.prompts[step] = prompt
+	n := m.calls[step]
+	m.calls[step]++
+
+	responses := m.Responses[step]
+	switch {
+	case len(responses) == 0:
+		return MockResponse{}
+	case n < len(responses):
+		return responses[n]
+	default:
+		return responses[len(responses)-1]
+	}
+}
+
+type mockStepAgent struct {
+	m    *MockAgent
+	step string
+}
+
+func (a *mockStepAgent) Run(runCtx context.Context, prompt string, onLine func(string)) (*AgentResult, error) {
+	r := a.m.respond(a.step, prompt)
+	if onLine != nil && r.Output != "" {
+		for _, line := range strings.Split(r.Output, "\n") {
+			onLine(line)
+		}
+	}
+
+	res := &AgentResult{Output: r.Output}
+	if r.Exit != 0 {
+		return res, &scriptedError{code: r.Exit, msg: fmt.Sprintf("exit status %d", r.Exit)}
+	}
+	return res, nil
+}
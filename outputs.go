@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// OutputSpec extracts a named value from a step's output. Exactly one of
+// regex, json or last_line is set.
+type OutputSpec struct {
+	Regex    string `yaml:"regex"`     // first match; see Group
+	Group    *int   `yaml:"group"`     // capture group, default 1 (or the whole match without groups)
+	JSON     string `yaml:"json"`      // path into the JSON output, e.g. review.issues[0]; "." is the root
+	LastLine bool   `yaml:"last_line"` // last non-empty line
+}
+
+func (o OutputSpec) validate() error {
+	set := 0
+	if o.Regex != "" {
+		set++
+		re, err := regexp.Compile(o.Regex)
+		if err != nil {
+			return fmt.Errorf("regex: %w", err)
+		}
+		if o.Group != nil && (*o.Group < 0 || *o.Group > re.NumSubexp()) {
+			return fmt.Errorf("group %d does not exist in %q", *o.Group, o.Regex)
+		}
+	}
+	if o.JSON != "" {
+		set++
+		if _, err := parseJSONPath(o.JSON); err != nil {
+			return err
+		}
+	}
+	if o.LastLine {
+		set++
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of regex, json or last_line is required")
+	}
+	if o.Group != nil && o.Regex == "" {
+		return fmt.Errorf("group requires regex")
+	}
+	return nil
+}
+
+// extract returns the value described by o from output
+func (o OutputSpec) extract(output string) (string, error) {
+	switch {
+	case o.Regex != "":
+		re, err := regexp.Compile(o.Regex)
+		if err != nil {
+			return "", err
+		}
+		m := re.FindStringSubmatch(output)
+		if m == nil {
+			return "", fmt.Errorf("no match for %q", o.Regex)
+		}
+		group := 0
+		if re.NumSubexp() > 0 {
+			group = 1
+		}
+		if o.Group != nil {
+			group = *o.Group
+		}
+		return strings.TrimSpace(m[group]), nil
+
+	case o.JSON != "":
+		doc, err := parseJSONOutput(output)
+		if err != nil {
+			return "", err
+		}
+		path, err := parseJSONPath(o.JSON)
+		if err != nil {
+			return "", err
+		}
+		v, err := lookupJSONPath(doc, path)
+		if err != nil {
+			return "", err
+		}
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+		return jsonString(v), nil
+
+	default:
+		lines := strings.Split(strings.TrimSpace(output), "\n")
+		return strings.TrimSpace(lines[len(lines)-1]), nil
+	}
+}
+
+// extractOutputs runs every spec of step against output. Values that cannot
+// be extracted are left empty and reported in errs, keyed by output name.
+func (s Step) extractOutputs(output string) (values map[string]string, errs map[string]error) {
+	if len(s.Outputs) == 0 {
+		return nil, nil
+	}
+	values = make(map[string]string, len(s.Outputs))
+	for _, name := range sortedKeys(s.Outputs) {
+		v, err := s.Outputs[name].extract(output)
+		if err != nil {
+			if errs == nil {
+				errs = make(map[string]error)
+			}
+			errs[name] = err
+		}
+		values[name] = v
+	}
+	return values, errs
+}
+
+// jsonPathElem is a property name or, when key is empty, an array index
+type jsonPathElem struct {
+	key   string
+	index int
+}
+
+// parseJSONPath splits a path like review.issues[0].title. A leading "$"
+// or "." is optional, and "." alone selects the whole document.
+func parseJSONPath(path string) ([]jsonPathElem, error) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	var elems []jsonPathElem
+	for rest != "" {
+		switch {
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("json path %q: missing ]", path)
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("json path %q: invalid index %q", path, rest[1:end])
+			}
+			elems = append(elems, jsonPathElem{index: n})
+			rest = rest[end+1:]
+		case rest[0] == '.':
+			rest = rest[1:]
+			if rest == "" || rest[0] == '.' || rest[0] == '[' {
+				return nil, fmt.Errorf("json path %q: empty property name", path)
+			}
+		default:
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			elems = append(elems, jsonPathElem{key: rest[:end]})
+			rest = rest[end:]
+		}
+	}
+	return elems, nil
+}
+
+func lookupJSONPath(doc any, path []jsonPathElem) (any, error) {
+	v := doc
+	for k, elem := range path {
+		where := formatJSONPath(path[:k+1])
+		if elem.key != "" {
+			obj, ok := v.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: expected object, got %s", where, jsonType(v))
+			}
+			if v, ok = obj[elem.key]; !ok {
+				return nil, fmt.Errorf("%s: not found", where)
+			}
+			continue
+		}
+		arr, ok := v.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected array, got %s", where, jsonType(v))
+		}
+		if elem.index >= len(arr) {
+			return nil, fmt.Errorf("%s: index out of range (length %d)", where, len(arr))
+		}
+		v = arr[elem.index]
+	}
+	return v, nil
+}
+
+func formatJSONPath(path []jsonPathElem) string {
+	var sb strings.Builder
+	sb.WriteString("$")
+	for _, elem := range path {
+		if elem.key != "" {
+			sb.WriteString("." + elem.key)
+		} else {
+			fmt.Fprintf(&sb, "[%d]", elem.index)
+		}
+	}
+	return sb.String()
+}
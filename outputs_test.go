@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOutputSpecExtract(t *testing.T) {
+	one := 1
+	zero := 0
+	review := "Looks fine.\n```json\n{\"verdict\": \"approve\", \"score\": 8, \"issues\": [{\"file\": \"a.go\"}]}\n```\n"
+
+	tests := []struct {
+		name    string
+		spec    OutputSpec
+		output  string
+		want    string
+		wantErr string
+	}{
+		{"regex first group by default", OutputSpec{Regex: `VERDICT: (\w+)`}, "...\nVERDICT: approve\n", "approve", ""},
+		{"regex explicit group", OutputSpec{Regex: `(\w+)=(\w+)`, Group: &one}, "key=value", "key", ""},
+		{"regex whole match", OutputSpec{Regex: `v\d+\.\d+`, Group: &zero}, "release v1.2 today", "v1.2", ""},
+		{"regex without groups", OutputSpec{Regex: `\d+ tests`}, "ran 12 tests", "12 tests", ""},
+		{"regex no match", OutputSpec{Regex: `VERDICT: (\w+)`}, "nothing", "", "no match"},
+		{"json string in fence", OutputSpec{JSON: "verdict"}, review, "approve", ""},
+		{"json number", OutputSpec{JSON: "score"}, review, "8", ""},
+		{"json nested index", OutputSpec{JSON: "issues[0].file"}, review, "a.go", ""},
+		{"json object", OutputSpec{JSON: "issues[0]"}, review, `{"file":"a.go"}`, ""},
+		{"json root", OutputSpec{JSON: "."}, `[1, 2]`, "[1,2]", ""},
+		{"json missing key", OutputSpec{JSON: "summary"}, review, "", "$.summary: not found"},
+		{"json index out of range", OutputSpec{JSON: "issues[3]"}, review, "", "index out of range"},
+		{"json not an object", OutputSpec{JSON: "score.value"}, review, "", "$.score.value: expected object, got integer"},
+		{"json invalid output", OutputSpec{JSON: "verdict"}, "approve", "", "not valid JSON"},
+		{"last line", OutputSpec{LastLine: true}, "thinking...\nDONE: 3 files\n\n", "DONE: 3 files", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.spec.extract(tt.output)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("extract() error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extract() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("extract() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputSpecValidate(t *testing.T) {
+	two := 2
+
+	tests := []struct {
+		name    string
+		spec    OutputSpec
+		wantErr bool
+	}{
+		{"regex", OutputSpec{Regex: `(\w+)`}, false},
+		{"json", OutputSpec{JSON: "$.items[0].name"}, false},
+		{"last line", OutputSpec{LastLine: true}, false},
+		{"nothing set", OutputSpec{}, true},
+		{"two sources", OutputSpec{Regex: "x", LastLine: true}, true},
+		{"invalid regex", OutputSpec{Regex: "("}, true},
+		{"missing group", OutputSpec{Regex: `(\w+)`, Group: &two}, true},
+		{"group without regex", OutputSpec{LastLine: true, Group: &two}, true},
+		{"bad index", OutputSpec{JSON: "items[x]"}, true},
+		{"empty property", OutputSpec{JSON: "a..b"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.spec.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInterpolateValues(t *testing.T) {
+	ctx := &Context{
+		Outputs: map[string]string{"review": "full text"},
+		Values:  map[string]map[string]string{"review": {"verdict": "approve"}},
+	}
+	got, _, err := interpolate("{{review.outputs.verdict}} / {{review.output}}", ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "approve / full text"; got != want {
+		t.Errorf("interpolate() = %q, want %q", got, want)
+	}
+}
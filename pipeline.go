@@ -4,29 +4,104 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// defaultMaxParallel caps concurrent steps when max_parallel is not set
+const defaultMaxParallel = 4
+
 type Pipeline struct {
-	File    string            `json:"-"`
-	Agent   AgentConfig       `yaml:"agent"`
-	Context map[string]any    `yaml:"context"`
-	Steps   []Step            `yaml:"steps"`
+	File        string         `json:"-"`
+	Agent       AgentConfig    `yaml:"agent"`
+	Context     map[string]any `yaml:"context"`
+	MaxParallel int            `yaml:"max_parallel"`
+	Timeout     time.Duration  `yaml:"timeout"` // default timeout for every step
+	Strict      bool           `yaml:"strict"`  // fail on unresolved template references
+	Session     string         `yaml:"session"` // default session for prompt steps
+
+	ContextBudget ContextBudget    `yaml:"context_budget"` // maximum prompt size
+	Summarize     *SummarizeConfig `yaml:"summarize"`      // compress outputs over the budget
+
+	Pricing map[string]Price `yaml:"pricing"` // price per model, in USD per million tokens
+	Budget  float64          `yaml:"budget"`  // maximum cost of a run, in USD
+
+	Git       GitConfig        `yaml:"git"`
+	Watch     WatchConfig      `yaml:"watch"` // which files change tracking looks at
+	PathRules `yaml:",inline"` // files every step may change
+
+	Steps []Step `yaml:"steps"`
 }
 
 type AgentConfig struct {
-	Cmd  string   `yaml:"cmd"`
-	Args []string `yaml:"args"`
+	Type       string   `yaml:"type"` // adapter: exec (default), claude, kiro-cli or opencode
+	Cmd        string   `yaml:"cmd"`
+	Args       []string `yaml:"args"`
+	PromptMode string   `yaml:"prompt_mode"` // arg (default), stdin or file
+	Model      string   `yaml:"model"`       // passed as --model by the adapters and used for pricing
+
+	session string // conversation to continue, set per step at run time
+	dir     string // working directory, set at run time for isolated runs
+}
+
+// Ways of handing the prompt to an agent
+const (
+	PromptModeArg   = "arg"
+	PromptModeStdin = "stdin"
+	PromptModeFile  = "file"
+)
+
+// promptFilePlaceholder in args is replaced by the prompt file path in file mode
+const promptFilePlaceholder = "{{prompt_file}}"
+
+func (a AgentConfig) validate() error {
+	if _, err := newAgent(a); err != nil {
+		return fmt.Errorf("type: %w", err)
+	}
+	if a.Cmd == "" && agentDefaultCmd[a.Type] == "" {
+		return fmt.Errorf("cmd is required")
+	}
+	switch a.PromptMode {
+	case "", PromptModeArg, PromptModeStdin, PromptModeFile:
+	default:
+		return fmt.Errorf("prompt_mode must be arg, stdin or file, got %q", a.PromptMode)
+	}
+	if a.PromptMode != PromptModeFile {
+		for _, arg := range a.Args {
+			if strings.Contains(arg, promptFilePlaceholder) {
+				return fmt.Errorf("%s in args requires prompt_mode: file", promptFilePlaceholder)
+			}
+		}
+	}
+	return nil
 }
 
 type Step struct {
-	Name     string       `yaml:"name"`
-	Prompt   string       `yaml:"prompt"`
-	SaveTo   string       `yaml:"save_to"`
-	LoadFrom string       `yaml:"load_from"`
-	When     string       `yaml:"when"`
-	Agent    *AgentConfig `yaml:"agent,omitempty"`
+	Name         string        `yaml:"name"`
+	Prompt       string        `yaml:"prompt"`
+	Run          string        `yaml:"run"` // shell command run instead of an agent
+	SaveTo       SaveSpec      `yaml:"save_to"`
+	LoadFrom     StringList    `yaml:"load_from"` // artifact names or glob patterns
+	Files        FileInputs    `yaml:"files"`     // project files loaded into {{files.*}}
+	When         string        `yaml:"when"`
+	DependsOn    []string      `yaml:"depends_on"`
+	Timeout      time.Duration `yaml:"timeout"`
+	AllowFailure bool          `yaml:"allow_failure"` // a non-zero exit does not stop the pipeline
+	Session      string        `yaml:"session"`       // new, continue or a shared session name
+
+	Retries      int           `yaml:"retries"`
+	RetryDelay   time.Duration `yaml:"retry_delay"`
+	RetryBackoff float64       `yaml:"retry_backoff"` // delay multiplier per attempt
+	RetryOn      string        `yaml:"retry_on"`      // regex matched against the failed output
+
+	IncludeOutputs OutputPolicy          `yaml:"include_outputs"` // previous outputs added to the prompt
+	Expect         *Expect               `yaml:"expect"`
+	Outputs        map[string]OutputSpec `yaml:"outputs"` // named values extracted from the output
+	Agent          *AgentConfig          `yaml:"agent,omitempty"`
+
+	PathRules `yaml:",inline"` // files the step may change, on top of the pipeline's
 }
 
 func LoadPipeline(path string) (*Pipeline, error) {
@@ -56,24 +131,168 @@ func LoadPipeline(path string) (*Pipeline, error) {
 	return &p, nil
 }
 
+// kind names the field holding the step's work, for error messages
+func (s Step) kind() string {
+	if s.Run != "" {
+		return "run"
+	}
+	return "prompt"
+}
+
 // Validate checks if the pipeline configuration is valid
 func (p *Pipeline) Validate() error {
-	if p.Agent.Cmd == "" {
-		return fmt.Errorf("agent.cmd is required")
+	if err := p.Agent.validate(); err != nil {
+		return fmt.Errorf("agent.%w", err)
 	}
 	
 	if len(p.Steps) == 0 {
 		return fmt.Errorf("at least one step is required")
 	}
 	
+	if p.MaxParallel < 0 {
+		return fmt.Errorf("max_parallel must be positive")
+	}
+	
+	if p.Timeout < 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	
+	if p.Budget < 0 {
+		return fmt.Errorf("budget must be positive")
+	}
+
+	for _, model := range sortedKeys(p.Pricing) {
+		if err := p.Pricing[model].validate(); err != nil {
+			return fmt.Errorf("pricing.%s: %w", model, err)
+		}
+	}
+	
+	if err := p.PathRules.validate(); err != nil {
+		return err
+	}
+
+	if err := p.Watch.validate(); err != nil {
+		return err
+	}
+
+	if p.Summarize != nil {
+		if p.Summarize.MaxChars < 0 {
+			return fmt.Errorf("summarize.max_chars must be positive")
+		}
+		if p.Summarize.Agent != nil {
+			if err := p.Summarize.Agent.validate(); err != nil {
+				return fmt.Errorf("summarize.agent.%w", err)
+			}
+		}
+	}
+	
+	seen := make(map[string]bool)
 	for i, step := range p.Steps {
 		if step.Name == "" {
 			return fmt.Errorf("step %d: name is required", i+1)
 		}
-		if step.Prompt == "" {
-			return fmt.Errorf("step %d (%s): prompt is required", i+1, step.Name)
+		if seen[step.Name] {
+			return fmt.Errorf("step %d (%s): duplicate step name", i+1, step.Name)
+		}
+		seen[step.Name] = true
+		if step.Prompt == "" && step.Run == "" {
+			return fmt.Errorf("step %d (%s): prompt or run is required", i+1, step.Name)
+		}
+		if step.Prompt != "" && step.Run != "" {
+			return fmt.Errorf("step %d (%s): prompt and run cannot be used together", i+1, step.Name)
+		}
+		if step.Run != "" && step.Agent != nil {
+			return fmt.Errorf("step %d (%s): agent cannot be set on a run step", i+1, step.Name)
+		}
+		if step.Run != "" && step.Session != "" {
+			return fmt.Errorf("step %d (%s): session cannot be set on a run step", i+1, step.Name)
+		}
+		if step.Agent != nil {
+			if err := step.Agent.validate(); err != nil {
+				return fmt.Errorf("step %d (%s): agent.%w", i+1, step.Name, err)
+			}
+		}
+		if err := step.validateArtifacts(); err != nil {
+			return fmt.Errorf("step %d (%s): %w", i+1, step.Name, err)
+		}
+		if step.Timeout < 0 {
+			return fmt.Errorf("step %d (%s): timeout must be positive", i+1, step.Name)
+		}
+		if err := step.PathRules.validate(); err != nil {
+			return fmt.Errorf("step %d (%s): %w", i+1, step.Name, err)
+		}
+		if err := step.validateRetry(); err != nil {
+			return fmt.Errorf("step %d (%s): %w", i+1, step.Name, err)
+		}
+		for _, name := range sortedKeys(step.Outputs) {
+			if err := step.Outputs[name].validate(); err != nil {
+				return fmt.Errorf("step %d (%s): outputs.%s: %w", i+1, step.Name, name, err)
+			}
+		}
+		if step.Expect != nil {
+			if err := step.Expect.validate(filepath.Dir(p.File)); err != nil {
+				return fmt.Errorf("step %d (%s): %w", i+1, step.Name, err)
+			}
+		}
+	}
+	
+	graph, err := buildStepGraph(p.Steps)
+	if err != nil {
+		return err
+	}
+	
+	for i, step := range p.Steps {
+		if err := p.validateSession(graph, i); err != nil {
+			return fmt.Errorf("step %d (%s): session: %w", i+1, step.Name, err)
+		}
+		if err := checkTemplates(p, graph, i); err != nil {
+			return fmt.Errorf("step %d (%s): %s: %w", i+1, step.Name, step.kind(), err)
+		}
+		for _, name := range step.IncludeOutputs.Steps {
+			if err := checkConditionRef(p, graph, i, []string{name, "output"}); err != nil {
+				return fmt.Errorf("step %d (%s): include_outputs: %w", i+1, step.Name, err)
+			}
+		}
+
+		if step.When == "" {
+			continue
+		}
+		cond, err := parseCondition(step.When)
+		if err != nil {
+			return fmt.Errorf("step %d (%s): when: %w", i+1, step.Name, err)
+		}
+		for _, ref := range cond.refs {
+			if err := checkConditionRef(p, graph, i, ref); err != nil {
+				return fmt.Errorf("step %d (%s): when: %w", i+1, step.Name, err)
+			}
 		}
 	}
 	
 	return nil
 }
+
+// Parallelism returns how many steps may run at the same time
+func (p *Pipeline) Parallelism() int {
+	if p.MaxParallel > 0 {
+		return p.MaxParallel
+	}
+	return defaultMaxParallel
+}
+
+// StepTimeout returns the timeout for step, falling back to the pipeline default
+func (p *Pipeline) StepTimeout(step Step) time.Duration {
+	if step.Timeout > 0 {
+		return step.Timeout
+	}
+	return p.Timeout
+}
+
+// StepIndex returns the index of the named step, or -1 if there is none
+func (p *Pipeline) StepIndex(name string) int {
+	for i, step := range p.Steps {
+		if step.Name == name {
+			return i
+		}
+	}
+	return -1
+}
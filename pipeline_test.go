@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateStepKind(t *testing.T) {
+	tests := []struct {
+		name    string
+		step    Step
+		wantErr string
+	}{
+		{"prompt step", Step{Name: "a", Prompt: "x"}, ""},
+		{"run step", Step{Name: "a", Run: "go test ./...", AllowFailure: true}, ""},
+		{"neither", Step{Name: "a"}, "prompt or run is required"},
+		{"both", Step{Name: "a", Prompt: "x", Run: "ls"}, "cannot be used together"},
+		{"agent on run step", Step{Name: "a", Run: "ls", Agent: &AgentConfig{Cmd: "other"}}, "agent cannot be set"},
+		{"run references unknown step", Step{Name: "a", Run: "echo {{ghost.output}}"}, "run: {{ghost.output}}: reference to unknown step"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Pipeline{Agent: AgentConfig{Cmd: "agent"}, Steps: []Step{tt.step}}
+			err := p.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
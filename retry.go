@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"time"
+)
+
+// attemptResult is the outcome of a single agent invocation
+type attemptResult struct {
+	output    string
+	exitCode  int
+	duration  time.Duration
+	err       error
+	sessionID string // reported by the agent adapter, if any
+	usage     Usage
+	reverted  []string // changes to paths not allowed, undone after the attempt
+}
+
+// MaxAttempts returns how many times the step may run in total
+func (s Step) MaxAttempts() int {
+	return s.Retries + 1
+}
+
+func (s Step) validateRetry() error {
+	if s.Retries < 0 {
+		return fmt.Errorf("retries must be positive")
+	}
+	if s.RetryDelay < 0 {
+		return fmt.Errorf("retry_delay must be positive")
+	}
+	if s.RetryBackoff != 0 && s.RetryBackoff < 1 {
+		return fmt.Errorf("retry_backoff must be at least 1")
+	}
+	if s.RetryOn != "" {
+		if _, err := regexp.Compile(s.RetryOn); err != nil {
+			return fmt.Errorf("retry_on: %w", err)
+		}
+	}
+	return nil
+}
+
+// retryDelay returns how long to wait after the given failed attempt
+func (s Step) retryDelay(attempt int) time.Duration {
+	backoff := s.RetryBackoff
+	if backoff == 0 {
+		backoff = 1
+	}
+	return time.Duration(float64(s.RetryDelay) * math.Pow(backoff, float64(attempt-1)))
+}
+
+// shouldRetry reports whether a failed attempt is worth retrying. Cancelled
+// runs and replay mismatches never are; with retry_on set, the agent output
+// or error must match it.
+func (s Step) shouldRetry(res attemptResult) bool {
+	if errors.Is(res.err, ErrCancelled) || errors.Is(res.err, ErrReplayMismatch) {
+		return false
+	}
+	if s.RetryOn == "" {
+		return true
+	}
+	re, err := regexp.Compile(s.RetryOn)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(res.output) || re.MatchString(res.err.Error())
+}
+
+// allowsFailure reports whether a failed attempt still completes the step:
+// allow_failure covers non-zero exits, not timeouts, cancellation or
+// rejected output.
+func (s Step) allowsFailure(res attemptResult) bool {
+	return s.AllowFailure && res.exitCode > 0 &&
+		!errors.Is(res.err, ErrStepTimedOut) && !errors.Is(res.err, ErrCancelled)
+}
+
+// runAttempt invokes the agent (or the run command) once, bounded by the step timeout
+func (r *pipelineRun) runAttempt(i int, agent AgentConfig, prompt string) attemptResult {
+	step := r.p.Steps[i]
+	start := time.Now()
+
+	stepCtx := r.runCtx
+	timeout := r.p.StepTimeout(step)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		stepCtx, cancel = context.WithTimeout(r.runCtx, timeout)
+		defer cancel()
+	}
+
+	var onLine func(string)
+	if r.cb.OnStream != nil {
+		onLine = func(line string) { r.cb.OnStream(i, line) }
+	}
+
+	var res attemptResult
+	if step.Run != "" && !r.mock.scripts(step.Name) {
+		// Step values reach the command in environment variables, not as
+		// shell code
+		r.mu.Lock()
+		script := r.scripts[i]
+		r.mu.Unlock()
+		cmd := newShellCommand(stepCtx, agent.dir, script.text)
+		cmd.Env = append(os.Environ(), script.env...)
+		if onLine != nil {
+			res.output, res.err = runCommandWithStreaming(cmd, onLine)
+		} else {
+			res.output, res.err = runCommand(cmd)
+		}
+	} else if adapter, err := r.agentFor(step.Name, agent); err != nil {
+		res.err = err
+	} else {
+		result, err := adapter.Run(stepCtx, prompt, onLine)
+		res.output, res.err = result.Output, err
+		res.sessionID = result.SessionID
+		if step.Run == "" {
+			res.usage = r.p.meterUsage(agent, prompt, result)
+		}
+	}
+	res.duration = time.Since(start)
+
+	if res.err != nil {
+		res.exitCode = exitCode(res.err)
+
+		switch {
+		case r.runCtx.Err() != nil:
+			res.err = ErrCancelled
+		case stepCtx.Err() == context.DeadlineExceeded:
+			res.err = fmt.Errorf("%w after %s", ErrStepTimedOut, timeout)
+		}
+	}
+
+	return res
+}
+
+// agentFor returns what answers the agent calls made for step: the mock
+// agent under octos test, or the adapter for cfg, recorded or replayed when
+// a cassette is set
+func (r *pipelineRun) agentFor(step string, cfg AgentConfig) (Agent, error) {
+	if r.mock != nil {
+		return r.mock.agent(step), nil
+	}
+	adapter, err := newAgent(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return r.cassette.wrap(step, cfg, adapter), nil
+}
+
+// exitCode returns the exit status carried by err, or -1 if the command
+// did not exit on its own
+func exitCode(err error) int {
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// runWithRetries runs the agent until it succeeds, the retries are used up
+// or the failure does not match retry_on. Every attempt is returned so it
+// can be stored in the step checkpoint.
+func (r *pipelineRun) runWithRetries(i int, agent AgentConfig, prompt string) (attemptResult, []AttemptRecord) {
+	step := r.p.Steps[i]
+	maxAttempts := step.MaxAttempts()
+	var records []AttemptRecord
+
+	for attempt := 1; ; attempt++ {
+		res := r.runAttempt(i, agent, prompt)
+
+		record := AttemptRecord{
+			Attempt:  attempt,
+			ExitCode: res.exitCode,
+			Duration: res.duration.Seconds(),
+		}
+		if res.err != nil {
+			record.Error = res.err.Error()
+		}
+		if !res.usage.IsZero() {
+			usage := res.usage
+			record.Usage = &usage
+			r.addUsage(i, usage)
+		}
+		records = append(records, record)
+
+		if res.err == nil || attempt >= maxAttempts || !step.shouldRetry(res) {
+			return res, records
+		}
+
+		delay := step.retryDelay(attempt)
+		r.recordRetry(i, records)
+		if !r.silent {
+			fmt.Printf("↻ Step %s failed (attempt %d/%d): %v, retrying in %s\n", step.Name, attempt, maxAttempts, res.err, delay)
+		}
+		if r.cb.OnAttempt != nil {
+			r.cb.OnAttempt(i, attempt+1, maxAttempts, res.err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-r.runCtx.Done():
+			records[len(records)-1].Error = ErrCancelled.Error()
+			return attemptResult{exitCode: -1, err: ErrCancelled}, records
+		}
+	}
+}
+
+// recordRetry checkpoints the failed attempts of a step that will be retried
+func (r *pipelineRun) recordRetry(i int, records []AttemptRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	last := records[len(records)-1]
+	r.state.Steps[r.p.Steps[i].Name] = &StepCheckpoint{
+		Status:     CheckpointRetrying,
+		FinishedAt: time.Now().Format(time.RFC3339),
+		ExitCode:   last.ExitCode,
+		Error:      last.Error,
+		Attempts:   append([]AttemptRecord{}, records...),
+	}
+	SaveState(r.state)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		step    Step
+		attempt int
+		want    time.Duration
+	}{
+		{"constant without backoff", Step{RetryDelay: time.Second}, 3, time.Second},
+		{"first attempt", Step{RetryDelay: time.Second, RetryBackoff: 2}, 1, time.Second},
+		{"exponential", Step{RetryDelay: time.Second, RetryBackoff: 2}, 3, 4 * time.Second},
+		{"fractional backoff", Step{RetryDelay: 100 * time.Millisecond, RetryBackoff: 1.5}, 2, 150 * time.Millisecond},
+		{"no delay", Step{RetryBackoff: 3}, 4, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.step.retryDelay(tt.attempt); got != tt.want {
+				t.Errorf("retryDelay(%d) = %s, want %s", tt.attempt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	failed := errors.New("exit status 1")
+
+	tests := []struct {
+		name string
+		step Step
+		res  attemptResult
+		want bool
+	}{
+		{"any failure without retry_on", Step{}, attemptResult{err: failed}, true},
+		{"timeout without retry_on", Step{}, attemptResult{err: fmt.Errorf("%w after 1s", ErrStepTimedOut)}, true},
+		{"cancelled", Step{}, attemptResult{err: ErrCancelled}, false},
+		{"retry_on matches output", Step{RetryOn: "(?i)rate limit"}, attemptResult{output: "Rate limit exceeded", err: failed}, true},
+		{"retry_on matches error", Step{RetryOn: "exit status 1"}, attemptResult{err: failed}, true},
+		{"retry_on does not match", Step{RetryOn: "rate limit"}, attemptResult{output: "syntax error", err: failed}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.step.shouldRetry(tt.res); got != tt.want {
+				t.Errorf("shouldRetry = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRetry(t *testing.T) {
+	tests := []struct {
+		name    string
+		step    Step
+		wantErr bool
+	}{
+		{"valid", Step{Retries: 2, RetryDelay: time.Second, RetryBackoff: 2, RetryOn: "rate"}, false},
+		{"negative retries", Step{Retries: -1}, true},
+		{"backoff below one", Step{RetryBackoff: 0.5}, true},
+		{"invalid retry_on", Step{RetryOn: "("}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.step.validateRetry(); (err != nil) != tt.wantErr {
+				t.Errorf("validateRetry() = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAllowsFailure(t *testing.T) {
+	failed := errors.New("exit status 1")
+
+	tests := []struct {
+		name string
+		step Step
+		res  attemptResult
+		want bool
+	}{
+		{"not allowed", Step{}, attemptResult{exitCode: 1, err: failed}, false},
+		{"non-zero exit", Step{AllowFailure: true}, attemptResult{exitCode: 1, err: failed}, true},
+		{"timeout", Step{AllowFailure: true}, attemptResult{exitCode: -1, err: ErrStepTimedOut}, false},
+		{"cancelled", Step{AllowFailure: true}, attemptResult{exitCode: 1, err: ErrCancelled}, false},
+		{"rejected output", Step{AllowFailure: true}, attemptResult{err: ErrExpectationFailed}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.step.allowsFailure(tt.res); got != tt.want {
+				t.Errorf("allowsFailure = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Run statuses in the run store
+const (
+	RunRunning   = "running"
+	RunCompleted = "completed"
+	RunFailed    = "failed"
+)
+
+// RunRecord is the metadata of one pipeline run, kept in
+// .octos/runs/<id>/run.json next to the prompts, outputs and artifacts of
+// its steps
+type RunRecord struct {
+	ID         string     `json:"id"`
+	Pipeline   string     `json:"pipeline"`
+	Iteration  int        `json:"iteration"`
+	Branch     string     `json:"branch,omitempty"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  string     `json:"started_at"`
+	FinishedAt string     `json:"finished_at,omitempty"`
+	Usage      Usage      `json:"usage"`
+	Workspace  *Workspace `json:"workspace,omitempty"` // set for runs started with --isolate
+	Steps      []*RunStep `json:"steps"`
+}
+
+// RunStep is what the run store keeps about one step of a run
+type RunStep struct {
+	Name        string   `json:"name"`
+	Dir         string   `json:"dir"` // holds prompt.txt and output.txt
+	Status      string   `json:"status"`
+	StartedAt   string   `json:"started_at,omitempty"`
+	FinishedAt  string   `json:"finished_at,omitempty"`
+	Duration    float64  `json:"duration_seconds"`
+	ExitCode    int      `json:"exit_code"`
+	Attempts    int      `json:"attempts,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	FileChanges []string `json:"file_changes,omitempty"`
+	Artifact    string   `json:"artifact,omitempty"` // save_to file, copied to artifacts/
+	Usage       *Usage   `json:"usage,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	Checkpoint  string   `json:"checkpoint,omitempty"` // git commit of the worktree after the step
+}
+
+func getRunsDir() string {
+	return filepath.Join(".octos", "runs")
+}
+
+// runLog writes one run to the run store as it happens. A nil runLog
+// records nothing, so a run store that cannot be written never stops a run.
+type runLog struct {
+	dir    string
+	record RunRecord
+	mu     sync.Mutex
+}
+
+// openRunLog starts the record of run id, or continues it when resuming
+func openRunLog(p *Pipeline, id string, iteration int, branch string) (*runLog, error) {
+	dir := filepath.Join(getRunsDir(), id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	l := &runLog{dir: dir}
+	if data, err := os.ReadFile(filepath.Join(dir, "run.json")); err == nil {
+		if err := json.Unmarshal(data, &l.record); err != nil {
+			return nil, err
+		}
+	} else {
+		l.record = RunRecord{
+			ID:        id,
+			Pipeline:  p.File,
+			Iteration: iteration,
+			Branch:    branch,
+			StartedAt: time.Now().Format(time.RFC3339),
+		}
+	}
+	l.record.Status = RunRunning
+	l.record.Error = ""
+	l.record.FinishedAt = ""
+	return l, l.save()
+}
+
+func (l *runLog) save() error {
+	data, err := json.MarshalIndent(l.record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(l.dir, "run.json"), data, 0644)
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// step returns the record of step i, creating it with its directory
+func (l *runLog) step(i int, name string) *RunStep {
+	for _, s := range l.record.Steps {
+		if s.Name == name {
+			return s
+		}
+	}
+	s := &RunStep{
+		Name: name,
+		Dir:  fmt.Sprintf("steps/%02d-%s", i+1, unsafeNameChars.ReplaceAllString(name, "_")),
+	}
+	l.record.Steps = append(l.record.Steps, s)
+	sort.SliceStable(l.record.Steps, func(a, b int) bool { return l.record.Steps[a].Dir < l.record.Steps[b].Dir })
+	return s
+}
+
+// update changes the record of step i and saves it
+func (l *runLog) update(i int, name string, change func(s *RunStep)) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	change(l.step(i, name))
+	l.save()
+}
+
+// writeStepFile stores the prompt or output of step i
+func (l *runLog) writeStepFile(i int, name, file, content string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	dir := filepath.Join(l.dir, filepath.FromSlash(l.step(i, name).Dir))
+	l.mu.Unlock()
+	if err := os.MkdirAll(dir, 0755); err == nil {
+		os.WriteFile(filepath.Join(dir, file), []byte(content), 0644)
+	}
+}
+
+// started records that step i is about to run with prompt
+func (l *runLog) started(i int, name, prompt string) {
+	l.writeStepFile(i, name, "prompt.txt", prompt)
+	l.update(i, name, func(s *RunStep) {
+		*s = RunStep{Name: s.Name, Dir: s.Dir, Status: RunRunning, StartedAt: time.Now().Format(time.RFC3339)}
+	})
+}
+
+// output stores what step i answered
+func (l *runLog) output(i int, name, output string) {
+	l.writeStepFile(i, name, "output.txt", output)
+}
+
+// diff stores the unified diff of the files step i changed, replacing the
+// one of an earlier attempt of the run
+func (l *runLog) diff(i int, name, diff string) {
+	if l == nil {
+		return
+	}
+	if diff != "" {
+		l.writeStepFile(i, name, "changes.diff", diff)
+		return
+	}
+	l.mu.Lock()
+	dir := filepath.Join(l.dir, filepath.FromSlash(l.step(i, name).Dir))
+	l.mu.Unlock()
+	os.Remove(filepath.Join(dir, "changes.diff"))
+}
+
+// finished records how step i ended
+func (l *runLog) finished(i int, name string, cp *StepCheckpoint, changes []string) {
+	l.update(i, name, func(s *RunStep) {
+		s.Status = cp.Status
+		s.FinishedAt = cp.FinishedAt
+		s.Duration = cp.Duration
+		s.ExitCode = cp.ExitCode
+		s.Attempts = len(cp.Attempts)
+		s.Error = cp.Error
+		s.FileChanges = changes
+		s.Usage = cp.Usage
+		s.Fingerprint = cp.Fingerprint
+		s.Artifact = cp.Artifact
+	})
+}
+
+// artifact keeps a copy of an artifact saved by a step of the run
+func (l *runLog) artifact(file, content string) error {
+	path := l.artifactFile(file)
+	if path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(content), 0644)
+}
+
+// artifactFile returns where the run keeps its copy of an artifact file, or
+// "" without a run store
+func (l *runLog) artifactFile(file string) string {
+	if l == nil {
+		return ""
+	}
+	return filepath.Join(l.dir, "artifacts", file)
+}
+
+// setWorkspace records where an isolated run works and where its changes went
+func (l *runLog) setWorkspace(ws *Workspace) {
+	if l == nil || ws == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.record.Workspace = ws
+	l.save()
+}
+
+// finish records the outcome of the run
+func (l *runLog) finish(err error, usage Usage) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.record.Status = RunCompleted
+	if err != nil {
+		l.record.Status = RunFailed
+		l.record.Error = err.Error()
+	}
+	l.record.FinishedAt = time.Now().Format(time.RFC3339)
+	l.record.Usage = usage
+	l.save()
+}
+
+// ListRuns returns the runs in the store, newest first
+func ListRuns() ([]*RunRecord, error) {
+	entries, err := os.ReadDir(getRunsDir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []*RunRecord
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		run, err := loadRun(e.Name())
+		if err != nil {
+			continue
+		}
+		runs = append(runs, run)
+	}
+	sort.Slice(runs, func(a, b int) bool { return runs[a].ID > runs[b].ID })
+	return runs, nil
+}
+
+func loadRun(id string) (*RunRecord, error) {
+	data, err := os.ReadFile(filepath.Join(getRunsDir(), id, "run.json"))
+	if err != nil {
+		return nil, err
+	}
+	var run RunRecord
+	if err := json.Unmarshal(data, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// FindRun returns the run whose id is id or starts with it. "latest" is
+// the newest run.
+func FindRun(id string) (*RunRecord, error) {
+	runs, err := ListRuns()
+	if err != nil {
+		return nil, err
+	}
+	if id == "latest" && len(runs) > 0 {
+		return runs[0], nil
+	}
+
+	var found []*RunRecord
+	for _, run := range runs {
+		if run.ID == id {
+			return run, nil
+		}
+		if strings.HasPrefix(run.ID, id) {
+			found = append(found, run)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("no run matches %q", id)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("%q matches %d runs", id, len(found))
+	}
+}
+
+// ReadRunStepFile returns the prompt.txt or output.txt of a step of run
+func ReadRunStepFile(run *RunRecord, step *RunStep, file string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(getRunsDir(), run.ID, filepath.FromSlash(step.Dir), file))
+	return string(data), err
+}
+
+// latestRun returns the newest run of pipelineFile
+func latestRun(pipelineFile string) (*RunRecord, error) {
+	runs, err := ListRuns()
+	if err != nil {
+		return nil, err
+	}
+	for _, run := range runs {
+		if run.Pipeline == pipelineFile {
+			return run, nil
+		}
+	}
+	return nil, fmt.Errorf("no run of %s recorded", pipelineFile)
+}
+
+// PruneRuns deletes all but the newest keep runs and returns the deleted
+// ids. Runs still in progress are never deleted.
+func PruneRuns(keep int) ([]string, error) {
+	runs, err := ListRuns()
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for k := keep; k < len(runs); k++ {
+		if runs[k].inProgress() {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(getRunsDir(), runs[k].ID)); err != nil {
+			return deleted, err
+		}
+		deleteCheckpointRefs(runs[k].ID)
+		if ws := runs[k].Workspace; ws != nil {
+			ws.remove()
+		}
+		deleted = append(deleted, runs[k].ID)
+	}
+	return deleted, nil
+}
+
+// inProgress reports whether run is still going: its status is running and
+// the state lock of its pipeline is held. A run whose process died is not.
+func (run *RunRecord) inProgress() bool {
+	if run.Status != RunRunning {
+		return false
+	}
+	path := getLockFile(run.Pipeline)
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	l, err := tryLock(path)
+	if err != nil {
+		return errors.Is(err, ErrPipelineLocked)
+	}
+	l.release()
+	return false
+}
+
+// runStatusIcon marks a run or step status in `octos runs` output
+func runStatusIcon(status string) string {
+	switch status {
+	case RunCompleted:
+		return "✓"
+	case CheckpointSkipped:
+		return "⊘"
+	case CheckpointTimedOut:
+		return "⏱"
+	case RunRunning, CheckpointRetrying:
+		return "…"
+	default:
+		return "✗"
+	}
+}
+
+// runDuration is the wall time of a run or step from its RFC 3339 timestamps
+func runDuration(started, finished string) time.Duration {
+	start, err1 := time.Parse(time.RFC3339, started)
+	end, err2 := time.Parse(time.RFC3339, finished)
+	if err1 != nil || err2 != nil {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// runRunsCommand implements `octos runs`, returning the exit status
+func runRunsCommand(args []string) int {
+	usage := "Usage: octos runs list\n" +
+		"       octos runs show [--step name] <id|latest>\n" +
+		"       octos runs prune --keep N"
+	if len(args) == 0 {
+		log.Fatal(usage)
+	}
+
+	switch args[0] {
+	case "list":
+		runs, err := ListRuns()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(runs) == 0 {
+			fmt.Println("No runs recorded yet")
+			return 0
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSTATUS\tSTEPS\tDURATION\tUSAGE\tPIPELINE")
+		for _, run := range runs {
+			done := 0
+			for _, s := range run.Steps {
+				if s.Status == CheckpointCompleted || s.Status == CheckpointSkipped {
+					done++
+				}
+			}
+			usage := "-"
+			if !run.Usage.IsZero() {
+				usage = run.Usage.String()
+			}
+			fmt.Fprintf(w, "%s\t%s %s\t%d/%d\t%s\t%s\t%s\n", run.ID, runStatusIcon(run.Status), run.Status,
+				done, len(run.Steps), runDuration(run.StartedAt, run.FinishedAt), usage, run.Pipeline)
+		}
+		w.Flush()
+
+	case "show":
+		fs := flag.NewFlagSet("runs show", flag.ExitOnError)
+		stepName := fs.String("step", "", "Print the prompt and output of this step")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			log.Fatal(usage)
+		}
+		run, err := FindRun(fs.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *stepName != "" {
+			return showRunStep(run, *stepName)
+		}
+		showRun(run)
+
+	case "prune":
+		fs := flag.NewFlagSet("runs prune", flag.ExitOnError)
+		keep := fs.Int("keep", -1, "Number of most recent runs to keep")
+		fs.Parse(args[1:])
+		if *keep < 0 {
+			log.Fatal(usage)
+		}
+		deleted, err := PruneRuns(*keep)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("✓ Deleted %d runs\n", len(deleted))
+
+	default:
+		log.Fatal(usage)
+	}
+	return 0
+}
+
+func showRun(run *RunRecord) {
+	fmt.Printf("Run %s %s %s\n", run.ID, runStatusIcon(run.Status), run.Status)
+	fmt.Printf("Pipeline:  %s (iteration %d)\n", run.Pipeline, run.Iteration)
+	if run.Branch != "" {
+		fmt.Printf("Branch:    %s\n", run.Branch)
+	}
+	fmt.Printf("Started:   %s\n", run.StartedAt)
+	if run.FinishedAt != "" {
+		fmt.Printf("Duration:  %s\n", runDuration(run.StartedAt, run.FinishedAt))
+	}
+	if !run.Usage.IsZero() {
+		fmt.Printf("Usage:     %s\n", run.Usage)
+	}
+	if run.Error != "" {
+		fmt.Printf("Error:     %s\n", run.Error)
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, s := range run.Steps {
+		details := []string{s.Status}
+		if s.Status != CheckpointSkipped && s.Status != RunRunning {
+			details = append(details, (time.Duration(s.Duration * float64(time.Second))).Round(100*time.Millisecond).String(),
+				fmt.Sprintf("exit %d", s.ExitCode))
+		}
+		if s.Attempts > 1 {
+			details = append(details, fmt.Sprintf("%d attempts", s.Attempts))
+		}
+		if s.Artifact != "" {
+			details = append(details, "💾 "+s.Artifact)
+		}
+		if s.Checkpoint != "" {
+			details = append(details, "⎇ "+s.Checkpoint[:min(len(s.Checkpoint), 7)])
+		}
+		if s.Usage != nil {
+			details = append(details, s.Usage.String())
+		}
+		fmt.Fprintf(w, "%s %s\t%s\n", runStatusIcon(s.Status), s.Name, strings.Join(details, ", "))
+		if s.Error != "" {
+			fmt.Fprintf(w, "    %s\n", s.Error)
+		}
+		for _, change := range s.FileChanges {
+			fmt.Fprintf(w, "    %s\n", change)
+		}
+	}
+	w.Flush()
+}
+
+func showRunStep(run *RunRecord, name string) int {
+	for _, s := range run.Steps {
+		if s.Name != name {
+			continue
+		}
+		for _, file := range []string{"prompt.txt", "output.txt", "changes.diff"} {
+			content, err := ReadRunStepFile(run, s, file)
+			if err != nil {
+				continue
+			}
+			fmt.Printf("=== %s ===\n%s\n", strings.TrimSuffix(file, filepath.Ext(file)), strings.TrimRight(content, "\n"))
+		}
+		return 0
+	}
+	log.Fatalf("run %s has no step %s", run.ID, name)
+	return 1
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunStoreRecordsRun(t *testing.T) {
+	t.Chdir(t.TempDir())
+	os.MkdirAll(filepath.Join(".octos", "artifacts"), 0755)
+	p := &Pipeline{
+		File:  "p.yaml",
+		Agent: AgentConfig{Cmd: "echo"},
+		Steps: []Step{
+			{Name: "write notes", Prompt: "notes", SaveTo: SaveSpec{File: "notes.md"}},
+			{Name: "skip", Prompt: "x", When: `{{write notes.output}} contains "zzz"`},
+			{Name: "fail", Run: "exit 2"},
+		},
+	}
+
+	if err := RunPipelineWithCallbacks(context.Background(), p, Callbacks{}, RunOptions{Iteration: 1}); err == nil {
+		t.Fatal("expected the fail step to fail the run")
+	}
+
+	run, err := FindRun("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != RunFailed || !strings.Contains(run.Error, "step fail failed") {
+		t.Errorf("run status = %s (%s)", run.Status, run.Error)
+	}
+
+	var statuses []string
+	for _, s := range run.Steps {
+		statuses = append(statuses, s.Name+"="+s.Status)
+	}
+	if want := []string{"write notes=completed", "skip=skipped", "fail=failed"}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("steps = %q, want %q", statuses, want)
+	}
+	if s := run.Steps[0]; s.Dir != "steps/01-write_notes" || s.Artifact != "notes.md" {
+		t.Errorf("step record = %+v", s)
+	}
+	if s := run.Steps[2]; s.ExitCode != 2 {
+		t.Errorf("exit code of fail = %d, want 2", s.ExitCode)
+	}
+
+	prompt, err := ReadRunStepFile(run, run.Steps[0], "prompt.txt")
+	if err != nil || !strings.Contains(prompt, "notes") {
+		t.Errorf("prompt.txt = %q, %v", prompt, err)
+	}
+	if _, err := os.Stat(filepath.Join(getRunsDir(), run.ID, "artifacts", "notes.md")); err != nil {
+		t.Errorf("artifact was not copied: %v", err)
+	}
+}
+
+func TestFindRun(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, id := range []string{"20260101-100000-aaaa", "20260101-100000-bbbb", "20260102-090000-cccc"} {
+		dir := filepath.Join(getRunsDir(), id)
+		os.MkdirAll(dir, 0755)
+		os.WriteFile(filepath.Join(dir, "run.json"), []byte(`{"id": "`+id+`"}`), 0644)
+	}
+
+	tests := []struct {
+		id      string
+		want    string
+		wantErr string
+	}{
+		{"latest", "20260102-090000-cccc", ""},
+		{"20260101-100000-bbbb", "20260101-100000-bbbb", ""},
+		{"20260102", "20260102-090000-cccc", ""},
+		{"20260101", "", `"20260101" matches 2 runs`},
+		{"2025", "", `no run matches "2025"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			run, err := FindRun(tt.id)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if run.ID != tt.want {
+				t.Errorf("FindRun(%q) = %s, want %s", tt.id, run.ID, tt.want)
+			}
+		})
+	}
+}
+
+func TestPruneRuns(t *testing.T) {
+	// The newest run is still going, the one before it died while running
+	runs := []struct{ id, status string }{
+		{"20260101-100000-aaaa", RunCompleted},
+		{"20260102-100000-bbbb", RunFailed},
+		{"20260103-100000-cccc", RunRunning},
+		{"20260104-100000-dddd", RunRunning},
+	}
+
+	tests := []struct {
+		keep        int
+		wantDeleted []string
+	}{
+		{5, nil},
+		{3, []string{"20260101-100000-aaaa"}},
+		{0, []string{"20260103-100000-cccc", "20260102-100000-bbbb", "20260101-100000-aaaa"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("keep %d", tt.keep), func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			for _, run := range runs {
+				dir := filepath.Join(getRunsDir(), run.id)
+				os.MkdirAll(dir, 0755)
+				pipeline := run.id + ".yaml"
+				os.WriteFile(filepath.Join(dir, "run.json"), []byte(`{"id": "`+run.id+`", "pipeline": "`+pipeline+`", "status": "`+run.status+`"}`), 0644)
+			}
+			lock, err := LockState(context.Background(), "20260104-100000-dddd.yaml", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lock.release()
+
+			deleted, err := PruneRuns(tt.keep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(deleted, tt.wantDeleted) {
+				t.Errorf("deleted = %q, want %q", deleted, tt.wantDeleted)
+			}
+			left, _ := ListRuns()
+			if len(left) != len(runs)-len(tt.wantDeleted) {
+				t.Errorf("%d runs left", len(left))
+			}
+		})
+	}
+}
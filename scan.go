@@ -0,0 +1,687 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxFiles caps the files tracked outside git when max_files is not set
+const defaultMaxFiles = 100000
+
+// maxBaselineSize caps the files hashed before every step outside git.
+// Larger files that are only touched are reported as modified.
+const maxBaselineSize = 1 << 20
+
+// Ways of detecting the files a step changed, for watch.mode
+const (
+	WatchScan   = "scan"   // walk the tree before and after every step
+	WatchNotify = "notify" // keep an index up to date from file system events
+)
+
+// WatchConfig sets which files change tracking looks at, and how
+type WatchConfig struct {
+	Include  StringList `yaml:"include"`   // globs of the files to track; empty tracks all
+	Exclude  StringList `yaml:"exclude"`   // globs of the files and directories never to track
+	Mode     string     `yaml:"mode"`      // scan (default) or notify
+	MaxFiles int        `yaml:"max_files"` // files tracked at most outside git
+}
+
+func (w WatchConfig) validate() error {
+	for _, pattern := range w.Include {
+		if err := validateGlob(pattern); err != nil {
+			return fmt.Errorf("watch.include: %w", err)
+		}
+	}
+	for _, pattern := range w.Exclude {
+		if err := validateGlob(pattern); err != nil {
+			return fmt.Errorf("watch.exclude: %w", err)
+		}
+	}
+	switch w.Mode {
+	case "", WatchScan, WatchNotify:
+	default:
+		return fmt.Errorf("watch.mode must be %s or %s, got %q", WatchScan, WatchNotify, w.Mode)
+	}
+	if w.MaxFiles < 0 {
+		return fmt.Errorf("watch.max_files must be positive")
+	}
+	return nil
+}
+
+func (w WatchConfig) maxFiles() int {
+	if w.MaxFiles > 0 {
+		return w.MaxFiles
+	}
+	return defaultMaxFiles
+}
+
+// ignoreRule is one line of a .gitignore or .octosignore file
+type ignoreRule struct {
+	base    string // directory of the ignore file, "" at the top
+	pattern string
+	negate  bool // re-includes what an earlier rule ignored
+	dirOnly bool // matches directories only
+}
+
+// parseIgnore reads the rules of an ignore file in directory base. It
+// supports the common subset of the .gitignore syntax: comments, !, a
+// trailing / for directories, a leading or inner / to anchor and **.
+func parseIgnore(base, content string) []ignoreRule {
+	var rules []ignoreRule
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, `\`)
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		// Without a slash a pattern matches at any depth
+		if !strings.Contains(line, "/") {
+			line = "**/" + line
+		}
+		rule.pattern = strings.TrimPrefix(line, "/")
+		if rule.pattern != "" {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// ignoredBy reports whether the last of rules matching the slash-separated
+// name ignores it
+func ignoredBy(rules []ignoreRule, name string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		rel := name
+		if rule.base != "" {
+			if !strings.HasPrefix(name, rule.base+"/") {
+				continue
+			}
+			rel = name[len(rule.base)+1:]
+		}
+		if matchGlob(rule.pattern, rel) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// fileStat is what the scanner knows of a file
+type fileStat struct {
+	size  int64
+	mtime time.Time
+	hash  string // content hash, when known
+}
+
+// fileScanner finds the files a step changed outside git, and keeps the
+// File Changes panel up to date while steps run. It skips .git, .octos,
+// node_modules, what .gitignore files and the .octosignore at the top
+// ignore, and what the watch block excludes.
+type fileScanner struct {
+	root   string
+	watch  WatchConfig
+	ignore []ignoreRule // .octosignore and .git/info/exclude, nested .gitignore files are read while walking
+
+	mu        sync.Mutex
+	hashes    map[string]fileStat // content hashes of files that changed, by path
+	truncated bool                // the last scan stopped at max_files
+	warned    bool                // the user was told about it
+
+	watcher *fileWatcher // set in notify mode
+}
+
+func newFileScanner(root string, watch WatchConfig) *fileScanner {
+	s := &fileScanner{root: root, watch: watch, hashes: make(map[string]fileStat)}
+	s.ignore = append(readIgnore(root, ".octosignore"), readIgnore(root, filepath.Join(".git", "info", "exclude"))...)
+	return s
+}
+
+// readIgnore returns the rules of the ignore file at the top of root
+func readIgnore(root, file string) []ignoreRule {
+	data, err := os.ReadFile(filepath.Join(root, file))
+	if err != nil {
+		return nil
+	}
+	return parseIgnore("", string(data))
+}
+
+// walkProject returns every file below root, sorted, leaving out .git,
+// .octos, node_modules and what git ignores, and with octosignore what the
+// .octosignore ignores too
+func walkProject(root string, octosignore bool) []string {
+	s := newFileScanner(root, WatchConfig{MaxFiles: math.MaxInt})
+	if !octosignore {
+		s.ignore = readIgnore(root, filepath.Join(".git", "info", "exclude"))
+	}
+	return slices.Sorted(maps.Keys(s.scan("")))
+}
+
+// skipDir reports whether the directory name, relative to the root, is left
+// out of scans
+func (s *fileScanner) skipDir(name string, rules []ignoreRule) bool {
+	switch path.Base(name) {
+	case ".git", ".octos", "node_modules":
+		return true
+	}
+	if ignoredBy(rules, name, true) {
+		return true
+	}
+	return slices.ContainsFunc(s.watch.Exclude, func(pattern string) bool { return matchGlob(pattern, name) })
+}
+
+// rulesFor returns the ignore rules that apply inside dir: those of the
+// .octosignore and of the .gitignore files from the top down to dir
+func (s *fileScanner) rulesFor(dir string) []ignoreRule {
+	rules := slices.Clone(s.ignore)
+	if dir == "." {
+		dir = ""
+	}
+	for base := ""; ; {
+		if data, err := os.ReadFile(filepath.Join(s.root, filepath.FromSlash(base), ".gitignore")); err == nil {
+			rules = append(rules, parseIgnore(base, string(data))...)
+		}
+		if base == dir {
+			return rules
+		}
+		next, _, _ := strings.Cut(strings.TrimPrefix(dir[len(base):], "/"), "/")
+		base = path.Join(base, next)
+	}
+}
+
+// tracks reports whether changes to the file name, relative to the root,
+// are reported
+func (s *fileScanner) tracks(name string) bool {
+	rules := s.rulesFor(path.Dir(name))
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if s.skipDir(dir, rules) {
+			return false
+		}
+	}
+	return s.tracksFile(name, rules)
+}
+
+// watched reports whether the .octosignore and the watch block let changes
+// to name be reported, for git repositories, where git applies .gitignore
+func (s *fileScanner) watched(name string) bool {
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		if ignoredBy(s.ignore, dir, true) || slices.ContainsFunc(s.watch.Exclude, func(pattern string) bool { return matchGlob(pattern, dir) }) {
+			return false
+		}
+	}
+	return s.tracksFile(name, s.ignore)
+}
+
+// overLimit reports, once, that a scan stopped at max_files
+func (s *fileScanner) overLimit() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.truncated || s.warned {
+		return false
+	}
+	s.warned = true
+	return true
+}
+
+// tracksFile reports whether the file name is tracked, given that its
+// directory is
+func (s *fileScanner) tracksFile(name string, rules []ignoreRule) bool {
+	if ignoredBy(rules, name, false) {
+		return false
+	}
+	if slices.ContainsFunc(s.watch.Exclude, func(pattern string) bool { return matchGlob(pattern, name) }) {
+		return false
+	}
+	return len(s.watch.Include) == 0 || slices.ContainsFunc(s.watch.Include, func(pattern string) bool { return matchGlob(pattern, name) })
+}
+
+// scan walks the tree, or dir below it, and returns its tracked files by
+// slash-separated path, up to max_files
+func (s *fileScanner) scan(dir string) map[string]fileStat {
+	files := make(map[string]fileStat)
+	truncated := false
+	rules := slices.Clone(s.ignore)
+	if dir != "" {
+		rules = s.rulesFor(path.Dir(dir))
+	}
+
+	start := filepath.Join(s.root, filepath.FromSlash(dir))
+	filepath.WalkDir(start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || truncated {
+			return nil
+		}
+		rel, _ := filepath.Rel(s.root, p)
+		name := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if name == "." {
+				name = ""
+			} else if s.skipDir(name, rules) {
+				return filepath.SkipDir
+			}
+			if data, err := os.ReadFile(filepath.Join(p, ".gitignore")); err == nil {
+				rules = append(rules, parseIgnore(name, string(data))...)
+			}
+			return nil
+		}
+		if !s.tracksFile(name, rules) {
+			return nil
+		}
+		if len(files) >= s.watch.maxFiles() {
+			truncated = true
+			return filepath.SkipAll
+		}
+		if info, err := d.Info(); err == nil {
+			files[name] = fileStat{size: info.Size(), mtime: info.ModTime()}
+		}
+		return nil
+	})
+
+	if dir == "" {
+		s.mu.Lock()
+		s.truncated = truncated
+		s.mu.Unlock()
+	}
+	return files
+}
+
+// snapshot records the state of the tree before a step runs. In notify
+// mode, the copy of the index is kept, so the tree after the step only
+// needs the paths the watcher saw change added to it.
+func (s *fileScanner) snapshot() *worktreeSnapshot {
+	snap := &worktreeSnapshot{dir: s.root, scanner: s}
+	if index, err := newGitIndex(s.root, s.gitExcludes()); err == nil {
+		if s.watcher != nil {
+			snap.log = s.watcher.record()
+		}
+		if err := index.addAll(); err == nil {
+			snap.tree, _ = index.writeTree()
+		}
+		snap.index = index
+		if snap.tree != "" && s.watcher != nil {
+			snap.files = s.state() // for live changes
+			return snap
+		}
+		snap.close()
+		if snap.tree != "" {
+			return snap
+		}
+	}
+	snap.files = s.state()
+	s.baseline(snap.files)
+	return snap
+}
+
+// gitTree writes the worktree as a tree object, leaving out what the
+// .octosignore and the watch block exclude
+func (s *fileScanner) gitTree() (string, error) {
+	index, err := newGitIndex(s.root, s.gitExcludes())
+	if err != nil {
+		return "", err
+	}
+	defer index.remove()
+	if err := index.addAll(); err != nil {
+		return "", err
+	}
+	return index.writeTree()
+}
+
+// gitExcludes returns the rules of the .octosignore and watch.exclude as
+// gitignore lines, so git never hashes the files they leave out
+func (s *fileScanner) gitExcludes() []string {
+	var lines []string
+	for _, rule := range readIgnore(s.root, ".octosignore") {
+		line := rule.pattern
+		if rule.dirOnly {
+			line += "/"
+		}
+		if rule.negate {
+			line = "!" + line
+		}
+		lines = append(lines, line)
+	}
+	return append(lines, s.watch.Exclude...)
+}
+
+// state returns the tracked files as they are now: from the index kept by
+// the watcher in notify mode, or from a scan
+func (s *fileScanner) state() map[string]fileStat {
+	if s.watcher != nil {
+		if files, ok := s.watcher.index(); ok {
+			return files
+		}
+	}
+	return s.scan("")
+}
+
+// diff returns the changes between two states, sorted by path, as "+ path",
+// "M path" or "- path". A file whose size is the same but whose
+// modification time is not is hashed, and only reported when its content
+// differs from the one last hashed.
+func (s *fileScanner) diff(before, after map[string]fileStat) []string {
+	var changes []string
+	for name, a := range after {
+		b, ok := before[name]
+		switch {
+		case !ok:
+			changes = append(changes, "+ "+name)
+		case a.size != b.size:
+			changes = append(changes, "M "+name)
+		case !a.mtime.Equal(b.mtime) && s.contentChanged(name, b, a):
+			changes = append(changes, "M "+name)
+		}
+	}
+
+	s.mu.Lock()
+	truncated := s.truncated
+	s.mu.Unlock()
+	// Past max_files, a file missing from a scan may still be there
+	if !truncated {
+		for name := range before {
+			if _, ok := after[name]; !ok {
+				changes = append(changes, "- "+name)
+			}
+		}
+	}
+
+	sort.Slice(changes, func(a, b int) bool { return changes[a][2:] < changes[b][2:] })
+	return changes
+}
+
+// baseline hashes the files of a state taken before a step whose content is
+// not known yet, so that diff can tell files the step only touched from
+// modified ones
+func (s *fileScanner) baseline(files map[string]fileStat) {
+	for name, stat := range files {
+		if stat.size > maxBaselineSize {
+			continue
+		}
+		s.mu.Lock()
+		known, ok := s.hashes[name]
+		s.mu.Unlock()
+		if ok && known.size == stat.size && known.mtime.Equal(stat.mtime) {
+			continue
+		}
+
+		file := filepath.Join(s.root, filepath.FromSlash(name))
+		hash, err := hashFile(file)
+		if err != nil {
+			continue
+		}
+		// A file written while it was hashed has no known content
+		if info, err := os.Stat(file); err != nil || info.Size() != stat.size || !info.ModTime().Equal(stat.mtime) {
+			continue
+		}
+		stat.hash = hash
+		s.mu.Lock()
+		s.hashes[name] = stat
+		s.mu.Unlock()
+	}
+}
+
+// contentChanged hashes the file name, now as after, and compares it with
+// the hash of its content as before, when that is known
+func (s *fileScanner) contentChanged(name string, before, after fileStat) bool {
+	hash, err := hashFile(filepath.Join(s.root, filepath.FromSlash(name)))
+	if err != nil {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	known, ok := s.hashes[name]
+	after.hash = hash
+	s.hashes[name] = after
+	return !ok || known.size != before.size || !known.mtime.Equal(before.mtime) || known.hash != hash
+}
+
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// live reports the changes since before to onChange while the files
+// change, until the returned function is called. It does nothing unless
+// the scanner is watching.
+func (s *fileScanner) live(before map[string]fileStat, onChange func(changes []string)) (stop func()) {
+	if s.watcher == nil || before == nil {
+		return func() {}
+	}
+	events := s.watcher.subscribe()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+		var last []string
+		for {
+			select {
+			case <-done:
+				return
+			case <-events:
+			}
+			// Let a burst of writes settle
+			select {
+			case <-done:
+				return
+			case <-time.After(200 * time.Millisecond):
+			}
+			if changes := s.diff(before, s.state()); !slices.Equal(changes, last) {
+				onChange(changes)
+				last = changes
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+		s.watcher.unsubscribe(events)
+	}
+}
+
+// startWatching keeps an index of the tracked files up to date from file
+// system events, instead of scanning around every step
+func (s *fileScanner) startWatching() error {
+	w, err := newFileWatcher(s)
+	if err != nil {
+		return err
+	}
+	s.watcher = w
+	return nil
+}
+
+// close stops watching the tree
+func (s *fileScanner) close() {
+	if s.watcher != nil {
+		s.watcher.close()
+		s.watcher = nil
+	}
+}
+
+// fileWatcher holds the index of the tracked files that a platform
+// notifier keeps up to date
+type fileWatcher struct {
+	scanner  *fileScanner
+	notifier notifier
+
+	mu       sync.Mutex
+	files    map[string]fileStat
+	dirty    map[string]bool // paths changed since the index was last refreshed
+	overflow bool            // events were lost, the next refresh scans the tree
+	subs     map[chan struct{}]bool
+	logs     map[*changeLog]bool
+}
+
+// notifier turns file system events into changes of a fileWatcher
+type notifier interface {
+	io.Closer
+	// sync returns once the events of every change made before it was
+	// called are delivered
+	sync() error
+}
+
+// changeLog collects the paths events were reported on while a step runs
+type changeLog struct {
+	paths    map[string]bool
+	overflow bool // events were lost
+}
+
+// changed records an event on the slash-separated path name
+func (w *fileWatcher) changed(name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.dirty == nil {
+		w.dirty = make(map[string]bool)
+	}
+	w.dirty[name] = true
+	for log := range w.logs {
+		log.paths[name] = true
+	}
+	w.notify()
+}
+
+// lost records that events were dropped
+func (w *fileWatcher) lost() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.overflow = true
+	for log := range w.logs {
+		log.overflow = true
+	}
+	w.notify()
+}
+
+// record starts collecting the paths changes are reported on
+func (w *fileWatcher) record() *changeLog {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	log := &changeLog{paths: make(map[string]bool)}
+	if w.logs == nil {
+		w.logs = make(map[*changeLog]bool)
+	}
+	w.logs[log] = true
+	return log
+}
+
+// since returns the paths changes were reported on since log started,
+// sorted, once the pending events are delivered. It reports false if some
+// may be missing.
+func (w *fileWatcher) since(log *changeLog) ([]string, bool) {
+	if w == nil || log == nil || w.notifier.sync() != nil {
+		return nil, false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Sorted(maps.Keys(log.paths)), !log.overflow
+}
+
+func (w *fileWatcher) forget(log *changeLog) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.logs, log)
+}
+
+// notify wakes up the subscribers. Callers must hold w.mu.
+func (w *fileWatcher) notify() {
+	for ch := range w.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *fileWatcher) subscribe() chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	if w.subs == nil {
+		w.subs = make(map[chan struct{}]bool)
+	}
+	w.subs[ch] = true
+	return ch
+}
+
+func (w *fileWatcher) unsubscribe(ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.subs, ch)
+}
+
+// index returns a copy of the index, refreshing the paths events were
+// reported on. It reports false if the index was never built.
+func (w *fileWatcher) index() (map[string]fileStat, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.files == nil {
+		return nil, false
+	}
+
+	if w.overflow {
+		w.files = w.scanner.scan("")
+		w.overflow = false
+		w.dirty = nil
+	}
+	for name := range w.dirty {
+		w.refresh(name)
+	}
+	w.dirty = nil
+	return maps.Clone(w.files), true
+}
+
+// refresh updates the index for the file or directory name. Callers must
+// hold w.mu.
+func (w *fileWatcher) refresh(name string) {
+	for file := range w.files {
+		if file == name || strings.HasPrefix(file, name+"/") {
+			delete(w.files, file)
+		}
+	}
+	info, err := os.Lstat(filepath.Join(w.scanner.root, filepath.FromSlash(name)))
+	switch {
+	case err != nil:
+	case info.IsDir():
+		for file, stat := range w.scanner.scan(name) {
+			if len(w.files) < w.scanner.watch.maxFiles() {
+				w.files[file] = stat
+			}
+		}
+	case w.scanner.tracks(name) && len(w.files) < w.scanner.watch.maxFiles():
+		w.files[name] = fileStat{size: info.Size(), mtime: info.ModTime()}
+	}
+}
+
+func (w *fileWatcher) close() {
+	w.notifier.Close()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIgnoredBy(t *testing.T) {
+	rules := append(parseIgnore("", "# build outputs\n*.log\n/dist\nbuild/\n!keep.log\ndocs/**/*.tmp\n"),
+		parseIgnore("web", "cache/\n/local.txt\n")...)
+
+	tests := []struct {
+		name  string
+		isDir bool
+		want  bool
+	}{
+		{"debug.log", false, true},
+		{"src/deep/debug.log", false, true},
+		{"keep.log", false, false},
+		{"dist", true, true},
+		{"src/dist", true, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"src/build", true, true},
+		{"docs/a/b/x.tmp", false, true},
+		{"x.tmp", false, false},
+		{"web/cache", true, true},
+		{"web/src/cache", true, true},
+		{"cache", true, false},
+		{"web/local.txt", false, true},
+		{"web/src/local.txt", false, false},
+		{"main.go", false, false},
+	}
+
+	for _, tt := range tests {
+		if got := ignoredBy(rules, tt.name, tt.isDir); got != tt.want {
+			t.Errorf("ignoredBy(%q, dir=%v) = %v, want %v", tt.name, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestWatchConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		watch   WatchConfig
+		wantErr string
+	}{
+		{"valid", WatchConfig{Include: StringList{"src/**"}, Exclude: StringList{"vendor/**"}, Mode: WatchNotify, MaxFiles: 10}, ""},
+		{"include outside", WatchConfig{Include: StringList{"../x"}}, "watch.include: ../x"},
+		{"bad exclude", WatchConfig{Exclude: StringList{"[a"}}, "watch.exclude: [a"},
+		{"unknown mode", WatchConfig{Mode: "poll"}, "watch.mode must be scan or notify"},
+		{"negative max_files", WatchConfig{MaxFiles: -1}, "watch.max_files must be positive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.watch.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// writeTree creates files, relative to the current directory
+func writeTree(t *testing.T, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileScannerScan(t *testing.T) {
+	t.Chdir(t.TempDir())
+	writeTree(t, map[string]string{
+		".gitignore":            "target/\n*.log\n",
+		".octosignore":          "secret/\n",
+		"web/.gitignore":        "dist/\n",
+		"src/main.go":           "",
+		"src/debug.log":         "",
+		"target/out.bin":        "",
+		"secret/key":            "",
+		"vendor/lib/lib.go":     "",
+		"node_modules/x/i.js":   "",
+		".github/workflows/ci":  "",
+		".octos/state/s.json":   "",
+		"web/app.js":            "",
+		"web/dist/app.min.js":   "",
+		"web/src/dist/keep.txt": "", // dist/ only applies below web/
+		"docs/readme.md":        "",
+	})
+
+	tests := []struct {
+		name  string
+		watch WatchConfig
+		want  []string
+	}{
+		{
+			name: "ignore files",
+			want: []string{".github/workflows/ci", ".gitignore", ".octosignore", "docs/readme.md", "src/main.go",
+				"vendor/lib/lib.go", "web/.gitignore", "web/app.js"},
+		},
+		{
+			name:  "include and exclude",
+			watch: WatchConfig{Include: StringList{"**/*.go", "**/*.js"}, Exclude: StringList{"vendor/**"}},
+			want:  []string{"src/main.go", "web/app.js"},
+		},
+		{
+			name:  "max files",
+			watch: WatchConfig{MaxFiles: 2},
+			want:  []string{".github/workflows/ci", ".gitignore"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFileScanner(".", tt.watch)
+			var got []string
+			for name := range s.scan("") {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("scan = %q, want %q", got, tt.want)
+			}
+			if want := tt.watch.MaxFiles > 0; s.overLimit() != want {
+				t.Errorf("overLimit = %v, want %v", !want, want)
+			}
+		})
+	}
+
+	s := newFileScanner(".", WatchConfig{})
+	for name, want := range map[string]bool{"src/main.go": true, "target/x": false, "web/dist/x.js": false, "secret/x": false} {
+		if got := s.tracks(name); got != want {
+			t.Errorf("tracks(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestFileScannerDiff(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	t.Setenv("GIT_CEILING_DIRECTORIES", filepath.Dir(dir))
+	writeTree(t, map[string]string{"same.txt": "same", "grow.txt": "a", "gone.txt": "x", "big.bin": strings.Repeat("b", maxBaselineSize+1)})
+	s := newFileScanner(".", WatchConfig{})
+	touch := func(name string) {
+		later := time.Now().Add(time.Duration(len(name)) * time.Minute)
+		os.Chtimes(name, later, later)
+	}
+
+	// Files are hashed before the step, so touching one is not a change
+	snap := s.snapshot()
+	writeTree(t, map[string]string{"grow.txt": "ab", "new.txt": "n"})
+	touch("same.txt")
+	touch("big.bin")
+	os.Remove("gone.txt")
+
+	// Except for files too big to hash every time
+	want := []string{"M big.bin", "- gone.txt", "M grow.txt", "+ new.txt"}
+	if got := snap.changes(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("changes = %q, want %q", got, want)
+	}
+
+	// Once hashed, touching it again is not a change, editing it is
+	before := s.scan("")
+	os.Chtimes("big.bin", time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	if got := s.diff(before, s.scan("")); len(got) != 0 {
+		t.Errorf("diff after touching = %q, want no changes", got)
+	}
+	before = s.scan("")
+	writeTree(t, map[string]string{"same.txt": "SAME"})
+	os.Chtimes("same.txt", time.Now().Add(2*time.Hour), time.Now().Add(2*time.Hour))
+	if got := s.diff(before, s.scan("")); !reflect.DeepEqual(got, []string{"M same.txt"}) {
+		t.Errorf("diff after editing = %q, want M same.txt", got)
+	}
+}
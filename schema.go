@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// validateSchema checks value against a JSON Schema. It supports the subset
+// that is useful for agent answers: type, enum, const, properties, required,
+// additionalProperties, items, min/maxItems, min/maxLength, pattern,
+// minimum/maximum and anyOf. Errors name the failing path, e.g. $.verdict.
+func validateSchema(schema map[string]any, value any) error {
+	return validateSchemaAt("$", schema, value)
+}
+
+func validateSchemaAt(path string, schema map[string]any, value any) error {
+	if t, ok := schema["type"]; ok {
+		if err := checkSchemaType(path, t, value); err != nil {
+			return err
+		}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %s is not one of %s", path, jsonString(value), jsonString(enum))
+		}
+	}
+
+	if c, ok := schema["const"]; ok && !jsonEqual(c, value) {
+		return fmt.Errorf("%s: expected %s, got %s", path, jsonString(c), jsonString(value))
+	}
+
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if subSchema, ok := sub.(map[string]any); ok && validateSchemaAt(path, subSchema, value) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: does not match any schema in anyOf", path)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		return validateSchemaObject(path, schema, v)
+	case []any:
+		if n, ok := schemaNumber(schema["minItems"]); ok && float64(len(v)) < n {
+			return fmt.Errorf("%s: expected at least %v items, got %d", path, n, len(v))
+		}
+		if n, ok := schemaNumber(schema["maxItems"]); ok && float64(len(v)) > n {
+			return fmt.Errorf("%s: expected at most %v items, got %d", path, n, len(v))
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for k, item := range v {
+				if err := validateSchemaAt(fmt.Sprintf("%s[%d]", path, k), items, item); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := float64(len([]rune(v)))
+		if n, ok := schemaNumber(schema["minLength"]); ok && length < n {
+			return fmt.Errorf("%s: expected at least %v characters, got %v", path, n, length)
+		}
+		if n, ok := schemaNumber(schema["maxLength"]); ok && length > n {
+			return fmt.Errorf("%s: expected at most %v characters, got %v", path, n, length)
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("%s: invalid pattern %q: %w", path, pattern, err)
+			}
+			if !re.MatchString(v) {
+				return fmt.Errorf("%s: %q does not match %q", path, v, pattern)
+			}
+		}
+	case float64:
+		if n, ok := schemaNumber(schema["minimum"]); ok && v < n {
+			return fmt.Errorf("%s: %v is below minimum %v", path, v, n)
+		}
+		if n, ok := schemaNumber(schema["maximum"]); ok && v > n {
+			return fmt.Errorf("%s: %v is above maximum %v", path, v, n)
+		}
+	}
+
+	return nil
+}
+
+func validateSchemaObject(path string, schema map[string]any, obj map[string]any) error {
+	if required, ok := schema["required"].([]any); ok {
+		for _, r := range required {
+			name := fmt.Sprint(r)
+			if _, ok := obj[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+	}
+
+	props, _ := schema["properties"].(map[string]any)
+	for _, name := range sortedKeys(obj) {
+		sub, ok := props[name].(map[string]any)
+		if !ok {
+			if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+				return fmt.Errorf("%s: unexpected property %q", path, name)
+			}
+			continue
+		}
+		if err := validateSchemaAt(path+"."+name, sub, obj[name]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkSchemaType(path string, t any, value any) error {
+	var types []string
+	switch x := t.(type) {
+	case string:
+		types = []string{x}
+	case []any:
+		for _, e := range x {
+			types = append(types, fmt.Sprint(e))
+		}
+	}
+
+	actual := jsonType(value)
+	for _, want := range types {
+		if want == actual || (want == "number" && actual == "integer") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), actual)
+}
+
+func jsonType(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func schemaNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
+
+func jsonEqual(a, b any) bool {
+	return jsonString(a) == jsonString(b)
+}
+
+// jsonString renders v as compact JSON with sorted keys
+func jsonString(v any) string {
+	data, err := json.Marshal(normalizeJSON(v))
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// normalizeJSON converts YAML-decoded values (ints, map[string]any from
+// yaml.v3) into the shapes encoding/json produces, so schemas written in the
+// pipeline YAML compare equal to decoded agent output
+func normalizeJSON(v any) any {
+	switch x := v.(type) {
+	case int:
+		return float64(x)
+	case int64:
+		return float64(x)
+	case uint64:
+		return float64(x)
+	case map[string]any:
+		out := make(map[string]any, len(x))
+		for k, e := range x {
+			out[k] = normalizeJSON(e)
+		}
+		return out
+	case []any:
+		out := make([]any, len(x))
+		for k, e := range x {
+			out[k] = normalizeJSON(e)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+var fencedBlockRegex = regexp.MustCompile("(?s)```[a-zA-Z0-9_-]*[ \\t]*\\n(.*?)```")
+
+// parseJSONOutput decodes agent output as JSON. When the whole output is
+// not JSON, the first fenced code block that is valid JSON is used.
+func parseJSONOutput(output string) (any, error) {
+	var v any
+	err := json.Unmarshal([]byte(strings.TrimSpace(output)), &v)
+	if err == nil {
+		return v, nil
+	}
+
+	for _, m := range fencedBlockRegex.FindAllStringSubmatch(output, -1) {
+		if json.Unmarshal([]byte(strings.TrimSpace(m[1])), &v) == nil {
+			return v, nil
+		}
+	}
+
+	return nil, fmt.Errorf("output is not valid JSON: %w", err)
+}
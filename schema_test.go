@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateSchema(t *testing.T) {
+	schema := map[string]any{
+		"type":     "object",
+		"required": []any{"verdict", "score"},
+		"properties": map[string]any{
+			"verdict": map[string]any{"type": "string", "enum": []any{"approve", "reject"}},
+			"score":   map[string]any{"type": "integer", "minimum": 0.0, "maximum": 10.0},
+			"notes":   map[string]any{"type": "array", "items": map[string]any{"type": "string", "minLength": 1.0}, "maxItems": 2.0},
+			"id":      map[string]any{"type": "string", "pattern": "^[A-Z]+-[0-9]+$"},
+		},
+		"additionalProperties": false,
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{"valid", `{"verdict": "approve", "score": 7}`, ""},
+		{"valid with optional fields", `{"verdict": "reject", "score": 0, "notes": ["too long"], "id": "ABC-12"}`, ""},
+		{"not an object", `["approve"]`, "$: expected object, got array"},
+		{"missing required", `{"verdict": "approve"}`, `missing required property "score"`},
+		{"wrong enum", `{"verdict": "maybe", "score": 1}`, `$.verdict: "maybe" is not one of`},
+		{"float for integer", `{"verdict": "approve", "score": 1.5}`, "$.score: expected integer, got number"},
+		{"above maximum", `{"verdict": "approve", "score": 11}`, "$.score: 11 is above maximum 10"},
+		{"empty item", `{"verdict": "approve", "score": 1, "notes": [""]}`, "$.notes[0]: expected at least 1 characters"},
+		{"too many items", `{"verdict": "approve", "score": 1, "notes": ["a", "b", "c"]}`, "$.notes: expected at most 2 items"},
+		{"pattern", `{"verdict": "approve", "score": 1, "id": "abc"}`, `$.id: "abc" does not match`},
+		{"additional property", `{"verdict": "approve", "score": 1, "extra": true}`, `unexpected property "extra"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value any
+			if err := json.Unmarshal([]byte(tt.value), &value); err != nil {
+				t.Fatal(err)
+			}
+			err := validateSchema(schema, value)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateSchema() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateSchema() = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateSchemaYAMLValues(t *testing.T) {
+	// Schemas decoded from pipeline YAML carry ints, not float64
+	schema := normalizeJSON(map[string]any{
+		"type":  []any{"integer", "null"},
+		"enum":  []any{1, 2, nil},
+		"const": 2,
+	}).(map[string]any)
+
+	if err := validateSchema(schema, 2.0); err != nil {
+		t.Errorf("validateSchema(2) = %v, want nil", err)
+	}
+	if err := validateSchema(schema, 1.0); err == nil {
+		t.Error("validateSchema(1) = nil, want const error")
+	}
+}
+
+func TestParseJSONOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    string
+		wantErr bool
+	}{
+		{"plain", ` {"ok": true} `, `{"ok":true}`, false},
+		{"fenced", "Here you go:\n```json\n{\"ok\": true}\n```\nDone.", `{"ok":true}`, false},
+		{"second fence is json", "```sh\nls\n```\n```\n[1, 2]\n```", `[1,2]`, false},
+		{"not json", "looks good to me", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseJSONOutput(tt.output)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseJSONOutput() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && jsonString(got) != tt.want {
+				t.Errorf("parseJSONOutput() = %s, want %s", jsonString(got), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ErrPipelineChanged is returned when resuming a checkpoint whose completed
+// steps were edited since they ran
+var ErrPipelineChanged = errors.New("pipeline changed")
+
+// stepFingerprint identifies what step i does: its name, its prompt or
+// command, the agent that runs it, its condition and what it depends on. A
+// step whose fingerprint changed would produce a different output, or be
+// skipped differently, if it ran again.
+func (p *Pipeline) stepFingerprint(i int) string {
+	step := p.Steps[i]
+	parts := []string{step.Name, step.Prompt, step.Run}
+	if step.Run == "" {
+		agent := p.stepAgent(step)
+		parts = append(parts, agent.Type, agent.Cmd, strings.Join(agent.Args, "\x00"), agent.PromptMode, agent.Model)
+	}
+	// Left out when unset, so older checkpoints of such steps still match
+	if step.When != "" {
+		parts = append(parts, "when", step.When)
+	}
+	if step.DependsOn != nil {
+		parts = append(parts, "depends_on", strings.Join(slices.Sorted(slices.Values(step.DependsOn)), ","))
+	}
+	return contentHash(strings.Join(parts, "\x00"))
+}
+
+// fingerprint identifies the whole pipeline: its steps and global context
+func (p *Pipeline) fingerprint() string {
+	var parts []string
+	for i := range p.Steps {
+		parts = append(parts, p.stepFingerprint(i))
+	}
+	for _, k := range sortedKeys(p.Context) {
+		parts = append(parts, fmt.Sprintf("%s=%v", k, p.Context[k]))
+	}
+	return contentHash(strings.Join(parts, "\x00"))
+}
+
+// staleSteps returns the completed steps of s that were edited since they
+// ran, in pipeline order, and the ones no longer in p
+func (s *PipelineState) staleSteps(p *Pipeline) (changed, removed []string) {
+	for i, step := range p.Steps {
+		cp := s.Steps[step.Name]
+		// Checkpoints written before fingerprints were stored are trusted
+		if cp != nil && cp.Status == CheckpointCompleted && cp.Fingerprint != "" && cp.Fingerprint != p.stepFingerprint(i) {
+			changed = append(changed, step.Name)
+		}
+	}
+	for _, name := range sortedKeys(s.Steps) {
+		if s.Steps[name].Status == CheckpointCompleted && p.StepIndex(name) < 0 {
+			removed = append(removed, name)
+		}
+	}
+	return changed, removed
+}
+
+// staleSkips returns the skipped steps of s to evaluate again on resume,
+// in pipeline order: those edited since they were skipped, and those
+// depending on a step that runs again
+func (s *PipelineState) staleSkips(p *Pipeline, g *stepGraph) []string {
+	pending := make(map[int]bool)
+	for i, step := range p.Steps {
+		pending[i] = !s.IsFinished(step.Name)
+	}
+
+	for again := true; again; {
+		again = false
+		for i, step := range p.Steps {
+			cp := s.Steps[step.Name]
+			if pending[i] || cp == nil || cp.Status != CheckpointSkipped {
+				continue
+			}
+			edited := cp.Fingerprint != "" && cp.Fingerprint != p.stepFingerprint(i)
+			upstream := false
+			for j := range g.ancestors(i) {
+				upstream = upstream || pending[j]
+			}
+			if edited || upstream {
+				pending[i] = true
+				again = true
+			}
+		}
+	}
+
+	var stale []string
+	for i, step := range p.Steps {
+		if pending[i] && s.IsFinished(step.Name) {
+			stale = append(stale, step.Name)
+		}
+	}
+	return stale
+}
+
+// checkResume refuses to resume s when completed steps were edited, and
+// warns about other edits since the checkpoint
+func (s *PipelineState) checkResume(p *Pipeline, silent bool) error {
+	changed, removed := s.staleSteps(p)
+	if len(changed) > 0 {
+		return fmt.Errorf("%w: completed step %s was edited since it ran; re-run it with --from %s or start over with --clean",
+			ErrPipelineChanged, strings.Join(changed, ", "), changed[0])
+	}
+	if silent {
+		return nil
+	}
+	for _, name := range removed {
+		fmt.Printf("⚠ Warning: completed step %s is no longer in the pipeline\n", name)
+	}
+	if len(removed) == 0 && s.PipelineHash != "" && s.PipelineHash != p.fingerprint() {
+		fmt.Println("⚠ Warning: the pipeline changed since the checkpoint, but its completed steps did not")
+	}
+	return nil
+}
+
+// StepSelection picks the steps a run executes, from --from, --until and
+// --only. The other steps are not run; their saved outputs are used instead.
+type StepSelection struct {
+	From  string
+	Until string
+	Only  []string
+}
+
+func (s StepSelection) IsZero() bool {
+	return s.From == "" && s.Until == "" && len(s.Only) == 0
+}
+
+func (s StepSelection) validate(p *Pipeline) error {
+	if len(s.Only) > 0 && (s.From != "" || s.Until != "") {
+		return errors.New("--only cannot be combined with --from or --until")
+	}
+	for _, name := range append([]string{s.From, s.Until}, s.Only...) {
+		if name != "" && p.StepIndex(name) < 0 {
+			return fmt.Errorf("unknown step %s", name)
+		}
+	}
+	if s.From != "" && s.Until != "" && p.StepIndex(s.From) > p.StepIndex(s.Until) {
+		return fmt.Errorf("step %s comes after step %s", s.From, s.Until)
+	}
+	return nil
+}
+
+// includes reports whether step i of p is selected
+func (s StepSelection) includes(p *Pipeline, i int) bool {
+	if len(s.Only) > 0 {
+		return slices.Contains(s.Only, p.Steps[i].Name)
+	}
+	if s.From != "" && i < p.StepIndex(s.From) {
+		return false
+	}
+	if s.Until != "" && i > p.StepIndex(s.Until) {
+		return false
+	}
+	return true
+}
+
+// loadSavedOutputs returns the outputs saved for the steps of p: the
+// checkpoint when there is one, completed by the newest run in the run
+// store where each remaining step completed or was skipped
+func loadSavedOutputs(p *Pipeline) *PipelineState {
+	state, err := LoadState(p.File)
+	if err != nil {
+		state = &PipelineState{PipelineFile: p.File}
+	}
+	state.upgrade(p)
+	if state.Outputs == nil {
+		state.Outputs = make(map[string]string)
+	}
+	if state.Artifacts == nil {
+		state.Artifacts = make(map[string]string)
+	}
+
+	runs, _ := ListRuns()
+	for _, run := range runs {
+		if run.Pipeline != p.File {
+			continue
+		}
+		for _, s := range run.Steps {
+			i := p.StepIndex(s.Name)
+			if i < 0 || state.IsFinished(s.Name) {
+				continue
+			}
+			if s.Status == CheckpointSkipped {
+				state.Steps[s.Name] = &StepCheckpoint{Status: CheckpointSkipped, FinishedAt: s.FinishedAt, Fingerprint: s.Fingerprint}
+				continue
+			}
+			if s.Status != CheckpointCompleted {
+				continue
+			}
+			output, err := ReadRunStepFile(run, s, "output.txt")
+			if err != nil {
+				continue
+			}
+			values, _ := p.Steps[i].extractOutputs(output)
+			state.Steps[s.Name] = &StepCheckpoint{
+				Status:      CheckpointCompleted,
+				Duration:    s.Duration,
+				FinishedAt:  s.FinishedAt,
+				ExitCode:    s.ExitCode,
+				Outputs:     values,
+				Fingerprint: s.Fingerprint,
+				Artifact:    s.Artifact,
+			}
+			state.Outputs[s.Name] = output
+		}
+	}
+	return state
+}
+
+// selectSteps prepares r to run only the steps of sel. Every other step
+// counts as finished, and steps feeding the selection get their saved
+// outputs back.
+func (r *pipelineRun) selectSteps(sel StepSelection, finished []bool) error {
+	if err := sel.validate(r.p); err != nil {
+		return err
+	}
+
+	state := loadSavedOutputs(r.p)
+	state.RunID = ""
+	state.Usage = Usage{}
+	state.StartTime = r.state.StartTime
+
+	needed := make(map[int]bool)
+	count := 0
+	for i, step := range r.p.Steps {
+		if sel.includes(r.p, i) {
+			delete(state.Steps, step.Name)
+			delete(state.Outputs, step.Name)
+			for j := range r.graph.ancestors(i) {
+				needed[j] = true
+			}
+			count++
+			continue
+		}
+		finished[i] = true
+	}
+
+	if !r.silent {
+		for i, step := range r.p.Steps {
+			if !needed[i] || sel.includes(r.p, i) {
+				continue
+			}
+			cp := state.Steps[step.Name]
+			switch {
+			case !state.IsFinished(step.Name):
+				fmt.Printf("⚠ Warning: step %s has no saved output\n", step.Name)
+			case cp.Fingerprint != "" && cp.Fingerprint != r.p.stepFingerprint(i):
+				fmt.Printf("⚠ Warning: step %s was edited since its output was saved\n", step.Name)
+			}
+		}
+		fmt.Printf("→ Running %d/%d steps with the saved outputs of the others\n", count, len(r.p.Steps))
+	}
+
+	r.state = state
+	r.ctx.Outputs = state.Outputs
+	r.artifacts = state.Artifacts
+	return nil
+}
+
+// allCompleted reports whether every step of the run completed or was
+// skipped
+func (r *pipelineRun) allCompleted() bool {
+	for _, step := range r.p.Steps {
+		if !r.state.IsFinished(step.Name) {
+			return false
+		}
+	}
+	return true
+}
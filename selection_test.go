@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStepSelection(t *testing.T) {
+	p := &Pipeline{Steps: []Step{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}}
+
+	tests := []struct {
+		name    string
+		sel     StepSelection
+		want    []string
+		wantErr string
+	}{
+		{"from", StepSelection{From: "b"}, []string{"b", "c", "d"}, ""},
+		{"until", StepSelection{Until: "b"}, []string{"a", "b"}, ""},
+		{"from until", StepSelection{From: "b", Until: "c"}, []string{"b", "c"}, ""},
+		{"only", StepSelection{Only: []string{"d", "a"}}, []string{"a", "d"}, ""},
+		{"unknown step", StepSelection{From: "x"}, nil, "unknown step x"},
+		{"reversed", StepSelection{From: "c", Until: "a"}, nil, "step c comes after step a"},
+		{"only with from", StepSelection{From: "a", Only: []string{"b"}}, nil, "--only cannot be combined"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.sel.validate(p)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for i, step := range p.Steps {
+				if tt.sel.includes(p, i) {
+					got = append(got, step.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selected %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStepFingerprint(t *testing.T) {
+	base := func() *Pipeline {
+		return &Pipeline{
+			Agent: AgentConfig{Cmd: "claude", Args: []string{"-p"}},
+			Steps: []Step{{Name: "plan", Prompt: "Plan"}, {Name: "test", Run: "go test"}},
+		}
+	}
+	want := base()
+
+	tests := []struct {
+		name    string
+		edit    func(p *Pipeline)
+		step    int
+		changed bool
+	}{
+		{"unchanged", func(p *Pipeline) {}, 0, false},
+		{"prompt", func(p *Pipeline) { p.Steps[0].Prompt = "Plan it" }, 0, true},
+		{"agent args", func(p *Pipeline) { p.Agent.Args = []string{"-p", "--verbose"} }, 0, true},
+		{"step agent", func(p *Pipeline) { p.Steps[0].Agent = &AgentConfig{Cmd: "opencode"} }, 0, true},
+		{"model", func(p *Pipeline) { p.Agent.Model = "opus" }, 0, true},
+		{"run command", func(p *Pipeline) { p.Steps[1].Run = "go test ./..." }, 1, true},
+		{"agent of a run step", func(p *Pipeline) { p.Agent.Cmd = "opencode" }, 1, false},
+		{"condition", func(p *Pipeline) { p.Steps[0].When = "true" }, 0, true},
+		{"depends_on", func(p *Pipeline) { p.Steps[1].DependsOn = []string{} }, 1, true},
+		{"depends_on order", func(p *Pipeline) { p.Steps[1].DependsOn = []string{"plan", "lint"} }, 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := base()
+			tt.edit(p)
+			if changed := p.stepFingerprint(tt.step) != want.stepFingerprint(tt.step); changed != tt.changed {
+				t.Errorf("fingerprint changed = %v, want %v", changed, tt.changed)
+			}
+		})
+	}
+}
+
+func TestCheckResume(t *testing.T) {
+	p := &Pipeline{Steps: []Step{{Name: "a", Prompt: "A"}, {Name: "b", Prompt: "B"}, {Name: "c", Prompt: "C"}}}
+	completed := func(i int) *StepCheckpoint {
+		return &StepCheckpoint{Status: CheckpointCompleted, Fingerprint: p.stepFingerprint(i)}
+	}
+
+	tests := []struct {
+		name    string
+		steps   map[string]*StepCheckpoint
+		wantErr string
+	}{
+		{"unchanged", map[string]*StepCheckpoint{"a": completed(0), "b": completed(1)}, ""},
+		{"legacy checkpoint", map[string]*StepCheckpoint{"a": {Status: CheckpointCompleted}}, ""},
+		{"failed step edited", map[string]*StepCheckpoint{"a": completed(0), "b": {Status: CheckpointFailed, Fingerprint: "old"}}, ""},
+		{"removed step", map[string]*StepCheckpoint{"a": completed(0), "gone": {Status: CheckpointCompleted, Fingerprint: "x"}}, ""},
+		{
+			"completed steps edited",
+			map[string]*StepCheckpoint{"a": completed(0), "b": {Status: CheckpointCompleted, Fingerprint: "old"}, "c": {Status: CheckpointCompleted, Fingerprint: "old"}},
+			"completed step b, c was edited since it ran; re-run it with --from b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &PipelineState{Steps: tt.steps}
+			err := s.checkResume(p, true)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrPipelineChanged) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunSelection(t *testing.T) {
+	t.Chdir(t.TempDir())
+	p := &Pipeline{
+		File: "p.yaml",
+		Steps: []Step{
+			{Name: "plan", Run: "echo plan-1"},
+			{Name: "build", Run: "echo built {{plan.output}}"},
+			{Name: "check", Run: "echo checked"},
+		},
+	}
+	run := func(sel StepSelection) []string {
+		var ran []string
+		cb := Callbacks{OnStart: func(i int, _ string) { ran = append(ran, p.Steps[i].Name) }}
+		if err := RunPipelineWithCallbacks(context.Background(), p, cb, RunOptions{Iteration: 1, Select: sel}); err != nil {
+			t.Fatal(err)
+		}
+		return ran
+	}
+
+	if ran := run(StepSelection{}); len(ran) != 3 {
+		t.Fatalf("full run ran %q", ran)
+	}
+	if StateExists(p.File) {
+		t.Fatal("a completed run left its state behind")
+	}
+
+	// The state was cleared, so the output of plan comes from the run store
+	p.Steps[0].Run = "echo plan-2"
+	var prompts []string
+	cb := Callbacks{
+		OnStart: func(i int, prompt string) { prompts = append(prompts, prompt) },
+	}
+	if err := RunPipelineWithCallbacks(context.Background(), p, cb, RunOptions{Iteration: 1, Select: StepSelection{Only: []string{"build"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"echo built plan-1\n"}; !reflect.DeepEqual(prompts, want) {
+		t.Errorf("prompts = %q, want %q", prompts, want)
+	}
+
+	if ran := run(StepSelection{From: "build", Until: "build"}); !reflect.DeepEqual(ran, []string{"build"}) {
+		t.Errorf("--from build --until build ran %q", ran)
+	}
+	if ran := run(StepSelection{From: "check"}); !reflect.DeepEqual(ran, []string{"check"}) {
+		t.Errorf("--from check ran %q", ran)
+	}
+	if StateExists(p.File) {
+		t.Error("the state was kept once every step completed")
+	}
+
+	// A new step has no output yet, so a run of the others keeps the state
+	// for --resume
+	p.Steps = append(p.Steps, Step{Name: "deploy", Run: "echo deployed"})
+	run(StepSelection{Only: []string{"check"}})
+	if !StateExists(p.File) {
+		t.Error("a partial run cleared the state")
+	}
+}
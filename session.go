@@ -0,0 +1,124 @@
+package main
+
+import "fmt"
+
+// Session modes. Any other value names a session shared by every step
+// that uses the name.
+const (
+	SessionNew      = "new"      // start a new conversation (default)
+	SessionContinue = "continue" // continue the conversation of the nearest earlier step
+)
+
+// sessionAgentTypes are the adapters that report a session id and can be
+// handed one back
+var sessionAgentTypes = map[string]bool{
+	"claude":   true,
+	"opencode": true,
+}
+
+// agentType returns the adapter name of cfg
+func agentType(cfg AgentConfig) string {
+	if cfg.Type == "" {
+		return "exec"
+	}
+	return cfg.Type
+}
+
+// stepAgent returns the agent that runs step: its own or the pipeline's
+func (p *Pipeline) stepAgent(step Step) AgentConfig {
+	if step.Agent != nil {
+		return *step.Agent
+	}
+	return p.Agent
+}
+
+// stepSession returns the session mode of step, falling back to the
+// pipeline default. Run steps always get SessionNew.
+func (p *Pipeline) stepSession(step Step) string {
+	switch {
+	case step.Run != "":
+		return SessionNew
+	case step.Session != "":
+		return step.Session
+	case p.Session != "":
+		return p.Session
+	default:
+		return SessionNew
+	}
+}
+
+// validateSession checks that step i can continue a conversation, and that
+// a named session is never used by two steps that may run at the same time
+func (p *Pipeline) validateSession(graph *stepGraph, i int) error {
+	step := p.Steps[i]
+	mode := p.stepSession(step)
+	if mode == SessionNew {
+		return nil
+	}
+
+	typ := agentType(p.stepAgent(step))
+	if !sessionAgentTypes[typ] {
+		return fmt.Errorf("agent type %s cannot continue sessions (use claude or opencode)", typ)
+	}
+	if mode == SessionContinue {
+		return nil
+	}
+
+	ancestors := graph.ancestors(i)
+	for j := 0; j < i; j++ {
+		other := p.Steps[j]
+		if p.stepSession(other) != mode {
+			continue
+		}
+		if !ancestors[j] && !graph.ancestors(j)[i] {
+			return fmt.Errorf("session %s is shared with step %s, which may run at the same time (add depends_on)", mode, other.Name)
+		}
+		if agentType(p.stepAgent(other)) != typ {
+			return fmt.Errorf("session %s is shared with step %s, which uses a different agent type", mode, other.Name)
+		}
+	}
+	return nil
+}
+
+// sessionFor returns the id of the conversation step i continues, or ""
+// when it starts a new one. Called with mu held.
+func (r *pipelineRun) sessionFor(i int) string {
+	step := r.p.Steps[i]
+	switch mode := r.p.stepSession(step); mode {
+	case SessionNew:
+		return ""
+	case SessionContinue:
+		// The nearest ancestor, in pipeline order, that recorded a session
+		// with the same kind of agent
+		typ := agentType(r.p.stepAgent(step))
+		ancestors := r.graph.ancestors(i)
+		for j := i - 1; j >= 0; j-- {
+			prev := r.p.Steps[j]
+			if !ancestors[j] || agentType(r.p.stepAgent(prev)) != typ {
+				continue
+			}
+			if cp := r.state.Steps[prev.Name]; cp != nil && cp.SessionID != "" {
+				return cp.SessionID
+			}
+		}
+		return ""
+	default:
+		return r.state.Sessions[mode]
+	}
+}
+
+// recordSession remembers the session id step i's agent reported, so later
+// steps sharing its named session continue it
+func (r *pipelineRun) recordSession(i int, id string) {
+	mode := r.p.stepSession(r.p.Steps[i])
+	if id == "" || mode == SessionNew || mode == SessionContinue {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state.Sessions == nil {
+		r.state.Sessions = make(map[string]string)
+	}
+	r.state.Sessions[mode] = id
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateSession(t *testing.T) {
+	claude := &AgentConfig{Type: "claude"}
+
+	tests := []struct {
+		name    string
+		session string // pipeline default
+		steps   []Step
+		wantErr string
+	}{
+		{
+			name:    "continue with claude",
+			session: SessionContinue,
+			steps:   []Step{{Name: "a", Prompt: "x", Agent: claude}, {Name: "b", Prompt: "y", Agent: claude}},
+		},
+		{
+			name:    "exec agent cannot continue",
+			steps:   []Step{{Name: "a", Prompt: "x", Session: SessionContinue}},
+			wantErr: "agent type exec cannot continue sessions",
+		},
+		{
+			name:    "run steps and new sessions are ignored",
+			session: "review",
+			steps:   []Step{{Name: "a", Run: "ls"}, {Name: "b", Prompt: "x", Session: SessionNew}},
+		},
+		{
+			name:    "run step with session",
+			steps:   []Step{{Name: "a", Run: "ls", Session: "review"}},
+			wantErr: "session cannot be set on a run step",
+		},
+		{
+			name: "named session in order",
+			steps: []Step{
+				{Name: "a", Prompt: "x", Agent: claude, Session: "review"},
+				{Name: "b", Prompt: "y", Agent: claude},
+				{Name: "c", Prompt: "z", Agent: claude, Session: "review"},
+			},
+		},
+		{
+			name: "named session used in parallel",
+			steps: []Step{
+				{Name: "a", Prompt: "x", Agent: claude, Session: "review", DependsOn: []string{}},
+				{Name: "b", Prompt: "y", Agent: claude, Session: "review", DependsOn: []string{}},
+			},
+			wantErr: "shared with step a, which may run at the same time",
+		},
+		{
+			name: "named session across agent types",
+			steps: []Step{
+				{Name: "a", Prompt: "x", Agent: claude, Session: "review"},
+				{Name: "b", Prompt: "y", Agent: &AgentConfig{Type: "opencode"}, Session: "review"},
+			},
+			wantErr: "uses a different agent type",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Pipeline{Agent: AgentConfig{Cmd: "agent"}, Session: tt.session, Steps: tt.steps}
+			err := p.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSessionFor(t *testing.T) {
+	claude := &AgentConfig{Type: "claude"}
+	p := &Pipeline{
+		Agent: AgentConfig{Cmd: "agent"},
+		Steps: []Step{
+			{Name: "plan", Prompt: "x", Agent: claude},
+			{Name: "lint", Prompt: "x"},
+			{Name: "build", Prompt: "x", Agent: claude, Session: SessionContinue},
+			{Name: "fresh", Prompt: "x", Agent: claude},
+			{Name: "review", Prompt: "x", Agent: claude, Session: "review"},
+			{Name: "other", Prompt: "x", Agent: claude, Session: SessionContinue, DependsOn: []string{}},
+		},
+	}
+	graph, err := buildStepGraph(p.Steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &pipelineRun{p: p, graph: graph, state: &PipelineState{
+		Steps: map[string]*StepCheckpoint{
+			"plan": {Status: CheckpointCompleted, SessionID: "s-plan"},
+			"lint": {Status: CheckpointCompleted, SessionID: "s-lint"},
+		},
+		Sessions: map[string]string{"review": "s-review"},
+	}}
+
+	tests := []struct {
+		step string
+		want string
+	}{
+		{"build", "s-plan"}, // lint is the nearest ancestor but runs another agent type
+		{"fresh", ""},
+		{"review", "s-review"},
+		{"other", ""}, // no ancestors
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.step, func(t *testing.T) {
+			if got := r.sessionFor(p.StepIndex(tt.step)); got != tt.want {
+				t.Errorf("sessionFor(%s) = %q, want %q", tt.step, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContinueSession(t *testing.T) {
+	cfg := fakeAgent(t, "claude", "claude-stream.jsonl")
+	output, err := filepath.Abs(os.Getenv("FAKE_AGENT_OUTPUT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FAKE_AGENT_OUTPUT", output)
+	argsFile := filepath.Join(t.TempDir(), "args")
+	t.Setenv("FAKE_AGENT_ARGS", argsFile)
+	t.Chdir(t.TempDir())
+
+	p := &Pipeline{
+		File:    "session.yaml",
+		Agent:   cfg,
+		Session: SessionContinue,
+		Steps: []Step{
+			{Name: "plan", Prompt: "make a plan"},
+			{Name: "build", Prompt: "now build it"},
+		},
+	}
+	if err := RunPipelineWithCallbacks(context.Background(), p, Callbacks{OnStart: func(int, string) {}}, RunOptions{Iteration: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantArgs := "-p\n--output-format\nstream-json\n--verbose\n--resume\n4f1c2a9e-0b7d-4c55-9a51-2f1f0c6d8e21\nnow build it\n"
+	if string(args) != wantArgs {
+		t.Errorf("args of the continued step = %q, want %q", args, wantArgs)
+	}
+}
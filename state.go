@@ -2,24 +2,129 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"time"
 )
 
 type PipelineState struct {
-	PipelineFile      string            `json:"pipeline_file"`
-	LastCompletedStep int               `json:"last_completed_step"`
-	Outputs           map[string]string `json:"outputs"`
-	StartTime         string            `json:"start_time"`
-	LastUpdate        string            `json:"last_update"`
+	PipelineFile string                     `json:"pipeline_file"`
+	RunID        string                     `json:"run_id,omitempty"`
+	PipelineHash string                     `json:"pipeline_hash,omitempty"` // fingerprint of the pipeline that wrote the state
+	Steps        map[string]*StepCheckpoint `json:"steps"`
+	Outputs      map[string]string          `json:"outputs"`
+	Summaries    map[string]*OutputSummary  `json:"summaries,omitempty"` // cached by summarize
+	Artifacts    map[string]string          `json:"artifacts,omitempty"` // loaded by load_from, by name without extension
+	Usage        Usage                      `json:"usage"`               // tokens and cost of the run so far
+	Sessions     map[string]string          `json:"sessions,omitempty"`  // named session -> agent session id
+	StartTime    string                     `json:"start_time"`
+	LastUpdate   string                     `json:"last_update"`
+
+	// LastCompletedStep is only read from checkpoints written before steps
+	// were tracked by name; upgrade converts it into Steps
+	LastCompletedStep *int `json:"last_completed_step,omitempty"`
+}
+
+// Step checkpoint statuses
+const (
+	CheckpointCompleted = "completed"
+	CheckpointFailed    = "failed"
+	CheckpointTimedOut  = "timed_out"
+	CheckpointCancelled = "cancelled"
+	CheckpointRetrying  = "retrying"
+	CheckpointSkipped   = "skipped" // the step's when condition was not met
+)
+
+// StepCheckpoint records how a single step finished
+type StepCheckpoint struct {
+	Status      string            `json:"status"`
+	Duration    float64           `json:"duration_seconds"`
+	FinishedAt  string            `json:"finished_at"`
+	ExitCode    int               `json:"exit_code"`
+	Error       string            `json:"error,omitempty"`
+	Attempts    []AttemptRecord   `json:"attempts,omitempty"`
+	Outputs     map[string]string `json:"outputs,omitempty"` // values extracted by the step's outputs
+	Usage       *Usage            `json:"usage,omitempty"`   // summed over the attempts
+	SessionID   string            `json:"session_id,omitempty"`
+	Fingerprint string            `json:"fingerprint,omitempty"` // stepFingerprint when the step ran
+	Condition   *bool             `json:"condition,omitempty"`   // result of the step's when, if it has one
+	Artifact    string            `json:"artifact,omitempty"`    // save_to file the step wrote
+}
+
+// AttemptRecord records one run of a step's agent
+type AttemptRecord struct {
+	Attempt  int     `json:"attempt"`
+	ExitCode int     `json:"exit_code"`
+	Duration float64 `json:"duration_seconds"`
+	Error    string  `json:"error,omitempty"`
+	Usage    *Usage  `json:"usage,omitempty"`
+}
+
+// checkpointStatus maps a step error to the status stored in state
+func checkpointStatus(err error) string {
+	switch {
+	case err == nil:
+		return CheckpointCompleted
+	case errors.Is(err, ErrStepTimedOut):
+		return CheckpointTimedOut
+	case errors.Is(err, ErrCancelled):
+		return CheckpointCancelled
+	default:
+		return CheckpointFailed
+	}
+}
+
+// upgrade converts a legacy checkpoint, where steps 0..LastCompletedStep
+// had completed, into per-step checkpoints for pipeline p
+func (s *PipelineState) upgrade(p *Pipeline) {
+	if s.Steps == nil {
+		s.Steps = make(map[string]*StepCheckpoint)
+	}
+	if s.LastCompletedStep == nil {
+		return
+	}
+
+	for i := 0; i <= *s.LastCompletedStep && i < len(p.Steps); i++ {
+		if _, ok := s.Steps[p.Steps[i].Name]; !ok {
+			s.Steps[p.Steps[i].Name] = &StepCheckpoint{Status: CheckpointCompleted}
+		}
+	}
+	s.LastCompletedStep = nil
+}
+
+// IsCompleted reports whether the named step finished successfully
+func (s *PipelineState) IsCompleted(step string) bool {
+	cp, ok := s.Steps[step]
+	return ok && cp.Status == CheckpointCompleted
+}
+
+// IsFinished reports whether the named step completed or was skipped, so a
+// resumed run must not run it again
+func (s *PipelineState) IsFinished(step string) bool {
+	cp, ok := s.Steps[step]
+	return ok && (cp.Status == CheckpointCompleted || cp.Status == CheckpointSkipped)
 }
 
 func getStateDir() string {
 	return filepath.Join(".octos", "state")
 }
 
+// getStateFile returns where the state of pipelineFile is kept. It is
+// keyed by the absolute path, so pipelines with the same name in different
+// directories do not share state.
 func getStateFile(pipelineFile string) string {
+	abs, err := filepath.Abs(pipelineFile)
+	if err != nil {
+		abs = pipelineFile
+	}
+	return filepath.Join(getStateDir(), fmt.Sprintf("%s-%s.json", filepath.Base(pipelineFile), contentHash(abs)[:8]))
+}
+
+// legacyStateFile is where state was kept when it was keyed by the base
+// name of the pipeline. It is still read, and removed once state is saved.
+func legacyStateFile(pipelineFile string) string {
 	return filepath.Join(getStateDir(), filepath.Base(pipelineFile)+".json")
 }
 
@@ -36,11 +141,18 @@ func SaveState(state *PipelineState) error {
 		return err
 	}
 
-	return os.WriteFile(getStateFile(state.PipelineFile), data, 0644)
+	if err := writeFileAtomic(getStateFile(state.PipelineFile), data, 0644); err != nil {
+		return err
+	}
+	os.Remove(legacyStateFile(state.PipelineFile))
+	return nil
 }
 
 func LoadState(pipelineFile string) (*PipelineState, error) {
 	data, err := os.ReadFile(getStateFile(pipelineFile))
+	if errors.Is(err, os.ErrNotExist) {
+		data, err = os.ReadFile(legacyStateFile(pipelineFile))
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -54,14 +166,45 @@ func LoadState(pipelineFile string) (*PipelineState, error) {
 }
 
 func StateExists(pipelineFile string) bool {
-	_, err := os.Stat(getStateFile(pipelineFile))
-	return err == nil
+	for _, path := range []string{getStateFile(pipelineFile), legacyStateFile(pipelineFile)} {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
 }
 
 func ClearState(pipelineFile string) error {
-	stateFile := getStateFile(pipelineFile)
-	if _, err := os.Stat(stateFile); err == nil {
-		return os.Remove(stateFile)
+	for _, path := range []string{getStateFile(pipelineFile), legacyStateFile(pipelineFile)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
 	}
 	return nil
 }
+
+// writeFileAtomic replaces path with data through a temporary file in the
+// same directory, so an interrupted write never leaves a truncated file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
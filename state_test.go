@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStateFileKeyedByPath(t *testing.T) {
+	t.Chdir(t.TempDir())
+	a := filepath.Join("a", "pipeline.yaml")
+	b := filepath.Join("b", "pipeline.yaml")
+
+	if getStateFile(a) == getStateFile(b) {
+		t.Fatalf("pipelines in different directories share %s", getStateFile(a))
+	}
+	if abs, _ := filepath.Abs(a); getStateFile(abs) != getStateFile(a) {
+		t.Errorf("relative and absolute paths use different state files")
+	}
+
+	if err := SaveState(&PipelineState{PipelineFile: a, RunID: "run-a"}); err != nil {
+		t.Fatal(err)
+	}
+	if StateExists(b) {
+		t.Error("state of a is visible to b")
+	}
+	if state, err := LoadState(a); err != nil || state.RunID != "run-a" {
+		t.Errorf("LoadState(a) = %+v, %v", state, err)
+	}
+}
+
+func TestLegacyStateFile(t *testing.T) {
+	tests := []struct {
+		name string
+		do   func(t *testing.T)
+		want bool // legacy file still there
+	}{
+		{"load", func(t *testing.T) {
+			if state, err := LoadState("p.yaml"); err != nil || state.RunID != "legacy" {
+				t.Errorf("LoadState() = %+v, %v", state, err)
+			}
+		}, true},
+		{"save", func(t *testing.T) {
+			if err := SaveState(&PipelineState{PipelineFile: "p.yaml"}); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"clear", func(t *testing.T) {
+			if err := ClearState("p.yaml"); err != nil {
+				t.Fatal(err)
+			}
+			if StateExists("p.yaml") {
+				t.Error("state still exists")
+			}
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			os.MkdirAll(getStateDir(), 0755)
+			os.WriteFile(legacyStateFile("p.yaml"), []byte(`{"run_id": "legacy"}`), 0644)
+			if !StateExists("p.yaml") {
+				t.Fatal("legacy state is not found")
+			}
+
+			tt.do(t)
+			if _, err := os.Stat(legacyStateFile("p.yaml")); (err == nil) != tt.want {
+				t.Errorf("legacy file kept = %v, want %v", err == nil, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	os.WriteFile(path, []byte("old content that is longer"), 0600)
+
+	if err := writeFileAtomic(path, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Errorf("content = %q", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0644 {
+		t.Errorf("mode = %v", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, "missing", "x.json"), nil, 0644); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
+
+func TestResumeKeepsDecisions(t *testing.T) {
+	tests := []struct {
+		name        string
+		steps       []Step
+		between     func(p *Pipeline) // runs between the failed run and the resume
+		wantRan     []string
+		wantSkipped []string
+	}{
+		{
+			name: "skipped step stays skipped",
+			steps: []Step{
+				{Name: "check", Run: "cat flag.txt"},
+				{Name: "fix", Run: "echo fixing", When: `{{check.output}} contains "broken"`},
+				{Name: "gate", Run: "test -f ok"},
+			},
+			between: func(*Pipeline) { os.WriteFile("flag.txt", []byte("broken"), 0644) },
+			wantRan: []string{"gate"},
+		},
+		{
+			name: "edited condition is evaluated again",
+			steps: []Step{
+				{Name: "check", Run: "cat flag.txt"},
+				{Name: "fix", Run: "echo fixing", When: `{{check.output}} contains "broken"`},
+				{Name: "verify", Run: "echo verifying", When: `{{fix.status}} == "completed"`, DependsOn: []string{"fix"}},
+				{Name: "other", Run: "echo other", When: `{{check.status}} == "failed"`, DependsOn: []string{"check"}},
+				{Name: "gate", Run: "test -f ok", DependsOn: []string{"verify", "other"}},
+			},
+			// verify depends on fix, which runs again; other does not
+			between: func(p *Pipeline) { p.Steps[1].When = `{{check.output}} contains "fine"` },
+			wantRan: []string{"fix", "verify", "gate"},
+		},
+		{
+			name: "loaded artifacts are restored",
+			steps: []Step{
+				{Name: "load", Run: "true", LoadFrom: StringList{"mode.txt"}},
+				{Name: "gate", Run: "test -f ok"},
+				{Name: "deploy", Run: "echo deploying", When: `{{artifact.mode}} == "go"`},
+			},
+			between: func(*Pipeline) { os.WriteFile(filepath.Join(".octos", "artifacts", "mode.txt"), []byte("stop"), 0644) },
+			wantRan: []string{"gate", "deploy"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Chdir(t.TempDir())
+			os.MkdirAll(filepath.Join(".octos", "artifacts"), 0755)
+			os.WriteFile(filepath.Join(".octos", "artifacts", "mode.txt"), []byte("go"), 0644)
+			os.WriteFile("flag.txt", []byte("fine"), 0644)
+			p := &Pipeline{File: "p.yaml", Agent: AgentConfig{Cmd: "echo"}, Steps: tt.steps}
+
+			if err := RunPipelineWithCallbacks(context.Background(), p, Callbacks{}, RunOptions{Iteration: 1}); err == nil {
+				t.Fatal("expected the gate step to fail")
+			}
+			tt.between(p)
+			os.WriteFile("ok", nil, 0644)
+
+			var ran, skipped []string
+			cb := Callbacks{
+				OnStart: func(i int, _ string) { ran = append(ran, p.Steps[i].Name) },
+				OnSkip:  func(i int) { skipped = append(skipped, p.Steps[i].Name) },
+			}
+			if err := RunPipelineWithCallbacks(context.Background(), p, cb, RunOptions{Resume: true, Iteration: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ran, tt.wantRan) || !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("resume ran %q and skipped %q, want %q and %q", ran, skipped, tt.wantRan, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestSkippedCheckpoint(t *testing.T) {
+	t.Chdir(t.TempDir())
+	p := &Pipeline{
+		File:  "p.yaml",
+		Agent: AgentConfig{Cmd: "echo"},
+		Steps: []Step{
+			{Name: "a", Run: "echo a"},
+			{Name: "b", Run: "echo b", When: `{{a.output}} contains "zzz"`},
+			{Name: "c", Run: "exit 1", When: `{{b.status}} == "skipped"`},
+		},
+	}
+	RunPipelineWithCallbacks(context.Background(), p, Callbacks{}, RunOptions{Iteration: 1})
+
+	state, err := LoadState(p.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]string{}
+	for name, cp := range state.Steps {
+		statuses[name] = cp.Status
+	}
+	if want := map[string]string{"a": CheckpointCompleted, "b": CheckpointSkipped, "c": CheckpointFailed}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+	if cp := state.Steps["b"]; cp.Condition == nil || *cp.Condition {
+		t.Errorf("condition of b = %v, want false", cp.Condition)
+	}
+	if cp := state.Steps["a"]; cp.Condition != nil {
+		t.Errorf("a has no when, but a condition was recorded")
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/charmbracelet/lipgloss"
 )
 
@@ -72,6 +74,13 @@ var (
 	greenStyle = lipgloss.NewStyle().
 			Foreground(neonGreen)
 	
+	redStyle = lipgloss.NewStyle().
+			Foreground(neonRed)
+
+	violationStyle = lipgloss.NewStyle().
+			Foreground(neonRed).
+			Bold(true)
+	
 	magentaBoldStyle = lipgloss.NewStyle().
 			Foreground(neonMagenta).
 			Bold(true)
@@ -90,8 +99,12 @@ func GetStepStatusStyle(status StepStatus) lipgloss.Style {
 		return lipgloss.NewStyle().Foreground(neonYellow).Bold(true).Blink(true)
 	case StatusCompleted:
 		return lipgloss.NewStyle().Foreground(neonGreen).Bold(true)
-	case StatusFailed:
+	case StatusFailed, StatusTimedOut:
 		return lipgloss.NewStyle().Foreground(neonRed).Bold(true)
+	case StatusCancelled:
+		return lipgloss.NewStyle().Foreground(mutedGray).Bold(true)
+	case StatusSkipped:
+		return lipgloss.NewStyle().Foreground(mutedGray).Italic(true)
 	default:
 		return lipgloss.NewStyle()
 	}
@@ -108,6 +121,12 @@ func GetStepIcon(status StepStatus) string {
 		return "✓"
 	case StatusFailed:
 		return "✗"
+	case StatusTimedOut:
+		return "⏱"
+	case StatusCancelled:
+		return "⊘"
+	case StatusSkipped:
+		return "↷"
 	default:
 		return "?"
 	}
@@ -122,3 +141,35 @@ func PanelTitleStyle() lipgloss.Style {
 func DividerStyle() lipgloss.Style {
 	return lipgloss.NewStyle().Foreground(neonCyan).Faint(true)
 }
+
+// changeStyle returns the style of a line of the File Changes panel
+func changeStyle(change string) lipgloss.Style {
+	switch {
+	case isViolation(change):
+		return violationStyle
+	case strings.HasPrefix(change, "+ "):
+		return greenStyle
+	case strings.HasPrefix(change, "- "):
+		return redStyle
+	default:
+		return yellowStyle
+	}
+}
+
+// diffLineStyle returns the style of a line of a unified diff
+func diffLineStyle(line string) lipgloss.Style {
+	switch {
+	case strings.HasPrefix(line, "diff --git"):
+		return magentaBoldStyle
+	case strings.HasPrefix(line, "+++"), strings.HasPrefix(line, "---"), strings.HasPrefix(line, "index "):
+		return cyanFaintStyle
+	case strings.HasPrefix(line, "@@"):
+		return cyanStyle
+	case strings.HasPrefix(line, "+"):
+		return greenStyle
+	case strings.HasPrefix(line, "-"):
+		return redStyle
+	default:
+		return lipgloss.NewStyle()
+	}
+}
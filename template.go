@@ -0,0 +1,469 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Templates
+//
+// Prompts and run commands may contain {{ path | filter arg ... }}
+// placeholders. The path is dotted, with [n] for list items:
+//
+//	{{context.project.name}}  {{context.rules[0]}}  {{env.HOME}}
+//	{{artifact.plan}}  {{run.id}}  {{review.output}}  {{review.outputs.verdict}}
+//
+// Placeholders whose path does not look like one (e.g. Helm's {{ .Values }})
+// are left untouched. Unresolved references are left as literal text unless
+// the pipeline sets strict: true.
+//
+// In run commands, placeholders become references to environment variables
+// holding their values, so step outputs are never run as shell code.
+
+// templateNamespaces are the path roots that are not step names
+var templateNamespaces = map[string]bool{
+	"context":  true,
+	"env":      true,
+	"artifact": true,
+	"files":    true,
+	"run":      true,
+}
+
+// runMetaFields lists the {{run.*}} fields available to templates
+var runMetaFields = map[string]bool{
+	"id":        true,
+	"iteration": true,
+	"date":      true,
+	"time":      true,
+	"branch":    true,
+	"pipeline":  true,
+}
+
+var (
+	placeholderRegex  = regexp.MustCompile(`\{\{([^{}]*)\}\}`)
+	templatePathRegex = regexp.MustCompile(`^[^\s.\[\]|{}"'()]+(?:\.[^\s.\[\]|{}"'()]+|\[\d+\])*$`)
+)
+
+// tmplExpr is a parsed {{ path | filter ... }} placeholder
+type tmplExpr struct {
+	raw     string
+	path    []string
+	filters []tmplFilter
+}
+
+type tmplFilter struct {
+	name string
+	args []string
+}
+
+// tmplLookup resolves a template path, reporting whether it exists
+type tmplLookup func(path []string) (any, bool)
+
+type tmplFilterDef struct {
+	minArgs, maxArgs int
+	intArg           bool // the first argument must be a number
+	apply            func(v any, args []string) any
+}
+
+var templateFilters = map[string]tmplFilterDef{
+	"join":     {0, 1, false, filterJoin},
+	"indent":   {0, 1, true, filterIndent},
+	"truncate": {1, 1, true, filterTruncate},
+	"default":  {1, 1, false, nil}, // handled in evaluate, it also applies to unresolved paths
+	"upper":    {0, 0, false, func(v any, _ []string) any { return strings.ToUpper(renderValue(v)) }},
+	"lower":    {0, 0, false, func(v any, _ []string) any { return strings.ToLower(renderValue(v)) }},
+	"trim":     {0, 0, false, func(v any, _ []string) any { return strings.TrimSpace(renderValue(v)) }},
+	"json":     {0, 0, false, func(v any, _ []string) any { return jsonString(v) }},
+}
+
+// parseTemplates returns the placeholders in text that are template
+// expressions. Placeholders that do not start with a path are skipped; a
+// path followed by invalid filters is an error.
+func parseTemplates(text string) ([]*tmplExpr, error) {
+	var exprs []*tmplExpr
+	for _, m := range placeholderRegex.FindAllStringSubmatch(text, -1) {
+		expr, err := parseTemplateExpr(m[0], m[1])
+		if err != nil {
+			return nil, err
+		}
+		if expr != nil {
+			exprs = append(exprs, expr)
+		}
+	}
+	return exprs, nil
+}
+
+func parseTemplateExpr(raw, inner string) (*tmplExpr, error) {
+	parts, err := splitPipes(inner)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", raw, err)
+	}
+
+	pathText := strings.TrimSpace(parts[0])
+	if !templatePathRegex.MatchString(pathText) {
+		return nil, nil
+	}
+
+	expr := &tmplExpr{raw: raw, path: splitTemplatePath(pathText)}
+	for _, part := range parts[1:] {
+		words, err := splitFilterArgs(part)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", raw, err)
+		}
+		if len(words) == 0 {
+			return nil, fmt.Errorf("%s: empty filter", raw)
+		}
+		f := tmplFilter{name: words[0], args: words[1:]}
+		def, ok := templateFilters[f.name]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown filter %q (use %s)", raw, f.name, strings.Join(sortedKeys(templateFilters), ", "))
+		}
+		if len(f.args) < def.minArgs || len(f.args) > def.maxArgs {
+			return nil, fmt.Errorf("%s: filter %s takes %d to %d arguments, got %d", raw, f.name, def.minArgs, def.maxArgs, len(f.args))
+		}
+		if def.intArg && len(f.args) > 0 {
+			if n, err := strconv.Atoi(f.args[0]); err != nil || n < 0 {
+				return nil, fmt.Errorf("%s: filter %s needs a positive number, got %q", raw, f.name, f.args[0])
+			}
+		}
+		expr.filters = append(expr.filters, f)
+	}
+	return expr, nil
+}
+
+// splitTemplatePath turns a.b[0].c into [a b 0 c]
+func splitTemplatePath(text string) []string {
+	text = strings.ReplaceAll(text, "[", ".")
+	text = strings.ReplaceAll(text, "]", "")
+	return strings.Split(text, ".")
+}
+
+// splitPipes splits on | outside quoted strings
+func splitPipes(s string) ([]string, error) {
+	var parts []string
+	var quote rune
+	start := 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '|':
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated string")
+	}
+	return append(parts, s[start:]), nil
+}
+
+// splitFilterArgs splits a filter into words. Quoted words may contain
+// spaces and the escapes \n, \t, \\ and the quote character.
+func splitFilterArgs(s string) ([]string, error) {
+	var words []string
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case r == ' ' || r == '\t':
+			i++
+		case r == '"' || r == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(runes) && runes[j] != r; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+					switch runes[j] {
+					case 'n':
+						sb.WriteRune('\n')
+					case 't':
+						sb.WriteRune('\t')
+					default:
+						sb.WriteRune(runes[j])
+					}
+					continue
+				}
+				sb.WriteRune(runes[j])
+			}
+			if j >= len(runes) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			words = append(words, sb.String())
+			i = j + 1
+		default:
+			j := i
+			for j < len(runes) && runes[j] != ' ' && runes[j] != '\t' {
+				j++
+			}
+			words = append(words, string(runes[i:j]))
+			i = j
+		}
+	}
+	return words, nil
+}
+
+// hasDefault reports whether the expression falls back to a default value
+func (e *tmplExpr) hasDefault() bool {
+	for _, f := range e.filters {
+		if f.name == "default" {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluate resolves the path and applies the filters
+func (e *tmplExpr) evaluate(lookup tmplLookup) (string, bool) {
+	v, ok := lookup(e.path)
+	for _, f := range e.filters {
+		if f.name == "default" {
+			if !ok || renderValue(v) == "" {
+				v, ok = f.args[0], true
+			}
+			continue
+		}
+		if ok {
+			v = templateFilters[f.name].apply(v, f.args)
+		}
+	}
+	if !ok {
+		return "", false
+	}
+	return renderValue(v), true
+}
+
+// renderTemplate replaces every template placeholder in text. Unresolved
+// ones are returned in unresolved and left as-is, or reported as an error
+// when strict is set.
+func renderTemplate(text string, lookup tmplLookup, strict bool) (result string, unresolved []string, err error) {
+	return expandTemplate(text, lookup, strict, func(value string) string { return value })
+}
+
+// shellScript is a run command whose placeholders are passed to the shell
+// in environment variables, so values are never parsed as shell code
+type shellScript struct {
+	text string
+	env  []string // NAME=value for each placeholder
+}
+
+// renderShellTemplate renders a run command like renderTemplate, but
+// replaces each placeholder with a reference to an environment variable
+// holding its value
+func renderShellTemplate(text string, lookup tmplLookup, strict bool) (script shellScript, unresolved []string, err error) {
+	script.text, unresolved, err = expandTemplate(text, lookup, strict, func(value string) string {
+		name := fmt.Sprintf("OCTOS_VALUE_%d", len(script.env)+1)
+		script.env = append(script.env, name+"="+value)
+		if runtime.GOOS == "windows" {
+			return "%" + name + "%"
+		}
+		return "${" + name + "}"
+	})
+	return script, unresolved, err
+}
+
+// expandTemplate replaces every resolved placeholder in text with what
+// substitute returns for its value
+func expandTemplate(text string, lookup tmplLookup, strict bool, substitute func(value string) string) (result string, unresolved []string, err error) {
+	result = placeholderRegex.ReplaceAllStringFunc(text, func(raw string) string {
+		if err != nil {
+			return raw
+		}
+		expr, perr := parseTemplateExpr(raw, raw[2:len(raw)-2])
+		if perr != nil {
+			err = perr
+			return raw
+		}
+		if expr == nil {
+			return raw
+		}
+		value, ok := expr.evaluate(lookup)
+		if !ok {
+			if strict {
+				err = fmt.Errorf("unresolved template reference %s", raw)
+			}
+			unresolved = append(unresolved, raw)
+			return raw
+		}
+		return substitute(value)
+	})
+	return result, unresolved, err
+}
+
+// lookupValue walks path through nested maps and lists
+func lookupValue(v any, path []string) (any, bool) {
+	for _, key := range path {
+		switch x := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = x[key]; !ok {
+				return nil, false
+			}
+		case map[string]string:
+			s, ok := x[key]
+			if !ok {
+				return nil, false
+			}
+			v = s
+		case []any:
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 || n >= len(x) {
+				return nil, false
+			}
+			v = x[n]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// renderValue formats a template value for a prompt. Lists become "- item"
+// lines and maps "key: value" lines, which reads well to an agent.
+func renderValue(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case []any:
+		lines := make([]string, len(x))
+		for k, item := range x {
+			lines[k] = "- " + renderScalar(item)
+		}
+		return strings.Join(lines, "\n")
+	case map[string]any:
+		keys := sortedKeys(x)
+		lines := make([]string, len(keys))
+		for k, key := range keys {
+			lines[k] = key + ": " + renderScalar(x[key])
+		}
+		return strings.Join(lines, "\n")
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// renderScalar renders list items and map values; nested collections use JSON
+func renderScalar(v any) string {
+	switch v.(type) {
+	case []any, map[string]any:
+		return jsonString(v)
+	default:
+		return renderValue(v)
+	}
+}
+
+func filterJoin(v any, args []string) any {
+	sep := ", "
+	if len(args) > 0 {
+		sep = args[0]
+	}
+	list, ok := v.([]any)
+	if !ok {
+		return renderValue(v)
+	}
+	items := make([]string, len(list))
+	for k, item := range list {
+		items[k] = renderScalar(item)
+	}
+	return strings.Join(items, sep)
+}
+
+func filterIndent(v any, args []string) any {
+	n := 2
+	if len(args) > 0 {
+		n, _ = strconv.Atoi(args[0])
+	}
+	pad := strings.Repeat(" ", n)
+	lines := strings.Split(renderValue(v), "\n")
+	for k, line := range lines {
+		if line != "" {
+			lines[k] = pad + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func filterTruncate(v any, args []string) any {
+	n, _ := strconv.Atoi(args[0])
+	return truncate(renderValue(v), n)
+}
+
+// checkTemplates validates the placeholders in the prompt or run command of
+// step i. Step references must point at earlier steps. In strict mode every
+// reference without a default must resolve at load time, except step output
+// values and run metadata, which exist only once the run starts.
+func checkTemplates(p *Pipeline, g *stepGraph, i int) error {
+	step := p.Steps[i]
+	exprs, err := parseTemplates(step.Prompt + step.Run)
+	if err != nil {
+		return err
+	}
+
+	for _, expr := range exprs {
+		root := expr.path[0]
+		if !templateNamespaces[root] {
+			// Without strict, only things that look like step references are checked
+			if !p.Strict && p.StepIndex(root) < 0 && !looksLikeStepRef(expr.path) {
+				continue
+			}
+			if err := checkConditionRef(p, g, i, expr.path); err != nil {
+				return fmt.Errorf("%s: %w", expr.raw, err)
+			}
+			continue
+		}
+		if !p.Strict || expr.hasDefault() {
+			continue
+		}
+
+		var ok bool
+		switch root {
+		case "context":
+			_, ok = lookupValue(p.Context, expr.path[1:])
+		case "env":
+			if len(expr.path) == 2 {
+				_, ok = os.LookupEnv(expr.path[1])
+			}
+		case "run":
+			ok = len(expr.path) == 2 && runMetaFields[expr.path[1]]
+		case "artifact":
+			ok = artifactAvailable(p, g, i, strings.Join(expr.path[1:], "."))
+		case "files":
+			ok = len(p.Steps[i].Files.Include) > 0
+		}
+		if !ok {
+			return fmt.Errorf("%s: unresolved reference (strict mode)", expr.raw)
+		}
+	}
+	return nil
+}
+
+// looksLikeStepRef reports whether path has the shape of a step reference
+func looksLikeStepRef(path []string) bool {
+	return (len(path) == 2 && path[1] == "output") || (len(path) == 3 && path[1] == "outputs")
+}
+
+// artifactAvailable reports whether artifact name will exist when step i
+// runs: it is saved by an earlier step, loaded by step i, or already on disk
+func artifactAvailable(p *Pipeline, g *stepGraph, i int, name string) bool {
+	if p.Steps[i].loadsArtifact(name) {
+		return true
+	}
+	for j := range g.ancestors(i) {
+		if file := p.Steps[j].SaveTo.File; file != "" && (file == name || artifactName(file) == name) {
+			return true
+		}
+	}
+	return findArtifact([]string{getArtifactsDir()}, name) != ""
+}
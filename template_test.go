@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	ctx := &Context{
+		Global: map[string]any{
+			"project": map[string]any{"name": "octos", "owners": []any{"ana", "luis"}},
+			"rules":   []any{"Write tests", "Keep it simple"},
+			"empty":   "",
+			"limit":   3,
+		},
+		Outputs: map[string]string{"plan": "step one\nstep two", "artifact.notes": "from disk"},
+		Values:  map[string]map[string]string{"review": {"verdict": "approve"}},
+		Run:     map[string]any{"id": "20261016-120000-abcd", "iteration": 2},
+		stepRef: func(path []string) (any, bool) {
+			if strings.Join(path, ".") == "test.exit_code" {
+				return 1.0, true
+			}
+			return nil, false
+		},
+	}
+	t.Setenv("OCTOS_TEST_USER", "dev")
+
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"nested context", "{{context.project.name}}", "octos"},
+		{"list item", "{{ context.project.owners[1] }}", "luis"},
+		{"list as bullets", "{{context.rules}}", "- Write tests\n- Keep it simple"},
+		{"number", "limit {{context.limit}}", "limit 3"},
+		{"join", `{{context.project.owners | join " and "}}`, "ana and luis"},
+		{"join default separator", "{{context.project.owners | join}}", "ana, luis"},
+		{"upper", "{{context.project.name | upper}}", "OCTOS"},
+		{"indent", "{{plan.output | indent 4}}", "    step one\n    step two"},
+		{"truncate", "{{plan.output | truncate 4}}", "step…"},
+		{"default for missing", `{{context.missing | default "none"}}`, "none"},
+		{"default for empty", `{{context.empty | default "n/a"}}`, "n/a"},
+		{"chained filters", `{{context.missing | default "x y" | upper}}`, "X Y"},
+		{"escaped separator", `{{context.rules | join "\n"}}`, "Write tests\nKeep it simple"},
+		{"step output", "{{plan.output}}", "step one\nstep two"},
+		{"step value", "{{review.outputs.verdict}}", "approve"},
+		{"step field", "{{test.exit_code}}", "1"},
+		{"artifact", "{{artifact.notes}}", "from disk"},
+		{"env", "{{env.OCTOS_TEST_USER}}", "dev"},
+		{"run metadata", "{{run.id}}#{{run.iteration}}", "20261016-120000-abcd#2"},
+		{"unresolved left as-is", "{{context.nope}}", "{{context.nope}}"},
+		{"not a template", "{{ .Values.image }} {{}}", "{{ .Values.image }} {{}}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := interpolate(tt.text, ctx, false)
+			if err != nil {
+				t.Fatalf("interpolate() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("interpolate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderTemplateUnresolved(t *testing.T) {
+	ctx := &Context{Global: map[string]any{}}
+
+	_, unresolved, err := interpolate("a {{context.x}} b {{env.OCTOS_NOT_SET_ANYWHERE}}", ctx, false)
+	if err != nil {
+		t.Fatalf("non-strict error = %v", err)
+	}
+	if len(unresolved) != 2 {
+		t.Errorf("unresolved = %v, want 2 entries", unresolved)
+	}
+
+	_, _, err = interpolate("a {{context.x}}", ctx, true)
+	if err == nil || !strings.Contains(err.Error(), "unresolved template reference {{context.x}}") {
+		t.Errorf("strict error = %v", err)
+	}
+}
+
+func TestParseTemplatesErrors(t *testing.T) {
+	tests := []struct {
+		text    string
+		wantErr string
+	}{
+		{"{{context.x | shout}}", `unknown filter "shout"`},
+		{"{{context.x | truncate}}", "filter truncate takes 1 to 1 arguments"},
+		{"{{context.x | indent two}}", "needs a positive number"},
+		{`{{context.x | join "a" "b"}}`, "filter join takes 0 to 1 arguments"},
+		{`{{context.x | default "open}}`, "unterminated string"},
+		{"{{context.x | }}", "empty filter"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			_, err := parseTemplates(tt.text)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseTemplates() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckTemplatesStrict(t *testing.T) {
+	t.Setenv("OCTOS_TEST_TOKEN", "x")
+
+	tests := []struct {
+		name    string
+		strict  bool
+		steps   []Step
+		wantErr string
+	}{
+		{
+			name:   "known references",
+			strict: true,
+			steps: []Step{
+				{Name: "a", Prompt: "x", SaveTo: SaveSpec{File: "plan.md"}},
+				{Name: "b", Prompt: "{{context.project}} {{env.OCTOS_TEST_TOKEN}} {{run.branch}} {{artifact.plan}} {{a.output}} {{a.status}}"},
+			},
+		},
+		{
+			name:    "missing context key",
+			strict:  true,
+			steps:   []Step{{Name: "a", Prompt: "{{context.nope}}"}},
+			wantErr: "{{context.nope}}: unresolved reference",
+		},
+		{
+			name:   "default skips the check",
+			strict: true,
+			steps:  []Step{{Name: "a", Prompt: `{{context.nope | default "x"}}`}},
+		},
+		{
+			name:    "unset env var",
+			strict:  true,
+			steps:   []Step{{Name: "a", Prompt: "{{env.OCTOS_NOT_SET_ANYWHERE}}"}},
+			wantErr: "unresolved reference",
+		},
+		{
+			name:    "unknown run field",
+			strict:  true,
+			steps:   []Step{{Name: "a", Prompt: "{{run.user}}"}},
+			wantErr: "unresolved reference",
+		},
+		{
+			name:    "artifact from a parallel step",
+			strict:  true,
+			steps:   []Step{{Name: "a", Prompt: "x", SaveTo: SaveSpec{File: "plan.md"}, DependsOn: []string{}}, {Name: "b", Prompt: "{{artifact.plan}}", DependsOn: []string{}}},
+			wantErr: "unresolved reference",
+		},
+		{
+			name:    "unknown root",
+			strict:  true,
+			steps:   []Step{{Name: "a", Prompt: "{{project.name}}"}},
+			wantErr: `reference to unknown step "project"`,
+		},
+		{
+			name:  "unknown root without strict",
+			steps: []Step{{Name: "a", Prompt: "{{project.name}} {{context.nope}}"}},
+		},
+		{
+			name:    "unknown filter without strict",
+			steps:   []Step{{Name: "a", Prompt: "{{context.x | shout}}"}},
+			wantErr: "unknown filter",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Pipeline{
+				Agent:   AgentConfig{Cmd: "agent"},
+				Context: map[string]any{"project": "octos"},
+				Strict:  tt.strict,
+				Steps:   tt.steps,
+			}
+			err := p.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunStepValuesAreNotShellCode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("run steps use sh")
+	}
+	t.Chdir(t.TempDir())
+	payload := `x'; touch pwned1; echo "$(touch pwned2)" ` + "`touch pwned3`" + ` && touch pwned4`
+	os.WriteFile("payload.txt", []byte(payload), 0644)
+
+	p := &Pipeline{
+		File:  "p.yaml",
+		Agent: AgentConfig{Cmd: "echo"},
+		Steps: []Step{
+			{Name: "agent", Run: "cat payload.txt"},
+			{Name: "quoted", Run: `printf '%s' "got {{agent.output}}"`, DependsOn: []string{"agent"}},
+			{Name: "bare", Run: `printf '%s|' {{agent.output | trim}}`, DependsOn: []string{"agent"}},
+		},
+	}
+	outputs := make(map[int]string)
+	var mu sync.Mutex
+	cb := Callbacks{
+		OnStart:  func(int, string) {},
+		OnOutput: func(i int, output string) { mu.Lock(); outputs[i] = output; mu.Unlock() },
+	}
+	if err := RunPipelineWithCallbacks(context.Background(), p, cb, RunOptions{Iteration: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for k := 1; k <= 4; k++ {
+		if _, err := os.Stat(fmt.Sprintf("pwned%d", k)); err == nil {
+			t.Errorf("the output of a step ran as shell code: pwned%d exists", k)
+		}
+	}
+	if got := outputs[1]; got != "got "+payload {
+		t.Errorf("quoted output = %q, want the payload", got)
+	}
+	// Unquoted values are split into words like any shell variable
+	if got := outputs[2]; !strings.HasPrefix(got, "x';|touch|pwned1;|") {
+		t.Errorf("bare output = %q", got)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TestSuite is a file of pipeline tests run by `octos test`
+type TestSuite struct {
+	Tests []PipelineTest `yaml:"tests"`
+}
+
+// PipelineTest runs a pipeline against the mock agent and checks what happened
+type PipelineTest struct {
+	Name      string                   `yaml:"name"`
+	Responses map[string]MockResponses `yaml:"responses"` // scripted answers per step
+	Files     map[string]string        `yaml:"files"`     // written to the test directory before the run
+	Resume    bool                     `yaml:"resume"`    // resume from a state file given in files
+	Expect    TestExpectations         `yaml:"expect"`
+}
+
+// TestExpectations are the assertions of a pipeline test
+type TestExpectations struct {
+	Ran       []string            `yaml:"ran"`       // steps that started
+	Skipped   []string            `yaml:"skipped"`   // steps whose condition was not met
+	NotRun    []string            `yaml:"not_run"`   // steps that neither ran nor were skipped
+	Failed    []string            `yaml:"failed"`    // steps that failed
+	Error     string              `yaml:"error"`     // the run fails with an error containing this
+	Prompts   map[string][]string `yaml:"prompts"`   // text the last prompt of a step contains
+	Artifacts []string            `yaml:"artifacts"` // artifacts that were written
+}
+
+// TestResult is the outcome of one pipeline test
+type TestResult struct {
+	Name     string
+	Duration time.Duration
+	Failures []string
+}
+
+// LoadTestSuite reads a test file and checks it refers to steps of p
+func LoadTestSuite(path string, p *Pipeline) (*TestSuite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var suite TestSuite
+	if err := yaml.Unmarshal(data, &suite); err != nil {
+		return nil, err
+	}
+	if len(suite.Tests) == 0 {
+		return nil, fmt.Errorf("%s: at least one test is required", path)
+	}
+
+	seen := make(map[string]bool)
+	for i, test := range suite.Tests {
+		if test.Name == "" {
+			return nil, fmt.Errorf("test %d: name is required", i+1)
+		}
+		if seen[test.Name] {
+			return nil, fmt.Errorf("test %d (%s): duplicate test name", i+1, test.Name)
+		}
+		seen[test.Name] = true
+		if err := test.checkSteps(p); err != nil {
+			return nil, fmt.Errorf("test %d (%s): %w", i+1, test.Name, err)
+		}
+	}
+	return &suite, nil
+}
+
+// checkSteps reports responses and expectations naming unknown steps
+func (t PipelineTest) checkSteps(p *Pipeline) error {
+	check := func(field string, names []string) error {
+		for _, name := range names {
+			if p.StepIndex(name) < 0 {
+				return fmt.Errorf("%s: unknown step %s", field, name)
+			}
+		}
+		return nil
+	}
+
+	var responses []string
+	for _, name := range sortedKeys(t.Responses) {
+		if name != mockSummaryKey {
+			responses = append(responses, name)
+		}
+	}
+	fields := []struct {
+		name  string
+		steps []string
+	}{
+		{"responses", responses},
+		{"expect.ran", t.Expect.Ran},
+		{"expect.skipped", t.Expect.Skipped},
+		{"expect.not_run", t.Expect.NotRun},
+		{"expect.failed", t.Expect.Failed},
+		{"expect.prompts", sortedKeys(t.Expect.Prompts)},
+	}
+	for _, f := range fields {
+		if err := check(f.name, f.steps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunPipelineTest runs p once against the mock agent, in a temporary
+// directory holding only the test's files, and checks the expectations
+func RunPipelineTest(p *Pipeline, test PipelineTest) TestResult {
+	start := time.Now()
+	result := TestResult{Name: test.Name}
+	fail := func(format string, args ...any) {
+		result.Failures = append(result.Failures, fmt.Sprintf(format, args...))
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		fail("%v", err)
+		return result
+	}
+	dir, err := os.MkdirTemp("", "octos-test-")
+	if err != nil {
+		fail("%v", err)
+		return result
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chdir(dir); err != nil {
+		fail("%v", err)
+		return result
+	}
+	defer os.Chdir(wd)
+
+	if err := writeTestFiles(test.Files); err != nil {
+		fail("files: %v", err)
+		return result
+	}
+
+	// Parallel steps report concurrently
+	var mu sync.Mutex
+	ran := make(map[string]bool)
+	skipped := make(map[string]bool)
+	failed := make(map[string]bool)
+	mark := func(set map[string]bool, i int) {
+		mu.Lock()
+		set[p.Steps[i].Name] = true
+		mu.Unlock()
+	}
+	cb := Callbacks{
+		OnStart: func(i int, _ string) { mark(ran, i) },
+		OnSkip:  func(i int) { mark(skipped, i) },
+		OnComplete: func(i int, _ time.Duration, err error) {
+			if err != nil {
+				mark(failed, i)
+			}
+		},
+	}
+	mock := NewMockAgent(test.Responses)
+	runErr := RunPipelineWithCallbacks(context.Background(), p, cb, RunOptions{Resume: test.Resume, Iteration: 1, Mock: mock})
+
+	exp := test.Expect
+	switch {
+	case exp.Error == "" && runErr != nil:
+		fail("pipeline failed: %v", runErr)
+	case exp.Error != "" && runErr == nil:
+		fail("pipeline succeeded, want an error containing %q", exp.Error)
+	case exp.Error != "" && !strings.Contains(runErr.Error(), exp.Error):
+		fail("pipeline error %q does not contain %q", runErr, exp.Error)
+	}
+
+	for _, name := range exp.Ran {
+		if !ran[name] {
+			fail("step %s did not run", name)
+		}
+	}
+	for _, name := range exp.Skipped {
+		if !skipped[name] {
+			fail("step %s was not skipped", name)
+		}
+	}
+	for _, name := range exp.NotRun {
+		if ran[name] || skipped[name] {
+			fail("step %s was reached", name)
+		}
+	}
+	for _, name := range exp.Failed {
+		if !failed[name] {
+			fail("step %s did not fail", name)
+		}
+	}
+	for _, name := range sortedKeys(exp.Prompts) {
+		prompt, ok := mock.Prompt(name)
+		if !ok {
+			fail("step %s was never prompted", name)
+			continue
+		}
+		for _, text := range exp.Prompts[name] {
+			if !strings.Contains(prompt, text) {
+				fail("prompt of step %s does not contain %q", name, text)
+			}
+		}
+	}
+	for _, name := range exp.Artifacts {
+		if _, err := loadArtifact(name); err != nil {
+			fail("artifact %s was not written", name)
+		}
+	}
+
+	result.Duration = time.Since(start)
+	return result
+}
+
+// writeTestFiles creates the files of a test, and the artifacts directory
+// a pipeline run expects
+func writeTestFiles(files map[string]string) error {
+	if err := os.MkdirAll(filepath.Join(".octos", "artifacts"), 0755); err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(files) {
+		if filepath.IsAbs(name) || !filepath.IsLocal(name) {
+			return fmt.Errorf("%s: path must be inside the test directory", name)
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(name, []byte(files[name]), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// JUnit XML report, as read by CI systems
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitReport renders the results of the tests of one pipeline
+func junitReport(pipelineFile string, results []TestResult) ([]byte, error) {
+	suite := junitSuite{Name: filepath.Base(pipelineFile), Tests: len(results)}
+	var total time.Duration
+	for _, r := range results {
+		c := junitCase{
+			Name:      r.Name,
+			ClassName: suite.Name,
+			Time:      fmt.Sprintf("%.3f", r.Duration.Seconds()),
+		}
+		if len(r.Failures) > 0 {
+			suite.Failures++
+			c.Failure = &junitFailure{Message: r.Failures[0], Text: strings.Join(r.Failures, "\n")}
+		}
+		suite.Cases = append(suite.Cases, c)
+		total += r.Duration
+	}
+	suite.Time = fmt.Sprintf("%.3f", total.Seconds())
+
+	data, err := xml.MarshalIndent(junitSuites{Suites: []junitSuite{suite}}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(data, '\n')...), nil
+}
+
+// runTestCommand implements `octos test`, returning the exit status
+func runTestCommand(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	junit := fs.String("junit", "", "Write a JUnit XML report to this file")
+	run := fs.String("run", "", "Only run tests whose name contains this text")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		log.Fatal("Usage: octos test [--junit report.xml] [--run name] <pipeline.yaml> <tests.yaml>")
+	}
+	pipeline, err := LoadPipeline(fs.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if pipeline.File, err = filepath.Abs(pipeline.File); err != nil {
+		log.Fatal(err)
+	}
+	suite, err := LoadTestSuite(fs.Arg(1), pipeline)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var results []TestResult
+	failed := 0
+	for _, test := range suite.Tests {
+		if *run != "" && !strings.Contains(test.Name, *run) {
+			continue
+		}
+		r := RunPipelineTest(pipeline, test)
+		results = append(results, r)
+		if len(r.Failures) == 0 {
+			fmt.Printf("✓ %s (%s)\n", r.Name, r.Duration.Round(time.Millisecond))
+			continue
+		}
+		failed++
+		fmt.Printf("✗ %s (%s)\n", r.Name, r.Duration.Round(time.Millisecond))
+		for _, f := range r.Failures {
+			fmt.Printf("    %s\n", f)
+		}
+	}
+	fmt.Printf("\n%d passed, %d failed\n", len(results)-failed, failed)
+
+	if *junit != "" {
+		data, err := junitReport(fs.Arg(0), results)
+		if err == nil {
+			err = os.WriteFile(*junit, data, 0644)
+		}
+		if err != nil {
+			log.Fatalf("Failed to write JUnit report: %v", err)
+		}
+	}
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
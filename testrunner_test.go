@@ -0,0 +1,201 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMockResponsesYAML(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want MockResponses
+	}{
+		{`"no"`, MockResponses{{Output: "no"}}},
+		{`{output: boom, exit: 2}`, MockResponses{{Output: "boom", Exit: 2}}},
+		{`[{exit: 1}, fixed]`, MockResponses{{Exit: 1}, {Output: "fixed"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.yaml, func(t *testing.T) {
+			var got MockResponses
+			if err := yaml.Unmarshal([]byte(tt.yaml), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMockAgentResponses(t *testing.T) {
+	m := NewMockAgent(map[string]MockResponses{"fix": {{Exit: 1, Output: "boom"}, {Output: "fixed"}}})
+
+	var outputs []string
+	var codes []int
+	for range 3 {
+		res, err := m.agent("fix").Run(t.Context(), "prompt", nil)
+		outputs = append(outputs, res.Output)
+		codes = append(codes, exitCode(err))
+	}
+	if want := []string{"boom", "fixed", "fixed"}; !reflect.DeepEqual(outputs, want) {
+		t.Errorf("outputs = %q, want %q", outputs, want)
+	}
+	if want := []int{1, -1, -1}; !reflect.DeepEqual(codes, want) {
+		t.Errorf("exit codes = %v, want %v", codes, want)
+	}
+
+	if res, err := m.agent("other").Run(t.Context(), "hi", nil); err != nil || res.Output != "" {
+		t.Errorf("unscripted step = %q, %v, want an empty answer", res.Output, err)
+	}
+	if prompt, ok := m.Prompt("other"); !ok || prompt != "hi" {
+		t.Errorf("Prompt(other) = %q, %v", prompt, ok)
+	}
+}
+
+func TestRunPipelineTest(t *testing.T) {
+	p := &Pipeline{
+		File:  filepath.Join(t.TempDir(), "p.yaml"),
+		Agent: AgentConfig{Cmd: "false"},
+		Steps: []Step{
+			{Name: "check", Prompt: "Do tests exist?"},
+			{Name: "create", Prompt: "Create tests", When: `{{check.output}} == "no"`, SaveTo: SaveSpec{File: "tests.txt"}},
+			{Name: "fix", Prompt: "Fix: {{create.output}}", Retries: 1},
+			{Name: "lint", Run: "exit 3"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		test PipelineTest
+		want []string // failures
+	}{
+		{
+			name: "all expectations met",
+			test: PipelineTest{
+				Responses: map[string]MockResponses{
+					"check":  {{Output: "no"}},
+					"create": {{Output: "added foo_test.go"}},
+					"fix":    {{Exit: 1}, {Output: "fixed"}},
+					"lint":   {{}},
+				},
+				Expect: TestExpectations{
+					Ran:       []string{"check", "create", "fix", "lint"},
+					Prompts:   map[string][]string{"fix": {"Fix: added foo_test.go"}},
+					Artifacts: []string{"tests.txt"},
+				},
+			},
+		},
+		{
+			name: "skipped step and real run step",
+			test: PipelineTest{
+				Responses: map[string]MockResponses{"check": {{Output: "yes"}}},
+				Expect: TestExpectations{
+					Skipped: []string{"create"},
+					Failed:  []string{"lint"},
+					Error:   "step lint failed",
+				},
+			},
+		},
+		{
+			name: "unmet expectations",
+			test: PipelineTest{
+				Responses: map[string]MockResponses{"check": {{Output: "yes"}}, "fix": {{Exit: 2}}},
+				Expect: TestExpectations{
+					Ran:       []string{"create"},
+					NotRun:    []string{"fix"},
+					Prompts:   map[string][]string{"create": {"x"}},
+					Artifacts: []string{"tests.txt"},
+				},
+			},
+			want: []string{
+				"pipeline failed: step fix failed: exit status 2",
+				"step create did not run",
+				"step fix was reached",
+				"step create was never prompted",
+				"artifact tests.txt was not written",
+			},
+		},
+		{
+			name: "seeded files",
+			test: PipelineTest{
+				Files:     map[string]string{".octos/artifacts/tests.txt": "old"},
+				Responses: map[string]MockResponses{"check": {{Output: "yes"}}, "lint": {{}}},
+				Expect:    TestExpectations{Artifacts: []string{"tests.txt"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wd, _ := os.Getwd()
+			got := RunPipelineTest(p, tt.test)
+			if !reflect.DeepEqual(got.Failures, tt.want) {
+				t.Errorf("failures = %q, want %q", got.Failures, tt.want)
+			}
+			if now, _ := os.Getwd(); now != wd {
+				t.Errorf("working directory changed to %s", now)
+			}
+		})
+	}
+}
+
+func TestLoadTestSuite(t *testing.T) {
+	p := &Pipeline{Steps: []Step{{Name: "a"}, {Name: "b"}}}
+
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr string
+	}{
+		{"valid", "tests:\n  - name: t\n    responses: {a: x, summarize: short}\n    expect: {ran: [a, b]}", ""},
+		{"empty", "tests: []", "at least one test is required"},
+		{"no name", "tests:\n  - expect: {ran: [a]}", "name is required"},
+		{"duplicate", "tests:\n  - name: t\n  - name: t", "duplicate test name"},
+		{"unknown response", "tests:\n  - name: t\n    responses: {c: x}", "responses: unknown step c"},
+		{"unknown expectation", "tests:\n  - name: t\n    expect: {prompts: {c: [x]}}", "expect.prompts: unknown step c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tests.yaml")
+			os.WriteFile(path, []byte(tt.yaml), 0644)
+			_, err := LoadTestSuite(path, p)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJUnitReport(t *testing.T) {
+	data, err := junitReport("dir/p.yaml", []TestResult{
+		{Name: "passes"},
+		{Name: "fails", Failures: []string{"step a did not run", "step b <was> reached"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := string(data)
+	for _, want := range []string{
+		`<testsuite name="p.yaml" tests="2" failures="1"`,
+		`<testcase name="passes" classname="p.yaml" time="0.000"></testcase>`,
+		`<failure message="step a did not run">step a did not run&#xA;step b &lt;was&gt; reached</failure>`,
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report does not contain %s:\n%s", want, report)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -55,16 +58,29 @@ const (
 	StatusRunning
 	StatusCompleted
 	StatusFailed
+	StatusTimedOut
+	StatusCancelled
+	StatusSkipped
 )
 
 type StepState struct {
-	Name      string
-	Status    StepStatus
-	Duration  time.Duration
-	StartTime time.Time
-	Output    string
-	Error     error
-	Prompt    string
+	Name        string
+	Status      StepStatus
+	Duration    time.Duration
+	StartTime   time.Time
+	Output      string
+	Error       error
+	Prompt      string
+	Attempt     int
+	MaxAttempts int
+}
+
+// fileChange is a line of the File Changes panel, with the diff of the file
+// in a git repository
+type fileChange struct {
+	step   int
+	change string
+	diff   string
 }
 
 type FocusedPanel int
@@ -83,14 +99,17 @@ type TUIModel struct {
 	outputView     viewport.Model
 	diffView       viewport.Model
 	promptView     viewport.Model
+	fileDiffView   viewport.Model
 	progress       progress.Model
 	width          int
 	height         int
 	startTime      time.Time
 	endTime        time.Time
-	filesChanged   []string
+	filesChanged   []fileChange
+	selectedFile   int
 	quitting       bool
 	resuming       bool
+	started        bool
 	program        *tea.Program
 	pipelineEnded  bool
 	statusMsg      string
@@ -98,15 +117,28 @@ type TUIModel struct {
 	gitBranch      string
 	userScrolling  bool
 	showPrompt     bool
+	showDiff       bool
+	rollbackStep   string // step whose rollback waits for confirmation
 	focusedPanel   FocusedPanel
 	maxLoops       int
 	currentLoop    int
+	cancelRun      context.CancelFunc
+	runDone        chan struct{}
+	runUsage       Usage         // tokens and cost of the current loop
+	cassette       *Cassette     // from --record or --replay
+	selection      StepSelection // from --from, --until or --only, for the first loop
+	wait           bool          // from --wait
+	isolate        string        // from --isolate
+	pastUsage      Usage         // tokens and cost of the finished loops
 }
 
 type stepStartMsg struct {
 	index  int
 	prompt string
 }
+type stepSkippedMsg struct {
+	index int
+}
 type stepOutputMsg struct {
 	index  int
 	output string
@@ -120,9 +152,22 @@ type stepCompleteMsg struct {
 	duration time.Duration
 	err      error
 }
+type stepAttemptMsg struct {
+	index       int
+	attempt     int
+	maxAttempts int
+	err         error
+}
+type usageMsg struct {
+	total Usage
+}
 type fileChangesMsg struct {
 	index   int
 	changes []string
+	diffs   map[string]string
+}
+type pipelineDoneMsg struct {
+	err error
 }
 type tickMsg time.Time
 type startPipelineMsg struct{}
@@ -137,11 +182,19 @@ func NewTUIModel(p *Pipeline, resume bool) TUIModel {
 	}
 
 	// Load state if resuming
+	var runUsage Usage
 	if resume && StateExists(p.File) {
-		state, _ := LoadState(p.File)
-		for i := 0; i <= state.LastCompletedStep && i < len(steps); i++ {
-			steps[i].Status = StatusCompleted
-			steps[i].Duration = time.Second // Placeholder
+		if state, err := LoadState(p.File); err == nil {
+			state.upgrade(p)
+			runUsage = state.Usage
+			for i := range steps {
+				if cp, ok := state.Steps[steps[i].Name]; ok && cp.Status == CheckpointCompleted {
+					steps[i].Status = StatusCompleted
+					steps[i].Duration = time.Duration(cp.Duration * float64(time.Second))
+				} else if ok && cp.Status == CheckpointSkipped {
+					steps[i].Status = StatusSkipped
+				}
+			}
 		}
 	}
 
@@ -170,6 +223,30 @@ func NewTUIModel(p *Pipeline, resume bool) TUIModel {
 		gitBranch:   gitBranch,
 		maxLoops:    0,
 		currentLoop: 1,
+		runUsage:    runUsage,
+	}
+}
+
+// selectSteps makes the first loop run only the steps of sel. The others
+// show as completed when their saved outputs will be used.
+func (m *TUIModel) selectSteps(sel StepSelection) {
+	m.selection = sel
+	if sel.IsZero() {
+		return
+	}
+	state := loadSavedOutputs(m.pipeline)
+	for i := range m.steps {
+		cp := state.Steps[m.steps[i].Name]
+		if cp == nil || sel.includes(m.pipeline, i) {
+			continue
+		}
+		switch cp.Status {
+		case CheckpointCompleted:
+			m.steps[i].Status = StatusCompleted
+			m.steps[i].Duration = time.Duration(cp.Duration * float64(time.Second))
+		case CheckpointSkipped:
+			m.steps[i].Status = StatusSkipped
+		}
 	}
 }
 
@@ -232,7 +309,7 @@ func (m *TUIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.diffView = viewport.New(panelWidth-PanelBorderPadding, diffHeight)
 		
 		// Only trigger pipeline start on first window size event
-		if m.currentStep == 0 && !m.pipelineEnded {
+		if !m.started {
 			return m, func() tea.Msg { return startPipelineMsg{} }
 		}
 		return m, nil
@@ -240,8 +317,21 @@ func (m *TUIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case startPipelineMsg:
 		// Start pipeline after window is ready
 		if m.program != nil {
+			m.started = true
 			m.statusMsg = "Starting pipeline..."
-			go runPipelineWithProgram(m.pipeline, m.resuming, m.program)
+
+			runCtx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			m.cancelRun = cancel
+			m.runDone = done
+			opts := RunOptions{Resume: m.resuming, Iteration: m.currentLoop, Wait: m.wait, Cassette: m.cassette, Isolate: m.isolate}
+			if m.currentLoop == 1 {
+				opts.Select = m.selection
+			}
+			go func() {
+				defer close(done)
+				runPipelineWithProgram(runCtx, m.pipeline, opts, m.program)
+			}()
 		}
 		return m, nil
 
@@ -249,7 +339,9 @@ func (m *TUIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		switch msg.Type {
 		case tea.MouseWheelUp:
 			m.userScrolling = true
-			if m.focusedPanel == FocusOutput {
+			if m.showDiff {
+				m.fileDiffView.LineUp(ScrollLines)
+			} else if m.focusedPanel == FocusOutput {
 				m.outputView.LineUp(ScrollLines)
 			} else {
 				m.diffView.LineUp(ScrollLines)
@@ -257,7 +349,9 @@ func (m *TUIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, nil
 		case tea.MouseWheelDown:
 			m.userScrolling = true
-			if m.focusedPanel == FocusOutput {
+			if m.showDiff {
+				m.fileDiffView.LineDown(ScrollLines)
+			} else if m.focusedPanel == FocusOutput {
 				m.outputView.LineDown(ScrollLines)
 			} else {
 				m.diffView.LineDown(ScrollLines)
@@ -279,6 +373,8 @@ func (m *TUIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.steps[msg.index].Status = StatusRunning
 			m.steps[msg.index].StartTime = time.Now()
 			m.steps[msg.index].Prompt = msg.prompt
+			m.steps[msg.index].Attempt = 1
+			m.steps[msg.index].MaxAttempts = m.pipeline.Steps[msg.index].MaxAttempts()
 			m.currentStep = msg.index
 			m.statusMsg = fmt.Sprintf("Running step %d/%d: %s", msg.index+1, len(m.steps), m.steps[msg.index].Name)
 			m.scrollToStep(msg.index)
@@ -286,6 +382,13 @@ func (m *TUIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		return m, nil
 
+	case stepSkippedMsg:
+		if m.isValidStepIndex(msg.index) {
+			m.steps[msg.index].Status = StatusSkipped
+			m.statusMsg = fmt.Sprintf("Step %d/%d skipped (condition not met)", msg.index+1, len(m.steps))
+		}
+		return m, nil
+
 	case stepOutputMsg:
 		if m.isValidStepIndex(msg.index) {
 			m.steps[msg.index].Output = msg.output
@@ -298,9 +401,27 @@ func (m *TUIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		return m, nil
 
+	case stepAttemptMsg:
+		if m.isValidStepIndex(msg.index) {
+			m.steps[msg.index].Attempt = msg.attempt
+			m.steps[msg.index].MaxAttempts = msg.maxAttempts
+			m.steps[msg.index].Output += fmt.Sprintf("\n↻ attempt %d/%d (previous attempt: %v)\n", msg.attempt, msg.maxAttempts, msg.err)
+			m.statusMsg = fmt.Sprintf("Retrying step %d: attempt %d/%d", msg.index+1, msg.attempt, msg.maxAttempts)
+		}
+		return m, nil
+
+	case usageMsg:
+		m.runUsage = msg.total
+		return m, nil
+
 	case fileChangesMsg:
 		if m.isValidStepIndex(msg.index) {
-			m.filesChanged = append(m.filesChanged, msg.changes...)
+			// Replace what was reported live while the step ran
+			m.filesChanged = slices.DeleteFunc(m.filesChanged, func(f fileChange) bool { return f.step == msg.index })
+			for _, change := range msg.changes {
+				m.filesChanged = append(m.filesChanged, fileChange{step: msg.index, change: change, diff: msg.diffs[changePath(change)]})
+			}
+			m.selectedFile = min(m.selectedFile, max(len(m.filesChanged)-1, 0))
 		}
 		return m, nil
 
@@ -308,20 +429,48 @@ func (m *TUIModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		if m.isValidStepIndex(msg.index) {
 			m.steps[msg.index].Duration = msg.duration
 			if msg.err != nil {
-				m.steps[msg.index].Status = StatusFailed
 				m.steps[msg.index].Error = msg.err
-				m.statusMsg = fmt.Sprintf("Step %d failed: %v", msg.index+1, msg.err)
+				switch {
+				case errors.Is(msg.err, ErrStepTimedOut):
+					m.steps[msg.index].Status = StatusTimedOut
+					m.statusMsg = fmt.Sprintf("Step %d %v", msg.index+1, msg.err)
+				case errors.Is(msg.err, ErrCancelled):
+					m.steps[msg.index].Status = StatusCancelled
+					m.statusMsg = fmt.Sprintf("Step %d cancelled", msg.index+1)
+				default:
+					m.steps[msg.index].Status = StatusFailed
+					m.statusMsg = fmt.Sprintf("Step %d failed: %v", msg.index+1, msg.err)
+				}
 			} else {
 				m.steps[msg.index].Status = StatusCompleted
 				m.statusMsg = fmt.Sprintf("Step %d/%d completed in %.1fs", msg.index+1, len(m.steps), msg.duration.Seconds())
 			}
 
-			if msg.index == len(m.steps)-1 {
-				// Pipeline ended, enable navigation
-				m.pipelineEnded = true
-				m.endTime = time.Now()
-				m.selectedStep = msg.index
-				m.statusMsg = "Pipeline completed! Use ↑↓/jk to navigate steps"
+			// Follow another step that is still running in parallel
+			if msg.index == m.currentStep {
+				for i, step := range m.steps {
+					if step.Status == StatusRunning {
+						m.currentStep = i
+						break
+					}
+				}
+			}
+		}
+		return m, nil
+
+	case pipelineDoneMsg:
+		// Pipeline ended, enable navigation
+		m.pipelineEnded = true
+		m.endTime = time.Now()
+		m.selectedStep = m.currentStep
+		if msg.err != nil {
+			m.statusMsg = fmt.Sprintf("Pipeline failed: %v", msg.err)
+		} else {
+			m.statusMsg = "Pipeline completed! Use ↑↓/jk to navigate steps"
+		}
+		if m.isolate != "" {
+			if run, err := latestRun(m.pipeline.File); err == nil && run.Workspace != nil {
+				m.statusMsg += " · " + run.Workspace.summary(msg.err)
 			}
 		}
 		return m, nil
@@ -336,6 +485,9 @@ func (m *TUIModel) handleKeyPress(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	switch msg.String() {
 	case "q", "ctrl+c":
 		m.quitting = true
+		if m.cancelRun != nil {
+			m.cancelRun()
+		}
 		return m, tea.Quit
 	
 	case "tab":
@@ -343,9 +495,8 @@ func (m *TUIModel) handleKeyPress(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		return m, nil
 	
 	case "esc":
-		if m.showPrompt {
-			m.showPrompt = false
-		}
+		m.showPrompt = false
+		m.showDiff = false
 		return m, nil
 	
 	case "enter":
@@ -354,6 +505,9 @@ func (m *TUIModel) handleKeyPress(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	case "r":
 		return m.handleRestartKey()
 	
+	case "b":
+		return m.handleRollbackKey()
+	
 	case "j", "down":
 		return m.handleDownKey()
 	
@@ -380,16 +534,27 @@ func (m *TUIModel) handleKeyPress(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// countCompletedSteps counts the steps that are done: completed or skipped
 func (m *TUIModel) countCompletedSteps() int {
 	completed := 0
 	for _, step := range m.steps {
-		if step.Status == StatusCompleted {
+		if step.Status == StatusCompleted || step.Status == StatusSkipped {
 			completed++
 		}
 	}
 	return completed
 }
 
+func (m *TUIModel) countRunningSteps() int {
+	running := 0
+	for _, step := range m.steps {
+		if step.Status == StatusRunning {
+			running++
+		}
+	}
+	return running
+}
+
 func (m *TUIModel) calculateStepsPerMinute(completed int, elapsed time.Duration) float64 {
 	if elapsed.Minutes() > 0 && completed > 0 {
 		return float64(completed) / elapsed.Minutes()
@@ -417,6 +582,9 @@ func (m *TUIModel) buildStepsView(showTitle bool, showDuration bool) string {
 		stepStyle := GetStepStatusStyle(step.Status)
 		
 		line := fmt.Sprintf("%s %s", icon, step.Name)
+		if step.Attempt > 1 {
+			line += fmt.Sprintf(" attempt %d/%d", step.Attempt, step.MaxAttempts)
+		}
 		if showDuration && step.Status == StatusCompleted {
 			duration := fmt.Sprintf("%.1fs", step.Duration.Seconds())
 			line = stepStyle.Render(line) + " " + statsStyle.Render(duration)
@@ -426,7 +594,7 @@ func (m *TUIModel) buildStepsView(showTitle bool, showDuration bool) string {
 		
 		stepsView.WriteString(line)
 		
-		if !m.pipelineEnded && i == m.currentStep && step.Status == StatusRunning {
+		if !m.pipelineEnded && step.Status == StatusRunning {
 			stepsView.WriteString(" ◀")
 		} else if m.pipelineEnded && i == m.selectedStep {
 			stepsView.WriteString(" ◀")
@@ -457,6 +625,17 @@ func (m *TUIModel) toggleFocusedPanel() {
 }
 
 func (m *TUIModel) handleEnterKey() (tea.Model, tea.Cmd) {
+	if m.showDiff {
+		m.showDiff = false
+		return m, nil
+	}
+	if m.focusedPanel == FocusDiff && !m.showPrompt {
+		if m.selectedFile < len(m.filesChanged) {
+			m.showDiff = true
+			m.initFileDiffView()
+		}
+		return m, nil
+	}
 	if m.pipelineEnded {
 		if !m.showPrompt {
 			m.showPrompt = true
@@ -479,11 +658,50 @@ func (m *TUIModel) handleRestartKey() (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// handleRollbackKey rolls the worktree back to its state before the
+// selected step, once b is pressed a second time to confirm
+func (m *TUIModel) handleRollbackKey() (tea.Model, tea.Cmd) {
+	if !m.pipelineEnded || !m.pipeline.Git.Checkpoint || m.showPrompt || m.showDiff {
+		return m, nil
+	}
+	step := m.steps[m.selectedStep].Name
+	if m.rollbackStep != step {
+		m.rollbackStep = step
+		m.statusMsg = fmt.Sprintf("Press b again to roll the worktree back to before step %s", step)
+		return m, nil
+	}
+	m.rollbackStep = ""
+
+	run, err := latestRun(m.pipeline.File)
+	if err != nil {
+		m.statusMsg = fmt.Sprintf("Rollback failed: %v", err)
+		return m, nil
+	}
+	rb, err := RollbackStep(run, step)
+	if err != nil {
+		m.statusMsg = fmt.Sprintf("Rollback failed: %v", err)
+		return m, nil
+	}
+	m.statusMsg = fmt.Sprintf("↺ Rolled back %d files to before step %s, previous worktree saved as %s", len(rb.Changes), step, rb.Backup)
+	return m, nil
+}
+
 func (m *TUIModel) handleDownKey() (tea.Model, tea.Cmd) {
 	if m.showPrompt {
 		m.promptView.LineDown(1)
 		return m, nil
 	}
+	if m.showDiff {
+		m.fileDiffView.LineDown(1)
+		return m, nil
+	}
+	if m.focusedPanel == FocusDiff {
+		if m.selectedFile < len(m.filesChanged)-1 {
+			m.selectedFile++
+			m.scrollToFile()
+		}
+		return m, nil
+	}
 	if m.pipelineEnded && m.selectedStep < len(m.steps)-1 {
 		m.selectedStep++
 		m.scrollToStep(m.selectedStep)
@@ -496,6 +714,17 @@ func (m *TUIModel) handleUpKey() (tea.Model, tea.Cmd) {
 		m.promptView.LineUp(1)
 		return m, nil
 	}
+	if m.showDiff {
+		m.fileDiffView.LineUp(1)
+		return m, nil
+	}
+	if m.focusedPanel == FocusDiff {
+		if m.selectedFile > 0 {
+			m.selectedFile--
+			m.scrollToFile()
+		}
+		return m, nil
+	}
 	if m.pipelineEnded && m.selectedStep > 0 {
 		m.selectedStep--
 		m.scrollToStep(m.selectedStep)
@@ -580,6 +809,8 @@ func (m *TUIModel) View() string {
 	// Render popup if showing prompt
 	if m.showPrompt && m.pipelineEnded && m.selectedStep < len(m.steps) && m.steps[m.selectedStep].Prompt != "" {
 		result = m.renderPromptPopup(result)
+	} else if m.showDiff && m.selectedFile < len(m.filesChanged) {
+		result = m.renderFileDiffPopup()
 	}
 	
 	return result
@@ -597,12 +828,8 @@ func (m *TUIModel) renderHeader() string {
 	titleBorder := strings.Repeat("═", len(titleText)+titleBorderPadding)
 	titleBox := titleStyle.Render(fmt.Sprintf("╔%s╗\n║  %s  ║\n╚%s╝", titleBorder, titleText, titleBorder))
 	
-	running := 0
+	running := m.countRunningSteps()
 	completed := m.countCompletedSteps()
-	// Count current step as running if pipeline hasn't ended
-	if !m.pipelineEnded && m.isValidStepIndex(m.currentStep) {
-		running = 1
-	}
 
 	// Progress bar with cyberpunk style - cyan text (original color)
 	percent := float64(completed+running) / float64(len(m.steps))
@@ -662,21 +889,24 @@ func (m *TUIModel) renderFooter() string {
 		elapsed = m.endTime.Sub(m.startTime)
 	}
 	
-	running := 0
+	running := m.countRunningSteps()
 	completed := m.countCompletedSteps()
-	// Count current step as running if pipeline hasn't ended
-	if !m.pipelineEnded && m.isValidStepIndex(m.currentStep) {
-		running = 1
-	}
-	
-	stats := statsStyle.Render(
-		fmt.Sprintf("⚡ Elapsed: %s │ Steps: %d/%d │ Speed: %.1f steps/min",
-			elapsed.Round(time.Second),
-			completed+running,
-			len(m.steps),
-			m.calculateStepsPerMinute(completed, elapsed),
-		),
+	
+	statsText := fmt.Sprintf("⚡ Elapsed: %s │ Steps: %d/%d │ Speed: %.1f steps/min",
+		elapsed.Round(time.Second),
+		completed+running,
+		len(m.steps),
+		m.calculateStepsPerMinute(completed, elapsed),
 	)
+	if !m.runUsage.IsZero() {
+		statsText += " │ 💰 " + m.runUsage.String()
+	}
+	if !m.pastUsage.IsZero() {
+		total := m.pastUsage
+		total.Add(m.runUsage)
+		statsText += " │ All loops: " + total.String()
+	}
+	stats := statsStyle.Render(statsText)
 
 	help := m.buildHelpText()
 	
@@ -685,16 +915,20 @@ func (m *TUIModel) renderFooter() string {
 
 func (m *TUIModel) buildHelpText() string {
 	if m.pipelineEnded {
+		rollback := ""
+		if m.pipeline.Git.Checkpoint {
+			rollback = " │ [b] Roll back"
+		}
 		if m.width >= wideTerminalWidth {
-			return "⌨  [↑↓/jk] Navigate │ [Enter] View prompt │ [r] Restart │ [Tab] Switch panel │ [Ctrl+j/k] Scroll │ [Ctrl+d/u] Page │ [Mouse wheel] Scroll │ [q] Quit"
+			return "⌨  [↑↓/jk] Navigate │ [Enter] View prompt/diff │ [r] Restart" + rollback + " │ [Tab] Switch panel │ [Ctrl+j/k] Scroll │ [Ctrl+d/u] Page │ [Mouse wheel] Scroll │ [q] Quit"
 		} else if m.width >= mediumTerminalWidth {
-			return "⌨  [↑↓/jk] Navigate │ [Enter] Prompt │ [r] Restart │ [Tab] Panel │ [Ctrl+j/k] Scroll │ [q] Quit"
+			return "⌨  [↑↓/jk] Navigate │ [Enter] Prompt │ [r] Restart" + rollback + " │ [Tab] Panel │ [Ctrl+j/k] Scroll │ [q] Quit"
 		} else {
-			return "⌨  [↑↓/jk] Nav │ [Enter] Prompt │ [r] Restart │ [Tab] Panel │ [q] Quit"
+			return "⌨  [↑↓/jk] Nav │ [Enter] Prompt │ [r] Restart" + rollback + " │ [Tab] Panel │ [q] Quit"
 		}
 	} else {
 		if m.width >= extraWideTerminalWidth {
-			return "⌨  [Tab] Switch panel │ [Ctrl+j/k] Scroll │ [Ctrl+d/u] Page │ [Mouse wheel] Scroll │ [q] Quit"
+			return "⌨  [Tab] Switch panel │ [↑↓/jk] Select file │ [Enter] View diff │ [Ctrl+j/k] Scroll │ [Ctrl+d/u] Page │ [q] Quit"
 		} else if m.width >= narrowTerminalWidth {
 			return "⌨  [Tab] Panel │ [Ctrl+j/k] Scroll │ [Ctrl+d/u] Page │ [q] Quit"
 		} else {
@@ -734,6 +968,8 @@ func (m *TUIModel) renderContent(width, contentHeight int) string {
 			outputContent = "Running..."
 		} else if m.steps[displayStep].Status == StatusCompleted {
 			outputContent = "Completed (no output)"
+		} else if m.steps[displayStep].Status == StatusSkipped {
+			outputContent = "Skipped (condition not met)"
 		}
 	}
 	
@@ -774,8 +1010,11 @@ func (m *TUIModel) renderContent(width, contentHeight int) string {
 	diffContent := "No changes yet"
 	if len(m.filesChanged) > 0 {
 		var dc strings.Builder
-		for _, file := range m.filesChanged {
-			dc.WriteString(greenStyle.Render("+ " + file))
+		for k, file := range m.filesChanged {
+			dc.WriteString(changeStyle(file.change).Render(file.change))
+			if m.focusedPanel == FocusDiff && k == m.selectedFile {
+				dc.WriteString(" ◀")
+			}
 			dc.WriteString("\n")
 		}
 		diffContent = dc.String()
@@ -936,14 +1175,7 @@ func (m *TUIModel) initPromptView() {
 	}
 	
 	prompt := m.steps[m.selectedStep].Prompt
-	popupWidth := int(float64(m.width) * popupWidthRatio)
-	if popupWidth > NarrowModeWidth {
-		popupWidth = NarrowModeWidth
-	}
-	popupHeight := int(float64(m.height) * popupHeightRatio)
-	if popupHeight > PopupMaxHeight {
-		popupHeight = PopupMaxHeight
-	}
+	popupWidth, popupHeight := m.popupSize()
 	
 	wrappedPrompt := wrapText(prompt, popupWidth-popupTextPadding)
 	m.promptView = viewport.New(popupWidth-popupTextPadding, popupHeight-popupViewportOffset)
@@ -953,6 +1185,8 @@ func (m *TUIModel) initPromptView() {
 // restartPipeline resets the pipeline state and starts again
 func (m *TUIModel) restartPipeline() (tea.Model, tea.Cmd) {
 	m.currentLoop++
+	m.pastUsage.Add(m.runUsage)
+	m.runUsage = Usage{}
 	
 	// Reset all steps to pending
 	for i := range m.steps {
@@ -960,13 +1194,16 @@ func (m *TUIModel) restartPipeline() (tea.Model, tea.Cmd) {
 		m.steps[i].Output = ""
 		m.steps[i].Error = nil
 		m.steps[i].Duration = 0
+		m.steps[i].Attempt = 0
 	}
 	
 	// Reset state
 	m.currentStep = 0
 	m.selectedStep = 0
 	m.pipelineEnded = false
-	m.filesChanged = []string{}
+	m.filesChanged = nil
+	m.selectedFile = 0
+	m.showDiff = false
 	m.startTime = time.Now()
 	m.endTime = time.Time{}
 	m.userScrolling = false
@@ -1005,7 +1242,18 @@ func (m *TUIModel) scrollToStep(stepIndex int) {
 
 func (m *TUIModel) renderPromptPopup(baseContent string) string {
 	stepName := m.steps[m.selectedStep].Name
-	
+	return m.renderPopup(fmt.Sprintf("PROMPT: %s", stepName), m.promptView)
+}
+
+// renderFileDiffPopup shows the diff of the selected file change
+func (m *TUIModel) renderFileDiffPopup() string {
+	file := m.filesChanged[m.selectedFile]
+	title := fmt.Sprintf("DIFF: %s (%s)", changePath(file.change), m.steps[file.step].Name)
+	return m.renderPopup(title, m.fileDiffView)
+}
+
+// popupSize returns the width and height of popups
+func (m *TUIModel) popupSize() (int, int) {
 	popupWidth := int(float64(m.width) * popupWidthRatio)
 	if popupWidth > NarrowModeWidth {
 		popupWidth = NarrowModeWidth
@@ -1014,6 +1262,11 @@ func (m *TUIModel) renderPromptPopup(baseContent string) string {
 	if popupHeight > PopupMaxHeight {
 		popupHeight = PopupMaxHeight
 	}
+	return popupWidth, popupHeight
+}
+
+func (m *TUIModel) renderPopup(title string, view viewport.Model) string {
+	popupWidth, popupHeight := m.popupSize()
 	
 	// Create popup style
 	popupStyle := lipgloss.NewStyle().
@@ -1025,10 +1278,10 @@ func (m *TUIModel) renderPromptPopup(baseContent string) string {
 		Height(popupHeight)
 	
 	// Title
-	popupTitle := magentaBoldStyle.Render(fmt.Sprintf("PROMPT: %s", stepName))
+	popupTitle := magentaBoldStyle.Render(title)
 	
 	// Footer with scroll hint
-	scrollPercent := m.promptView.ScrollPercent()
+	scrollPercent := view.ScrollPercent()
 	scrollInfo := fmt.Sprintf("%.0f%%", scrollPercent*100)
 	footer := lipgloss.NewStyle().
 		Foreground(neonYellow).
@@ -1039,7 +1292,7 @@ func (m *TUIModel) renderPromptPopup(baseContent string) string {
 		lipgloss.Left,
 		popupTitle,
 		"",
-		m.promptView.View(),
+		view.View(),
 		"",
 		footer,
 	)
@@ -1058,33 +1311,96 @@ func (m *TUIModel) renderPromptPopup(baseContent string) string {
 	)
 }
 
-func runPipelineWithProgram(p *Pipeline, resume bool, program *tea.Program) {
-	RunPipelineWithCallbacks(p,
-		func(stepIndex int, prompt string) {
+// initFileDiffView initializes the diff viewport with the selected file
+// change
+func (m *TUIModel) initFileDiffView() {
+	popupWidth, popupHeight := m.popupSize()
+	content := wrapText("No diff recorded (changes are only diffed in a git repository)", popupWidth-popupTextPadding)
+	if diff := m.filesChanged[m.selectedFile].diff; diff != "" {
+		content = colorizeDiff(diff, popupWidth-popupTextPadding)
+	}
+	m.fileDiffView = viewport.New(popupWidth-popupTextPadding, popupHeight-popupViewportOffset)
+	m.fileDiffView.SetContent(content)
+}
+
+// scrollToFile keeps the selected file change visible in the File Changes
+// panel
+func (m *TUIModel) scrollToFile() {
+	switch {
+	case m.selectedFile < m.diffView.YOffset:
+		m.diffView.SetYOffset(m.selectedFile)
+	case m.selectedFile >= m.diffView.YOffset+m.diffView.Height:
+		m.diffView.SetYOffset(m.selectedFile - m.diffView.Height + 1)
+	}
+}
+
+// colorizeDiff wraps a unified diff to width and colors its lines
+func colorizeDiff(diff string, width int) string {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(diff, "\n"), "\n") {
+		style := diffLineStyle(line)
+		for _, part := range strings.Split(wrapText(line, width), "\n") {
+			b.WriteString(style.Render(part))
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
+
+// Shutdown cancels a running pipeline and waits until its agents are killed
+func (m *TUIModel) Shutdown() {
+	if m.cancelRun != nil {
+		m.cancelRun()
+	}
+	if m.runDone != nil {
+		<-m.runDone
+	}
+}
+
+func runPipelineWithProgram(runCtx context.Context, p *Pipeline, opts RunOptions, program *tea.Program) {
+	err := RunPipelineWithCallbacks(runCtx, p, Callbacks{
+		OnStart: func(stepIndex int, prompt string) {
 			if program != nil {
 				program.Send(stepStartMsg{index: stepIndex, prompt: prompt})
 			}
 		},
-		func(stepIndex int, output string) {
+		OnOutput: func(stepIndex int, output string) {
 			if program != nil {
 				program.Send(stepOutputMsg{index: stepIndex, output: output})
 			}
 		},
-		func(stepIndex int, duration time.Duration, err error) {
+		OnComplete: func(stepIndex int, duration time.Duration, err error) {
 			if program != nil {
 				program.Send(stepCompleteMsg{index: stepIndex, duration: duration, err: err})
 			}
 		},
-		func(stepIndex int, line string) {
+		OnStream: func(stepIndex int, line string) {
 			if program != nil {
 				program.Send(stepStreamMsg{index: stepIndex, line: line})
 			}
 		},
-		func(stepIndex int, changes []string) {
+		OnFileChanges: func(stepIndex int, changes []string, diffs map[string]string) {
 			if program != nil {
-				program.Send(fileChangesMsg{index: stepIndex, changes: changes})
+				program.Send(fileChangesMsg{index: stepIndex, changes: changes, diffs: diffs})
 			}
 		},
-		resume,
-	)
+		OnAttempt: func(stepIndex int, attempt, maxAttempts int, err error) {
+			if program != nil {
+				program.Send(stepAttemptMsg{index: stepIndex, attempt: attempt, maxAttempts: maxAttempts, err: err})
+			}
+		},
+		OnUsage: func(stepIndex int, usage Usage, total Usage) {
+			if program != nil {
+				program.Send(usageMsg{total: total})
+			}
+		},
+		OnSkip: func(stepIndex int) {
+			if program != nil {
+				program.Send(stepSkippedMsg{index: stepIndex})
+			}
+		},
+	}, opts)
+	if program != nil {
+		program.Send(pipelineDoneMsg{err: err})
+	}
 }
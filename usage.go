@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrBudgetExceeded is returned when a run costs more than the pipeline budget
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// Price is what a model costs, in USD per million tokens
+type Price struct {
+	Input      float64 `yaml:"input"`
+	Output     float64 `yaml:"output"`
+	CacheRead  float64 `yaml:"cache_read"`
+	CacheWrite float64 `yaml:"cache_write"`
+}
+
+func (p Price) validate() error {
+	if p.Input < 0 || p.Output < 0 || p.CacheRead < 0 || p.CacheWrite < 0 {
+		return fmt.Errorf("prices must be positive")
+	}
+	return nil
+}
+
+// cost returns the price of u in USD
+func (p Price) cost(u Usage) float64 {
+	return (float64(u.InputTokens)*p.Input +
+		float64(u.OutputTokens)*p.Output +
+		float64(u.CacheReadTokens)*p.CacheRead +
+		float64(u.CacheWriteTokens)*p.CacheWrite) / 1e6
+}
+
+// priceFor looks model up in the pricing table: an exact key wins,
+// otherwise the longest key contained in the model name, so "sonnet"
+// prices "claude-sonnet-4-5".
+func (p *Pipeline) priceFor(model string) (Price, bool) {
+	if model == "" {
+		return Price{}, false
+	}
+	if price, ok := p.Pricing[model]; ok {
+		return price, true
+	}
+	best := ""
+	for key := range p.Pricing {
+		if strings.Contains(model, key) && len(key) > len(best) {
+			best = key
+		}
+	}
+	if best == "" {
+		return Price{}, false
+	}
+	return p.Pricing[best], true
+}
+
+// agentModel returns the model an agent is configured to use, from its
+// model setting or a --model/-m argument
+func agentModel(cfg AgentConfig) string {
+	if cfg.Model != "" {
+		return cfg.Model
+	}
+	for k, arg := range cfg.Args {
+		if value, ok := strings.CutPrefix(arg, "--model="); ok {
+			return value
+		}
+		if (arg == "--model" || arg == "-m") && k+1 < len(cfg.Args) {
+			return cfg.Args[k+1]
+		}
+	}
+	return ""
+}
+
+// estimateUsage guesses the tokens of an exchange from its size, for agents
+// that do not report usage
+func estimateUsage(prompt, output string) Usage {
+	return Usage{
+		InputTokens:  (len(prompt) + charsPerToken - 1) / charsPerToken,
+		OutputTokens: (len(output) + charsPerToken - 1) / charsPerToken,
+		Estimated:    true,
+	}
+}
+
+// meterUsage returns the usage of one agent call: what the agent reported,
+// or an estimate when it reported nothing, priced from the pricing table
+// unless the agent already gave a cost
+func (p *Pipeline) meterUsage(cfg AgentConfig, prompt string, result *AgentResult) Usage {
+	u := result.Usage
+	if u.IsZero() {
+		if result.Output == "" {
+			return Usage{}
+		}
+		u = estimateUsage(prompt, result.Output)
+	}
+	if u.CostUSD == 0 {
+		if price, ok := p.priceFor(agentModel(cfg)); ok {
+			u.CostUSD = price.cost(u)
+		}
+	}
+	return u
+}
+
+// IsZero reports whether u records nothing
+func (u Usage) IsZero() bool {
+	return u.InputTokens == 0 && u.OutputTokens == 0 &&
+		u.CacheReadTokens == 0 && u.CacheWriteTokens == 0 && u.CostUSD == 0
+}
+
+// String formats u for the headless summary and the TUI, with a leading ~
+// when part of it was estimated
+func (u Usage) String() string {
+	s := fmt.Sprintf("%s in / %s out tokens", formatTokens(u.InputTokens), formatTokens(u.OutputTokens))
+	if u.CostUSD > 0 {
+		s += fmt.Sprintf(", $%.4f", u.CostUSD)
+	}
+	if u.Estimated {
+		s = "~" + s
+	}
+	return s
+}
+
+func formatTokens(n int) string {
+	switch {
+	case n >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	case n >= 1_000:
+		return fmt.Sprintf("%.1fk", float64(n)/1e3)
+	default:
+		return fmt.Sprintf("%d", n)
+	}
+}
+
+// attemptsUsage sums the usage of a step's attempts, nil if none was recorded
+func attemptsUsage(records []AttemptRecord) *Usage {
+	var total *Usage
+	for _, record := range records {
+		if record.Usage == nil {
+			continue
+		}
+		if total == nil {
+			total = &Usage{}
+		}
+		total.Add(*record.Usage)
+	}
+	return total
+}
+
+// addUsage adds the usage of an agent call made for step i to the run total
+func (r *pipelineRun) addUsage(i int, u Usage) {
+	if u.IsZero() {
+		return
+	}
+
+	r.mu.Lock()
+	r.state.Usage.Add(u)
+	total := r.state.Usage
+	r.mu.Unlock()
+
+	// Outside the lock, so a slow UI does not hold up the other steps
+	if r.cb.OnUsage != nil {
+		r.cb.OnUsage(i, u, total)
+	}
+}
+
+// checkBudget returns ErrBudgetExceeded once the run has spent its budget
+func (r *pipelineRun) checkBudget() error {
+	if r.p.Budget == 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	spent := r.state.Usage.CostUSD
+	r.mu.Unlock()
+	if spent <= r.p.Budget {
+		return nil
+	}
+	return fmt.Errorf("%w: spent $%.4f of $%.2f", ErrBudgetExceeded, spent, r.p.Budget)
+}
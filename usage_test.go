@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPriceFor(t *testing.T) {
+	p := &Pipeline{Pricing: map[string]Price{
+		"sonnet":            {Input: 3, Output: 15},
+		"claude-sonnet-4-5": {Input: 2, Output: 10},
+		"haiku":             {Input: 1, Output: 5},
+	}}
+
+	tests := []struct {
+		model  string
+		want   float64 // input price
+		wantOK bool
+	}{
+		{"claude-sonnet-4-5", 2, true},
+		{"claude-sonnet-4", 3, true},
+		{"claude-haiku-4-5", 1, true},
+		{"gpt-5", 0, false},
+		{"", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			got, ok := p.priceFor(tt.model)
+			if ok != tt.wantOK || got.Input != tt.want {
+				t.Errorf("priceFor(%q) = %+v, %v, want input %v, %v", tt.model, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestAgentModel(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  AgentConfig
+		want string
+	}{
+		{"model setting", AgentConfig{Model: "opus", Args: []string{"--model", "haiku"}}, "opus"},
+		{"model flag", AgentConfig{Args: []string{"-p", "--model", "haiku"}}, "haiku"},
+		{"model flag with value", AgentConfig{Args: []string{"--model=sonnet"}}, "sonnet"},
+		{"short flag", AgentConfig{Args: []string{"-m", "anthropic/claude-sonnet-4"}}, "anthropic/claude-sonnet-4"},
+		{"flag without value", AgentConfig{Args: []string{"--model"}}, ""},
+		{"no model", AgentConfig{Args: []string{"-p"}}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := agentModel(tt.cfg); got != tt.want {
+				t.Errorf("agentModel() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMeterUsage(t *testing.T) {
+	p := &Pipeline{Pricing: map[string]Price{"haiku": {Input: 1, Output: 5}}}
+	priced := AgentConfig{Model: "haiku"}
+
+	tests := []struct {
+		name   string
+		cfg    AgentConfig
+		prompt string
+		result AgentResult
+		want   Usage
+	}{
+		{
+			name:   "reported cost is kept",
+			cfg:    priced,
+			result: AgentResult{Output: "ok", Usage: Usage{InputTokens: 1000, OutputTokens: 100, CostUSD: 0.5}},
+			want:   Usage{InputTokens: 1000, OutputTokens: 100, CostUSD: 0.5},
+		},
+		{
+			name:   "reported tokens are priced",
+			cfg:    priced,
+			result: AgentResult{Output: "ok", Usage: Usage{InputTokens: 1_000_000, OutputTokens: 200_000}},
+			want:   Usage{InputTokens: 1_000_000, OutputTokens: 200_000, CostUSD: 2},
+		},
+		{
+			name:   "estimated from size",
+			cfg:    AgentConfig{},
+			prompt: "12345678",
+			result: AgentResult{Output: "123456789"},
+			want:   Usage{InputTokens: 2, OutputTokens: 3, Estimated: true},
+		},
+		{
+			name:   "no output, nothing spent",
+			cfg:    priced,
+			prompt: "a prompt",
+			want:   Usage{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := p.meterUsage(tt.cfg, tt.prompt, &tt.result)
+			if math.Abs(got.CostUSD-tt.want.CostUSD) > 1e-9 {
+				t.Errorf("cost = %v, want %v", got.CostUSD, tt.want.CostUSD)
+			}
+			got.CostUSD = tt.want.CostUSD
+			if got != tt.want {
+				t.Errorf("meterUsage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsageString(t *testing.T) {
+	tests := []struct {
+		usage Usage
+		want  string
+	}{
+		{Usage{InputTokens: 950, OutputTokens: 12}, "950 in / 12 out tokens"},
+		{Usage{InputTokens: 12_345, OutputTokens: 2_000_000, CostUSD: 0.01234}, "12.3k in / 2.0M out tokens, $0.0123"},
+		{Usage{InputTokens: 40, OutputTokens: 8, Estimated: true}, "~40 in / 8 out tokens"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.usage.String(); got != tt.want {
+			t.Errorf("String() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestBudgetStopsRun(t *testing.T) {
+	t.Chdir(t.TempDir())
+	p := &Pipeline{
+		File:    "budget.yaml",
+		Agent:   AgentConfig{Cmd: "echo", Model: "pricey"},
+		Pricing: map[string]Price{"pricey": {Input: 1_000_000, Output: 1_000_000}},
+		Budget:  1,
+		Steps: []Step{
+			{Name: "first", Prompt: "hello"},
+			{Name: "second", Prompt: "again"},
+		},
+	}
+
+	var steps []int
+	cb := Callbacks{OnUsage: func(i int, _ Usage, _ Usage) { steps = append(steps, i) }}
+	err := RunPipelineWithCallbacks(context.Background(), p, cb, RunOptions{Iteration: 1})
+	if !errors.Is(err, ErrBudgetExceeded) {
+		t.Fatalf("RunPipelineWithCallbacks() error = %v, want ErrBudgetExceeded", err)
+	}
+	if len(steps) != 1 || steps[0] != 0 {
+		t.Errorf("metered steps = %v, want only the first", steps)
+	}
+
+	state, err := LoadState(p.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := state.Steps["first"]
+	if cp == nil || cp.Usage == nil || !cp.Usage.Estimated || cp.Usage.CostUSD <= 1 {
+		t.Errorf("first checkpoint usage = %+v, want an estimated cost over the budget", cp)
+	}
+	if state.Usage.CostUSD != cp.Usage.CostUSD {
+		t.Errorf("run usage = %+v, want %+v", state.Usage, *cp.Usage)
+	}
+	if _, ok := state.Steps["second"]; ok {
+		t.Error("second step ran after the budget was spent")
+	}
+}
+
+func TestSlowUsageCallback(t *testing.T) {
+	t.Chdir(t.TempDir())
+	p := &Pipeline{
+		File:  "usage.yaml",
+		Agent: AgentConfig{Cmd: "echo"},
+		Steps: []Step{
+			{Name: "agent", Prompt: "hello", DependsOn: []string{}},
+			{Name: "shell", Run: "sleep 0.2; echo done", DependsOn: []string{}},
+		},
+	}
+
+	// The usage callback of one step waits for the other step to finish
+	shellDone := make(chan struct{})
+	cb := Callbacks{
+		OnStart: func(int, string) {},
+		OnUsage: func(int, Usage, Usage) {
+			select {
+			case <-shellDone:
+			case <-time.After(5 * time.Second):
+				t.Error("the other step could not finish while the usage callback ran")
+			}
+		},
+		OnComplete: func(i int, _ time.Duration, _ error) {
+			if i == 1 {
+				close(shellDone)
+			}
+		},
+	}
+	if err := RunPipelineWithCallbacks(context.Background(), p, cb, RunOptions{Iteration: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
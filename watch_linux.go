@@ -0,0 +1,190 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB | syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR
+
+// inotify watches every tracked directory of a tree. Its file descriptor is
+// non-blocking, so closing it wakes up the reading goroutine.
+type inotify struct {
+	file    *os.File
+	fd      int
+	mu      sync.Mutex
+	watches map[int32]string // directory of each watch descriptor, slash-separated
+
+	// Events are queued in order, so once a file created in a directory of
+	// its own is read, every earlier event is too
+	syncMu  sync.Mutex
+	syncDir string
+	syncWd  int32
+	syncs   int
+	synced  chan string // names created in syncDir, as they are read
+}
+
+// newFileWatcher watches the tree of s with inotify and builds the index
+func newFileWatcher(s *fileScanner) (*fileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	n := &inotify{file: os.NewFile(uintptr(fd), "inotify"), fd: fd, watches: make(map[int32]string), synced: make(chan string, 16)}
+	w := &fileWatcher{scanner: s, notifier: n}
+
+	if n.syncDir, err = os.MkdirTemp("", "octos-sync-*"); err != nil {
+		n.Close()
+		return nil, err
+	}
+	wd, err := syscall.InotifyAddWatch(fd, n.syncDir, syscall.IN_CREATE)
+	if err != nil {
+		n.Close()
+		return nil, err
+	}
+	n.syncWd = int32(wd)
+	if err := n.addTree(s, ""); err != nil {
+		n.Close()
+		return nil, err
+	}
+	w.files = s.scan("")
+	go n.read(w)
+	return w, nil
+}
+
+// addTree watches dir and the directories below it that are not skipped
+func (n *inotify) addTree(s *fileScanner, dir string) error {
+	rules := slices.Clone(s.ignore)
+	if dir != "" {
+		rules = s.rulesFor(path.Dir(dir))
+	}
+	return filepath.WalkDir(filepath.Join(s.root, filepath.FromSlash(dir)), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(s.root, p)
+		name := filepath.ToSlash(rel)
+		if name == "." {
+			name = ""
+		} else if s.skipDir(name, rules) {
+			return filepath.SkipDir
+		}
+		if data, err := os.ReadFile(filepath.Join(p, ".gitignore")); err == nil {
+			rules = append(rules, parseIgnore(name, string(data))...)
+		}
+
+		wd, err := syscall.InotifyAddWatch(n.fd, p, inotifyMask)
+		if errors.Is(err, syscall.ENOSPC) {
+			return errors.New("too many directories to watch, raise fs.inotify.max_user_watches or exclude some with watch.exclude")
+		}
+		if err != nil {
+			return nil // removed meanwhile
+		}
+		n.mu.Lock()
+		n.watches[int32(wd)] = name
+		n.mu.Unlock()
+		return nil
+	})
+}
+
+// read turns events into changes of w until the notifier is closed
+func (n *inotify) read(w *fileWatcher) {
+	buf := make([]byte, 64<<10)
+	for {
+		size, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= size; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				w.lost()
+				continue
+			}
+			if ev.Wd == n.syncWd {
+				select {
+				case n.synced <- cString(nameBytes):
+				default:
+				}
+				continue
+			}
+			n.mu.Lock()
+			dir, ok := n.watches[ev.Wd]
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(n.watches, ev.Wd)
+			}
+			n.mu.Unlock()
+			if !ok || ev.Len == 0 {
+				continue
+			}
+
+			name := filepath.ToSlash(filepath.Join(dir, cString(nameBytes)))
+			if ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				if err := n.addTree(w.scanner, name); err != nil {
+					w.lost()
+				}
+			}
+			w.changed(name)
+		}
+	}
+}
+
+// cString returns b up to its first NUL byte
+func cString(b []byte) string {
+	for k, c := range b {
+		if c == 0 {
+			return string(b[:k])
+		}
+	}
+	return string(b)
+}
+
+// sync creates a file in the directory of its own and waits for its event
+func (n *inotify) sync() error {
+	n.syncMu.Lock()
+	defer n.syncMu.Unlock()
+	n.syncs++
+	name := strconv.Itoa(n.syncs)
+	file := filepath.Join(n.syncDir, name)
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		return err
+	}
+	defer os.Remove(file)
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case got := <-n.synced:
+			if got == name {
+				return nil
+			}
+		case <-timeout:
+			return errors.New("file system events were not delivered in time")
+		}
+	}
+}
+
+func (n *inotify) Close() error {
+	if n.syncDir != "" {
+		os.RemoveAll(n.syncDir)
+	}
+	return n.file.Close()
+}
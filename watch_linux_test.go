@@ -0,0 +1,96 @@
+//go:build linux
+
+package main
+
+import (
+	"maps"
+	"os"
+	"os/exec"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFileWatcher(t *testing.T) {
+	t.Chdir(t.TempDir())
+	writeTree(t, map[string]string{".gitignore": "build/\n", "src/a.go": "a", "old.txt": "old"})
+	s := newFileScanner(".", WatchConfig{Exclude: StringList{"vendor/**"}})
+	if err := s.startWatching(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	before := s.state()
+	live := make(chan []string, 16)
+	stop := s.live(before, func(changes []string) { live <- changes })
+	defer stop()
+
+	writeTree(t, map[string]string{
+		"src/a.go":            "changed",
+		"src/new/deep/b.go":   "b",
+		"build/out.bin":       "",
+		"src/build/x.o":       "",
+		"vendor/lib/lib.go":   "",
+		"node_modules/x/i.js": "",
+	})
+	os.Remove("old.txt")
+
+	want := []string{"- old.txt", "M src/a.go", "+ src/new/deep/b.go"}
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case changes := <-live:
+			if slices.Equal(changes, want) {
+				// The index the watcher keeps matches a fresh scan
+				files, ok := s.watcher.index()
+				if !ok {
+					t.Fatal("index was never built")
+				}
+				got := slices.Sorted(maps.Keys(files))
+				scanned := slices.Sorted(maps.Keys(s.scan("")))
+				if !slices.Equal(got, scanned) {
+					t.Errorf("index = %q, scan = %q", got, scanned)
+				}
+				return
+			}
+		case <-deadline:
+			t.Fatalf("live changes never became %q, last state %q", want, s.diff(before, s.state()))
+		}
+	}
+}
+
+func TestWatchedGitSnapshot(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Chdir(t.TempDir())
+	writeTree(t, map[string]string{".gitignore": "*.log\n", "src/a.go": "a", "old.txt": "old", "same.txt": "same"})
+	for _, args := range [][]string{{"init", "-q"}, {"add", "."}, {"commit", "-qm", "init"}} {
+		if _, err := gitOutput(".", checkpointEnv, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newFileScanner(".", WatchConfig{})
+	if err := s.startWatching(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	snap := s.snapshot()
+	defer snap.close()
+	if snap.index == nil {
+		t.Fatal("the index of the snapshot was not kept")
+	}
+	writeTree(t, map[string]string{"src/a.go": "changed", "src/new/deep/b.go": "b", "debug.log": "", "same.txt": "same"})
+	os.Remove("old.txt")
+
+	// Only the paths the watcher saw change are added again
+	want := []string{"- old.txt", "M src/a.go", "+ src/new/deep/b.go"}
+	if got := snap.changes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes = %q, want %q", got, want)
+	}
+	if full, err := s.gitTree(); err != nil || full != snap.after {
+		t.Errorf("tree after the step = %s, a full snapshot gives %s (%v)", snap.after, full, err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// newFileWatcher is only implemented with inotify; elsewhere notify mode
+// falls back to scanning
+func newFileWatcher(s *fileScanner) (*fileWatcher, error) {
+	return nil, errors.New("watching files is only supported on Linux")
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Ways of isolating a run from the checkout, for --isolate
+const (
+	IsolateWorktree = "worktree" // a git worktree on a new branch
+	IsolateCopy     = "copy"     // a copy of the project in a temporary directory
+)
+
+// validateIsolation checks the value of --isolate
+func validateIsolation(mode string) error {
+	switch mode {
+	case "", IsolateWorktree, IsolateCopy:
+		return nil
+	}
+	return fmt.Errorf("--isolate must be %s or %s, got %q", IsolateWorktree, IsolateCopy, mode)
+}
+
+// Workspace is where an isolated run works, away from the checkout Octos
+// was started in. State, artifacts and the run store stay in the checkout.
+type Workspace struct {
+	Mode   string `json:"mode"`
+	Root   string `json:"root"`             // the worktree or the copy
+	Dir    string `json:"dir"`              // where steps run: Root, or the subdirectory of it Octos was started in
+	Branch string `json:"branch,omitempty"` // worktree: the branch of the run
+	Base   string `json:"base,omitempty"`   // copy: the commit of the copied project
+	Result string `json:"result,omitempty"` // branch or patch holding the changes of the run
+}
+
+// workdir is the directory steps run in: the workspace of an isolated run,
+// or the current directory
+func (r *pipelineRun) workdir() string {
+	if r.workspace != nil {
+		return r.workspace.Dir
+	}
+	return "."
+}
+
+// openWorkspace creates the workspace of run id. A resumed run continues in
+// the workspace it already has.
+func openWorkspace(mode, id string, resume bool) (*Workspace, error) {
+	if resume {
+		if run, err := loadRun(id); err == nil && run.Workspace != nil {
+			if _, err := os.Stat(run.Workspace.Dir); err == nil {
+				run.Workspace.Result = ""
+				return run.Workspace, nil
+			}
+		}
+	}
+
+	switch mode {
+	case IsolateWorktree:
+		return newWorktree(id)
+	case IsolateCopy:
+		return newCopy(id)
+	}
+	return nil, nil
+}
+
+// worktreesDir is where the worktrees of isolated runs are added: in the
+// user cache, outside the project, so tools walking it do not find them
+func worktreesDir() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "octos", "worktrees")
+}
+
+// newWorktree adds a git worktree on branch octos/<id>, from HEAD
+func newWorktree(id string) (*Workspace, error) {
+	prefix, err := gitOutput(".", nil, "rev-parse", "--show-prefix")
+	if err != nil {
+		return nil, fmt.Errorf("--isolate=worktree needs a git repository: %w", err)
+	}
+	top, err := gitOutput(".", nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	root := filepath.Join(worktreesDir(), filepath.Base(strings.TrimSpace(top))+"-"+id)
+	if err := os.MkdirAll(filepath.Dir(root), 0755); err != nil {
+		return nil, err
+	}
+	ws := &Workspace{
+		Mode:   IsolateWorktree,
+		Root:   root,
+		Dir:    filepath.Join(root, strings.TrimSpace(prefix)),
+		Branch: "octos/" + id,
+	}
+	if _, err := gitOutput(".", nil, "worktree", "add", "-q", "-b", ws.Branch, root, "HEAD"); err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// newCopy copies the project into a temporary directory, leaving out what
+// git ignores, even outside a git repository, and commits the copy so its changes can be exported as a
+// patch
+func newCopy(id string) (*Workspace, error) {
+	root, err := os.MkdirTemp("", "octos-"+id+"-")
+	if err != nil {
+		return nil, err
+	}
+	ws := &Workspace{Mode: IsolateCopy, Root: root, Dir: root}
+
+	files := walkProject(".", false)
+	if out, err := gitOutput(".", nil, "ls-files", "-z", "--cached", "--others", "--exclude-standard"); err == nil {
+		files = strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	}
+	for _, name := range files {
+		if name == "" || name == ".octos" || strings.HasPrefix(name, ".octos/") {
+			continue
+		}
+		if err := copyPath(filepath.FromSlash(name), filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			os.RemoveAll(root)
+			return nil, fmt.Errorf("copy %s: %w", name, err)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "-A"},
+		{"commit", "-q", "--allow-empty", "--no-verify", "--no-gpg-sign", "-m", "octos: copy of the project"},
+	} {
+		if _, err := gitOutput(root, checkpointEnv, args...); err != nil {
+			os.RemoveAll(root)
+			return nil, err
+		}
+	}
+	base, err := gitOutput(root, nil, "rev-parse", "HEAD")
+	if err != nil {
+		os.RemoveAll(root)
+		return nil, err
+	}
+	ws.Base = strings.TrimSpace(base)
+	return ws, nil
+}
+
+// copyPath copies the file or symlink src to dst, keeping its mode.
+// Directories, like submodules, are skipped.
+func copyPath(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // deleted, but still in the index
+		}
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// finish exports the changes of a successful run, to the branch of a
+// worktree or to a patch in the run store, and removes the workspace. A
+// failed run keeps it, so it can be resumed.
+func (ws *Workspace) finish(id string, runErr error) error {
+	if runErr != nil {
+		return nil
+	}
+
+	status, err := gitOutput(ws.Root, nil, "status", "--porcelain")
+	if err != nil {
+		return err
+	}
+	changed := strings.TrimSpace(status) != ""
+
+	switch ws.Mode {
+	case IsolateWorktree:
+		if changed {
+			env := checkpointEnv
+			if _, err := gitOutput(ws.Root, nil, "config", "user.email"); err == nil {
+				env = nil // commit as the user
+			}
+			if _, err := gitOutput(ws.Root, nil, "add", "-A"); err != nil {
+				return err
+			}
+			if _, err := gitOutput(ws.Root, env, "commit", "-q", "--no-verify", "--no-gpg-sign", "-m", "octos: run "+id); err != nil {
+				return err
+			}
+			ws.Result = ws.Branch
+		}
+		if _, err := gitOutput(".", nil, "worktree", "remove", "--force", ws.Root); err != nil {
+			return err
+		}
+		if !changed {
+			gitOutput(".", nil, "branch", "-D", ws.Branch)
+		}
+
+	case IsolateCopy:
+		if changed {
+			if _, err := gitOutput(ws.Root, nil, "add", "-A"); err != nil {
+				return err
+			}
+			patch, err := gitOutput(ws.Root, nil, "diff", "--cached", "--binary", ws.Base)
+			if err != nil {
+				return err
+			}
+			path := filepath.Join(getRunsDir(), id, "changes.patch")
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(path, []byte(patch), 0644); err != nil {
+				return err
+			}
+			ws.Result = path
+		}
+		if err := os.RemoveAll(ws.Root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes the workspace of a run, keeping the branch of a worktree
+func (ws *Workspace) remove() {
+	if ws.Mode == IsolateWorktree {
+		gitOutput(".", nil, "worktree", "remove", "--force", ws.Root)
+		return
+	}
+	os.RemoveAll(ws.Root)
+}
+
+// summary tells where the changes of a finished isolated run are
+func (ws *Workspace) summary(runErr error) string {
+	switch {
+	case runErr != nil:
+		return fmt.Sprintf("Workspace kept in %s, continue in it with --resume", ws.Root)
+	case ws.Result == "":
+		return "The isolated run changed no files"
+	case ws.Mode == IsolateWorktree:
+		return fmt.Sprintf("Changes committed to branch %s, merge them with: git merge %s", ws.Result, ws.Result)
+	default:
+		return fmt.Sprintf("Changes saved to %s, apply them with: git apply %s", ws.Result, ws.Result)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateIsolation(t *testing.T) {
+	tests := []struct {
+		mode    string
+		wantErr bool
+	}{
+		{"", false},
+		{IsolateWorktree, false},
+		{IsolateCopy, false},
+		{"tmp", true},
+	}
+
+	for _, tt := range tests {
+		if err := validateIsolation(tt.mode); (err != nil) != tt.wantErr {
+			t.Errorf("validateIsolation(%q) = %v, want error %v", tt.mode, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWorkspaceSummary(t *testing.T) {
+	tests := []struct {
+		name string
+		ws   Workspace
+		err  error
+		want string
+	}{
+		{"failed", Workspace{Root: "/tmp/ws"}, errors.New("boom"), "Workspace kept in /tmp/ws"},
+		{"no changes", Workspace{Mode: IsolateCopy}, nil, "changed no files"},
+		{"worktree", Workspace{Mode: IsolateWorktree, Result: "octos/run1"}, nil, "git merge octos/run1"},
+		{"copy", Workspace{Mode: IsolateCopy, Result: "changes.patch"}, nil, "git apply changes.patch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ws.summary(tt.err); !strings.Contains(got, tt.want) {
+				t.Errorf("summary = %q, want it to contain %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsolatedRun(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	p := &Pipeline{
+		File: "p.yaml",
+		Steps: []Step{
+			{Name: "write", Run: "echo v2 > main.go; echo new > new.go; test ! -e build/out.bin"},
+			{Name: "check", Run: "test -f new.go"},
+		},
+	}
+
+	copyResult := func(t *testing.T, run *RunRecord) string {
+		data, err := os.ReadFile(run.Workspace.Result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, _ := gitOutput(".", nil, "apply", "--stat", run.Workspace.Result)
+		if strings.Contains(string(data), "out.bin") {
+			t.Error("patch contains an ignored file")
+		}
+		return out
+	}
+
+	tests := []struct {
+		name  string
+		mode  string
+		noGit bool
+		// result returns the diff between HEAD and the changes of run
+		result func(t *testing.T, run *RunRecord) string
+	}{
+		{IsolateWorktree, IsolateWorktree, false, func(t *testing.T, run *RunRecord) string {
+			if run.Workspace.Result != "octos/"+run.ID || run.Branch != run.Workspace.Result {
+				t.Errorf("result = %q, branch = %q, want the branch of the run", run.Workspace.Result, run.Branch)
+			}
+			out, _ := gitOutput(".", nil, "diff", "--stat", "HEAD", run.Workspace.Result)
+			return out
+		}},
+		{IsolateCopy, IsolateCopy, false, copyResult},
+		{"copy outside git", IsolateCopy, true, copyResult},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			project := t.TempDir()
+			t.Chdir(project)
+			t.Setenv("XDG_CACHE_HOME", t.TempDir())
+			if tt.noGit {
+				t.Setenv("GIT_CEILING_DIRECTORIES", filepath.Dir(project))
+			}
+			git := func(args ...string) {
+				t.Helper()
+				if tt.noGit {
+					return
+				}
+				if _, err := gitOutput(".", checkpointEnv, args...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			git("init", "-q")
+			os.WriteFile(".gitignore", []byte("build/\n.octos/\n"), 0644)
+			os.WriteFile("main.go", []byte("v1\n"), 0644)
+			git("add", ".")
+			git("commit", "-qm", "init")
+			os.MkdirAll("build", 0755)
+			os.WriteFile("build/out.bin", []byte("ignored"), 0644)
+
+			err := RunPipelineWithCallbacks(context.Background(), p, Callbacks{}, RunOptions{Iteration: 1, Isolate: tt.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if data, _ := os.ReadFile("main.go"); string(data) != "v1\n" {
+				t.Errorf("checkout changed: main.go = %q", data)
+			}
+			if _, err := os.Stat("new.go"); err == nil {
+				t.Error("checkout changed: new.go was created")
+			}
+
+			run, err := latestRun(p.File)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if run.Workspace == nil || run.Workspace.Mode != tt.mode {
+				t.Fatalf("workspace = %+v, want mode %s", run.Workspace, tt.mode)
+			}
+			if _, err := os.Stat(run.Workspace.Root); err == nil {
+				t.Errorf("workspace %s was not removed", run.Workspace.Root)
+			}
+			if strings.HasPrefix(run.Workspace.Root, project) {
+				t.Errorf("workspace %s is inside the project", run.Workspace.Root)
+			}
+
+			var files []string
+			for _, line := range strings.Split(strings.TrimSpace(tt.result(t, run)), "\n") {
+				if fields := strings.Fields(line); len(fields) > 0 && strings.HasSuffix(fields[0], ".go") {
+					files = append(files, filepath.Base(fields[0]))
+				}
+			}
+			if want := []string{"main.go", "new.go"}; !reflect.DeepEqual(files, want) {
+				t.Errorf("changed files = %q, want %q", files, want)
+			}
+		})
+	}
+}
+
+func TestIsolatedRunResume(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Chdir(t.TempDir())
+	if _, err := gitOutput(".", nil, "init", "-q"); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Pipeline{
+		File: "p.yaml",
+		Steps: []Step{
+			{Name: "first", Run: "echo one > one.txt"},
+			{Name: "flaky", Run: "test -f ok || { touch ok; exit 1; }"},
+		},
+	}
+	if err := RunPipelineWithCallbacks(context.Background(), p, Callbacks{}, RunOptions{Iteration: 1, Isolate: IsolateCopy}); err == nil {
+		t.Fatal("first run succeeded")
+	}
+	failed, err := latestRun(p.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(failed.Workspace.Dir, "one.txt")); err != nil {
+		t.Fatalf("workspace of the failed run was not kept: %v", err)
+	}
+
+	// Resuming continues in the same workspace, without --isolate
+	if err := RunPipelineWithCallbacks(context.Background(), p, Callbacks{}, RunOptions{Iteration: 1, Resume: true}); err != nil {
+		t.Fatal(err)
+	}
+	run, err := latestRun(p.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.ID != failed.ID || run.Workspace.Result == "" {
+		t.Fatalf("resumed run %s has workspace %+v", run.ID, run.Workspace)
+	}
+	patch, _ := os.ReadFile(run.Workspace.Result)
+	for _, file := range []string{"one.txt", "ok"} {
+		if !strings.Contains(string(patch), "b/"+file) {
+			t.Errorf("patch does not contain %s:\n%s", file, patch)
+		}
+	}
+	if _, err := os.Stat("one.txt"); err == nil {
+		t.Error("checkout changed: one.txt was created")
+	}
+}